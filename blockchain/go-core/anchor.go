@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// SidechainValidatorSet is a sidechain's federated M-of-N validator set
+// Anchored headers need signatures from Threshold distinct validators
+type SidechainValidatorSet struct {
+	Validators []string // Wallet addresses (public keys) of the federated validators
+	Threshold  int
+}
+
+// Validate checks that the validator set is well formed
+func (v SidechainValidatorSet) Validate() error {
+	if len(v.Validators) == 0 {
+		return fmt.Errorf("validator set has no validators")
+	}
+	if v.Threshold < 1 || v.Threshold > len(v.Validators) {
+		return fmt.Errorf("threshold %d must be between 1 and %d", v.Threshold, len(v.Validators))
+	}
+	seen := make(map[string]bool)
+	for _, validator := range v.Validators {
+		if seen[validator] {
+			return fmt.Errorf("duplicate validator %s", validator)
+		}
+		seen[validator] = true
+	}
+	return nil
+}
+
+// IsMember checks whether an address is one of the validators
+func (v SidechainValidatorSet) IsMember(address string) bool {
+	for _, validator := range v.Validators {
+		if validator == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy returns a copy of the validator set
+func (v SidechainValidatorSet) Copy() SidechainValidatorSet {
+	return SidechainValidatorSet{Validators: append([]string(nil), v.Validators...), Threshold: v.Threshold}
+}
+
+// ScheduledValidatorSet is a validator set in effect from a sidechain block onwards
+type ScheduledValidatorSet struct {
+	EffectiveBlock int // First sidechain block the set signs
+	Validators     SidechainValidatorSet
+}
+
+// SidechainValidatorRotation is the payload of a TxSidechainValidatorRotation transaction
+type SidechainValidatorRotation struct {
+	SidechainID    string
+	Validators     SidechainValidatorSet
+	EffectiveBlock int
+}
+
+// SidechainRegistration is the payload of a TxSidechainRegistration transaction
+type SidechainRegistration struct {
+	SidechainID string
+	Name        string
+	Validators  SidechainValidatorSet
+	Fee         *big.Int // Fee per sidechain transfer or burn, paid to the operator; nil for none
+}
+
+// SidechainAnchor is the main chain's record of a registered sidechain and its anchored headers
+// Headers are verified against it alone, without the sidechain's blocks
+type SidechainAnchor struct {
+	ID               string
+	Name             string
+	Operator         string                  // Sender of the registration transaction
+	Fee              *big.Int                // Sidechain fee policy, nil for free transactions
+	ValidatorSets    []ScheduledValidatorSet // Validator sets ordered by effective block, the first from block 0
+	RegisteredHeight int
+	LastBlock        int              // Last sidechain block covered by an anchored header, -1 before the first
+	LastHeaderHash   string           // Hash of the last anchored header
+	LastAnchorHeight int              // Main-chain block that anchored the last header
+	Headers          []AnchoredHeader // Anchored headers in range order
+
+	Deposits    []BridgeDeposit              // Bridge deposits in order
+	Withdrawals map[string]*BridgeWithdrawal // Claimed bridge withdrawals by burn transaction ID
+
+	// Validators that signed a fraudulent header, by the height they were penalized
+	// Their signatures no longer count towards any header
+	Penalized map[string]int
+}
+
+// AnchoredHeader records a header accepted by the main chain
+type AnchoredHeader struct {
+	StartBlock       int
+	EndBlock         int
+	HeaderHash       string
+	MerkleRoot       string
+	TransactionCount int
+	StateRoot        string   // Sidechain ledger root after the range
+	TraceRoot        string   // Merkle root of the ledger roots after each transaction in the range
+	AnchorHeight     int      // Main-chain block that anchored the header
+	Signers          []string // Validators whose signatures were counted
+	Invalid          bool     // Proven fraudulent by a fraud proof, or anchored on top of a range that was
+	InvalidHeight    int
+}
+
+// Copy returns a deep copy of the anchor
+func (a *SidechainAnchor) Copy() *SidechainAnchor {
+	c := *a
+	if a.Fee != nil {
+		c.Fee = new(big.Int).Set(a.Fee)
+	}
+	c.Headers = nil
+	for _, header := range a.Headers {
+		header.Signers = append([]string(nil), header.Signers...)
+		c.Headers = append(c.Headers, header)
+	}
+	c.Penalized = make(map[string]int, len(a.Penalized))
+	for validator, height := range a.Penalized {
+		c.Penalized[validator] = height
+	}
+	c.Deposits = nil
+	for _, deposit := range a.Deposits {
+		deposit.Amount = new(big.Int).Set(deposit.Amount)
+		c.Deposits = append(c.Deposits, deposit)
+	}
+	c.Withdrawals = make(map[string]*BridgeWithdrawal, len(a.Withdrawals))
+	for id, withdrawal := range a.Withdrawals {
+		c.Withdrawals[id] = withdrawal.Copy()
+	}
+	c.ValidatorSets = nil
+	for _, scheduled := range a.ValidatorSets {
+		c.ValidatorSets = append(c.ValidatorSets, ScheduledValidatorSet{
+			EffectiveBlock: scheduled.EffectiveBlock,
+			Validators:     scheduled.Validators.Copy(),
+		})
+	}
+	return &c
+}
+
+// ValidatorsFor returns the validator set that signs a sidechain block
+func (a *SidechainAnchor) ValidatorsFor(block int) SidechainValidatorSet {
+	validators := a.ValidatorSets[0].Validators
+	for _, scheduled := range a.ValidatorSets {
+		if scheduled.EffectiveBlock > block {
+			break
+		}
+		validators = scheduled.Validators
+	}
+	return validators
+}
+
+// TransactionFee returns the fee the sidechain charges per transfer or burn
+func (a *SidechainAnchor) TransactionFee() *big.Int {
+	if a.Fee == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(a.Fee)
+}
+
+// HeaderFor returns the latest anchored header covering a sidechain block
+// Ranges anchored again after a fraud proof replace the invalid headers they follow
+func (a *SidechainAnchor) HeaderFor(block int) (AnchoredHeader, bool) {
+	for i := len(a.Headers) - 1; i >= 0; i-- {
+		if header := a.Headers[i]; header.StartBlock <= block && block <= header.EndBlock {
+			return header, true
+		}
+	}
+	return AnchoredHeader{}, false
+}
+
+// HeaderForRange returns the latest anchored header for an exact block range
+func (a *SidechainAnchor) HeaderForRange(blockRange string) (AnchoredHeader, bool) {
+	if index := a.headerIndex(blockRange); index >= 0 {
+		return a.Headers[index], true
+	}
+	return AnchoredHeader{}, false
+}
+
+// headerIndex returns the position of the latest header anchored for a block range, or -1
+func (a *SidechainAnchor) headerIndex(blockRange string) int {
+	for i := len(a.Headers) - 1; i >= 0; i-- {
+		if fmt.Sprintf("%d-%d", a.Headers[i].StartBlock, a.Headers[i].EndBlock) == blockRange {
+			return i
+		}
+	}
+	return -1
+}
+
+// stateRootBefore returns the ledger root a header's range was applied to: the root of
+// the last valid header before it, or the empty ledger's root for the first
+func (a *SidechainAnchor) stateRootBefore(index int) string {
+	for i := index - 1; i >= 0; i-- {
+		if !a.Headers[i].Invalid {
+			return a.Headers[i].StateRoot
+		}
+	}
+	return NewSidechainState().StateRoot()
+}
+
+// signsFor returns a check accepting the validators whose signatures count for a
+// sidechain block: members of the set in effect that have not been penalized
+func (a *SidechainAnchor) signsFor(block int) func(address string) bool {
+	validators := a.ValidatorsFor(block)
+	return func(address string) bool {
+		_, penalized := a.Penalized[address]
+		return validators.IsMember(address) && !penalized
+	}
+}
+
+// LatestValidators returns the most recently scheduled validator set
+func (a *SidechainAnchor) LatestValidators() SidechainValidatorSet {
+	return a.ValidatorSets[len(a.ValidatorSets)-1].Validators
+}
+
+// NewSidechainRegistrationTransaction creates a transaction registering a sidechain
+// and its validator set on the main chain. The operator signs it and pays its fee.
+func NewSidechainRegistrationTransaction(operator string, nonce int, registration SidechainRegistration) (*Transaction, error) {
+	data, err := json.Marshal(registration)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      TxSidechainRegistration,
+		Sender:    operator,
+		Recipient: operator,
+		Amount:    big.NewInt(0),
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// NewSidechainValidatorRotationTransaction creates a transaction scheduling a new validator set
+// A threshold of the latest set authorizes it with AddCoSignature; the sender signs it and pays its fee.
+func NewSidechainValidatorRotationTransaction(sender string, nonce int, rotation SidechainValidatorRotation) (*Transaction, error) {
+	data, err := json.Marshal(rotation)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      TxSidechainValidatorRotation,
+		Sender:    sender,
+		Recipient: sender,
+		Amount:    big.NewInt(0),
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// applySidechainRegistration records a new sidechain with its validator set
+func (s *ChainState) applySidechainRegistration(tx *Transaction) error {
+	var registration SidechainRegistration
+	if err := json.Unmarshal([]byte(tx.Payload), &registration); err != nil {
+		return fmt.Errorf("invalid sidechain registration payload: %v", err)
+	}
+	if registration.SidechainID == "" {
+		return fmt.Errorf("sidechain registration needs an ID")
+	}
+	if _, exists := s.Sidechains[registration.SidechainID]; exists {
+		return fmt.Errorf("sidechain %s is already registered", registration.SidechainID)
+	}
+	if err := registration.Validators.Validate(); err != nil {
+		return err
+	}
+	if registration.Fee != nil && registration.Fee.Sign() < 0 {
+		return fmt.Errorf("negative sidechain fee %s", registration.Fee.String())
+	}
+
+	s.Sidechains[registration.SidechainID] = &SidechainAnchor{
+		ID:               registration.SidechainID,
+		Name:             registration.Name,
+		Operator:         tx.Sender,
+		Fee:              registration.Fee,
+		ValidatorSets:    []ScheduledValidatorSet{{EffectiveBlock: 0, Validators: registration.Validators.Copy()}},
+		RegisteredHeight: s.blockHeight,
+		LastBlock:        -1,
+		Withdrawals:      make(map[string]*BridgeWithdrawal),
+		Penalized:        make(map[string]int),
+	}
+	return nil
+}
+
+// applySidechainValidatorRotation schedules a validator set authorized by the latest set
+// The new set can only take effect after the blocks already anchored and scheduled
+func (s *ChainState) applySidechainValidatorRotation(tx *Transaction) error {
+	var rotation SidechainValidatorRotation
+	if err := json.Unmarshal([]byte(tx.Payload), &rotation); err != nil {
+		return fmt.Errorf("invalid validator rotation payload: %v", err)
+	}
+	anchor, exists := s.Sidechains[rotation.SidechainID]
+	if !exists {
+		return fmt.Errorf("sidechain %s is not registered", rotation.SidechainID)
+	}
+	if err := rotation.Validators.Validate(); err != nil {
+		return err
+	}
+	if rotation.EffectiveBlock <= anchor.LastBlock {
+		return fmt.Errorf("effective block %d is already anchored", rotation.EffectiveBlock)
+	}
+	latest := anchor.ValidatorSets[len(anchor.ValidatorSets)-1]
+	if rotation.EffectiveBlock <= latest.EffectiveBlock {
+		return fmt.Errorf("effective block %d must follow the latest set change at block %d", rotation.EffectiveBlock, latest.EffectiveBlock)
+	}
+	// Penalized validators cannot use their remaining votes to replace the set
+	current := anchor.LatestValidators()
+	if signers := tx.ValidCoSigners(anchor.signsFor(latest.EffectiveBlock)); len(signers) < current.Threshold {
+		return fmt.Errorf("authorized by %d of the %d required validators", len(signers), current.Threshold)
+	}
+
+	anchor.ValidatorSets = append(anchor.ValidatorSets, ScheduledValidatorSet{
+		EffectiveBlock: rotation.EffectiveBlock,
+		Validators:     rotation.Validators.Copy(),
+	})
+	return nil
+}
+
+// checkSidechainHeader verifies an anchored header against the sidechain's registration:
+// validator signatures, range continuity and the link to the previous anchored header.
+// It returns the validators whose signatures were counted.
+func (s *ChainState) checkSidechainHeader(header *SidechainHeader) ([]string, error) {
+	anchor, exists := s.Sidechains[header.SidechainID]
+	if !exists {
+		return nil, fmt.Errorf("sidechain %s is not registered", header.SidechainID)
+	}
+	startBlock, endBlock, err := parseBlockRange(header.BlockRange)
+	if err != nil {
+		return nil, err
+	}
+	// Ranges must tile the sidechain: no block anchored twice and none skipped
+	if startBlock <= anchor.LastBlock {
+		return nil, fmt.Errorf("range %s overlaps blocks anchored up to %d", header.BlockRange, anchor.LastBlock)
+	}
+	if startBlock != anchor.LastBlock+1 {
+		return nil, fmt.Errorf("range %s leaves a gap after block %d", header.BlockRange, anchor.LastBlock)
+	}
+	if header.PrevHeaderHash != anchor.LastHeaderHash {
+		return nil, fmt.Errorf("header links to %q, last anchored header is %q", header.PrevHeaderHash, anchor.LastHeaderHash)
+	}
+	// One validator set signs the whole range
+	for _, scheduled := range anchor.ValidatorSets {
+		if scheduled.EffectiveBlock > startBlock && scheduled.EffectiveBlock <= endBlock {
+			return nil, fmt.Errorf("range crosses the validator set change at block %d", scheduled.EffectiveBlock)
+		}
+	}
+	threshold := anchor.ValidatorsFor(startBlock).Threshold
+	signers := header.ValidSigners(anchor.signsFor(startBlock))
+	if len(signers) < threshold {
+		return nil, fmt.Errorf("signed by %d of the %d required validators", len(signers), threshold)
+	}
+	return signers, nil
+}
+
+// NewSidechainAnchorTransaction creates a transaction anchoring a signed header
+// The sender signs it and pays the anchoring fee
+func NewSidechainAnchorTransaction(sender string, nonce int, header SidechainHeader) (*Transaction, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      TxSidechainAnchor,
+		Sender:    sender,
+		Recipient: sender,
+		Amount:    big.NewInt(0),
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// anchorTransactionHeader decodes the header carried by an anchor transaction
+func anchorTransactionHeader(tx *Transaction) (*SidechainHeader, error) {
+	var header SidechainHeader
+	if err := json.Unmarshal([]byte(tx.Payload), &header); err != nil {
+		return nil, fmt.Errorf("invalid sidechain anchor payload: %v", err)
+	}
+	return &header, nil
+}
+
+// applySidechainAnchor anchors the header carried by a transaction
+func (s *ChainState) applySidechainAnchor(tx *Transaction) error {
+	header, err := anchorTransactionHeader(tx)
+	if err != nil {
+		return err
+	}
+	if err := checkAnchoredHeader(*header); err != nil {
+		return err
+	}
+	return s.anchorHeader(header)
+}
+
+// applySidechainHeaders anchors each header carried in a block's SidechainHeaders
+// The proposer pays the fee an anchor transaction for the header would pay, and
+// the total is returned to go into the block's fees
+func (s *ChainState) applySidechainHeaders(block Block, feeSchedule FeeSchedule) (*big.Int, error) {
+	fees := big.NewInt(0)
+	for i := range block.SidechainHeaders {
+		header := &block.SidechainHeaders[i]
+		if err := checkAnchoredHeader(*header); err != nil {
+			return nil, fmt.Errorf("sidechain anchor %s %s: %v", header.SidechainID, header.BlockRange, err)
+		}
+		if err := s.anchorHeader(header); err != nil {
+			return nil, fmt.Errorf("sidechain anchor %s %s: %v", header.SidechainID, header.BlockRange, err)
+		}
+		fee, err := headerAnchoringFee(*header, feeSchedule)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.debit(block.Validator, fee, JournalFee, "Sidechain anchoring fee"); err != nil {
+			return nil, fmt.Errorf("sidechain anchor %s %s: %v", header.SidechainID, header.BlockRange, err)
+		}
+		fees.Add(fees, fee)
+	}
+	return fees, nil
+}
+
+// headerAnchoringFee returns the fee of the anchor transaction that would carry a header
+func headerAnchoringFee(header SidechainHeader, feeSchedule FeeSchedule) (*big.Int, error) {
+	tx, err := NewSidechainAnchorTransaction("", 0, header)
+	if err != nil {
+		return nil, err
+	}
+	return feeSchedule.FeeFor(tx), nil
+}
+
+// anchorHeader checks a header and advances its sidechain's anchor
+func (s *ChainState) anchorHeader(header *SidechainHeader) error {
+	signers, err := s.checkSidechainHeader(header)
+	if err != nil {
+		return err
+	}
+	startBlock, endBlock, _ := parseBlockRange(header.BlockRange)
+	anchor := s.Sidechains[header.SidechainID]
+	anchor.LastBlock = endBlock
+	anchor.LastHeaderHash = header.CalculateHash()
+	anchor.LastAnchorHeight = s.blockHeight
+	anchor.Headers = append(anchor.Headers, AnchoredHeader{
+		StartBlock:       startBlock,
+		EndBlock:         endBlock,
+		HeaderHash:       anchor.LastHeaderHash,
+		MerkleRoot:       header.MerkleRoot,
+		TransactionCount: header.TransactionCount,
+		StateRoot:        header.StateRoot,
+		TraceRoot:        header.TraceRoot,
+		AnchorHeight:     s.blockHeight,
+		Signers:          signers,
+	})
+	return nil
+}
+
+// AnchoredHeaders returns the sidechain headers a block anchors, both those in
+// SidechainHeaders and those carried by anchor transactions
+func (b Block) AnchoredHeaders() []SidechainHeader {
+	headers := append([]SidechainHeader(nil), b.SidechainHeaders...)
+	for _, tx := range b.Transactions {
+		if tx.Type != TxSidechainAnchor {
+			continue
+		}
+		if header, err := anchorTransactionHeader(tx); err == nil {
+			headers = append(headers, *header)
+		}
+	}
+	return headers
+}
+
+// GetSidechainAnchor returns the main chain's anchoring progress for a sidechain
+func GetSidechainAnchor(sidechainID string) map[string]interface{} {
+	state, err := CurrentState()
+	if err != nil {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Error building chain state: %v", err),
+		}
+	}
+	anchor, exists := state.Sidechains[sidechainID]
+	if !exists {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Sidechain %s is not registered", sidechainID),
+		}
+	}
+
+	invalid := 0
+	for _, header := range anchor.Headers {
+		if header.Invalid {
+			invalid++
+		}
+	}
+
+	return map[string]interface{}{
+		"id":                 anchor.ID,
+		"name":               anchor.Name,
+		"operator":           anchor.Operator,
+		"registered_height":  anchor.RegisteredHeight,
+		"last_block":         anchor.LastBlock,
+		"last_header_hash":   anchor.LastHeaderHash,
+		"last_anchor_height": anchor.LastAnchorHeight,
+		"anchored_headers":   len(anchor.Headers),
+		"validator_sets":     len(anchor.ValidatorSets),
+		"invalid_headers":    invalid,
+		"penalized":          len(anchor.Penalized),
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// AnchoringPolicy decides when unanchored sidechain blocks are due for a header
+// A header is built once either limit is reached; a zero limit is disabled
+type AnchoringPolicy struct {
+	BlockInterval int           // Unanchored blocks that trigger a header
+	TimeInterval  time.Duration // Age of the oldest unanchored block that triggers a header
+}
+
+// AnchoringService anchors a sidechain's blocks to the main chain on a policy
+// It builds and signs headers for the unanchored blocks, submits them in anchor
+// transactions paid by the operator, and resubmits until they are included.
+type AnchoringService struct {
+	Sidechain *Sidechain
+	Operator  *Wallet   // Sends the anchor transactions and pays the anchoring fee
+	Signers   []*Wallet // Federated validators whose keys sign the headers
+	Policy    AnchoringPolicy
+
+	Pending     *Transaction // Submitted anchor transaction awaiting inclusion
+	Submissions int          // Anchor transactions built
+	Retries     int          // Resubmissions of a pending transaction
+	Included    int          // Anchor transactions seen on the main chain
+	FeesPaid    *big.Int     // Anchoring fees of the included transactions
+}
+
+// NewAnchoringService creates an anchoring service for a sidechain
+func NewAnchoringService(sc *Sidechain, operator *Wallet, signers []*Wallet, policy AnchoringPolicy) *AnchoringService {
+	return &AnchoringService{
+		Sidechain: sc,
+		Operator:  operator,
+		Signers:   signers,
+		Policy:    policy,
+		FeesPaid:  big.NewInt(0),
+	}
+}
+
+// Tick checks the main chain and returns the anchor transaction to submit, or nil
+// A pending transaction that is not yet included is returned again until it is.
+func (a *AnchoringService) Tick(now time.Time) (*Transaction, error) {
+	state, err := CurrentState()
+	if err != nil {
+		return nil, err
+	}
+	anchor, exists := state.Sidechains[a.Sidechain.ID]
+	if !exists {
+		return nil, fmt.Errorf("sidechain %s is not registered on the main chain", a.Sidechain.ID)
+	}
+
+	if a.Pending != nil {
+		header, err := anchorTransactionHeader(a.Pending)
+		if err != nil {
+			return nil, err
+		}
+		startBlock, _, _ := parseBlockRange(header.BlockRange)
+		switch {
+		case anchoredHash(anchor, startBlock) == header.CalculateHash():
+			a.Included++
+			a.FeesPaid.Add(a.FeesPaid, a.Pending.Fee)
+			a.Pending = nil
+		case anchor.LastBlock >= startBlock || state.Nonces[a.Operator.GetAddress()] > a.Pending.Nonce:
+			// Superseded by another anchor or its nonce was used; build a new one
+			a.Pending = nil
+		default:
+			a.Retries++
+			return a.Pending, nil
+		}
+	}
+
+	startBlock, endBlock, due := a.dueRange(anchor, now)
+	if !due {
+		return nil, nil
+	}
+	tx, err := a.buildAnchorTransaction(anchor, startBlock, endBlock, state.Nonces[a.Operator.GetAddress()])
+	if err != nil {
+		return nil, err
+	}
+	a.Pending = tx
+	a.Submissions++
+	return tx, nil
+}
+
+// anchoredHash returns the hash of the anchored header starting at a block, if any
+func anchoredHash(anchor *SidechainAnchor, startBlock int) string {
+	if anchored, ok := anchor.HeaderFor(startBlock); ok && anchored.StartBlock == startBlock {
+		return anchored.HeaderHash
+	}
+	return ""
+}
+
+// dueRange returns the unanchored block range and whether the policy says to anchor it
+// The range stops before a validator set change, since one set signs each header
+func (a *AnchoringService) dueRange(anchor *SidechainAnchor, now time.Time) (int, int, bool) {
+	startBlock := anchor.LastBlock + 1
+	endBlock := len(a.Sidechain.Blocks) - 1
+	if startBlock > endBlock {
+		return 0, 0, false
+	}
+	for _, scheduled := range anchor.ValidatorSets {
+		if scheduled.EffectiveBlock > startBlock && scheduled.EffectiveBlock <= endBlock {
+			endBlock = scheduled.EffectiveBlock - 1
+			break
+		}
+	}
+
+	unanchored := len(a.Sidechain.Blocks) - startBlock
+	if a.Policy.BlockInterval > 0 && unanchored >= a.Policy.BlockInterval {
+		return startBlock, endBlock, true
+	}
+	oldest := ParseBlockTimestamp(a.Sidechain.Blocks[startBlock].Timestamp)
+	if a.Policy.TimeInterval > 0 && !oldest.IsZero() && now.Sub(oldest) >= a.Policy.TimeInterval {
+		return startBlock, endBlock, true
+	}
+	return 0, 0, false
+}
+
+// buildAnchorTransaction archives the range, then generates, signs and wraps its header
+func (a *AnchoringService) buildAnchorTransaction(anchor *SidechainAnchor, startBlock, endBlock, nonce int) (*Transaction, error) {
+	if _, err := ArchiveSidechainBatch(a.Sidechain, startBlock, endBlock); err != nil {
+		return nil, err
+	}
+	header, err := a.Sidechain.GenerateSidechainHeader(startBlock, endBlock)
+	if err != nil {
+		return nil, err
+	}
+	validators, signs := anchor.ValidatorsFor(startBlock), anchor.signsFor(startBlock)
+	for _, signer := range a.Signers {
+		if !signs(signer.GetAddress()) {
+			continue
+		}
+		if err := header.Sign(signer); err != nil {
+			return nil, err
+		}
+	}
+	if signers := header.ValidSigners(signs); len(signers) < validators.Threshold {
+		return nil, fmt.Errorf("only %d of the %d required validators can sign blocks %s", len(signers), validators.Threshold, header.BlockRange)
+	}
+
+	tx, err := NewSidechainAnchorTransaction(a.Operator.GetAddress(), nonce, *header)
+	if err != nil {
+		return nil, err
+	}
+	if !tx.ProcessTransactionFee() {
+		return nil, fmt.Errorf("operator cannot pay the anchoring fee")
+	}
+	if err := tx.SignTransaction(a.Operator.PrivateKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// GetAnchoringStats returns anchoring lag and submission statistics
+func (a *AnchoringService) GetAnchoringStats(now time.Time) map[string]interface{} {
+	state, err := CurrentState()
+	if err != nil {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Error building chain state: %v", err),
+		}
+	}
+	lastAnchored, lastAnchorHeight := -1, -1
+	if anchor, exists := state.Sidechains[a.Sidechain.ID]; exists {
+		lastAnchored, lastAnchorHeight = anchor.LastBlock, anchor.LastAnchorHeight
+	}
+
+	// Lag in blocks and in the age of the oldest unanchored block
+	unanchored := len(a.Sidechain.Blocks) - 1 - lastAnchored
+	lagSeconds := 0.0
+	if unanchored > 0 {
+		if oldest := ParseBlockTimestamp(a.Sidechain.Blocks[lastAnchored+1].Timestamp); !oldest.IsZero() {
+			lagSeconds = now.Sub(oldest).Seconds()
+		}
+	}
+
+	return map[string]interface{}{
+		"sidechain_id":        a.Sidechain.ID,
+		"sidechain_blocks":    len(a.Sidechain.Blocks),
+		"last_anchored_block": lastAnchored,
+		"last_anchor_height":  lastAnchorHeight,
+		"unanchored_blocks":   unanchored,
+		"lag_seconds":         lagSeconds,
+		"pending":             a.Pending != nil,
+		"submissions":         a.Submissions,
+		"retries":             a.Retries,
+		"included":            a.Included,
+		"fees_paid":           a.FeesPaid.String(),
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// ArchivedBatch is the full data of an anchored sidechain block range
+// Anyone holding the range's header can fetch it and recompute the header's roots
+type ArchivedBatch struct {
+	SidechainID string
+	BlockRange  string
+	Blocks      []SidechainBlock
+	ArchivedAt  string
+}
+
+// Global archive of sidechain batches, by sidechain ID and then block range
+// Proposers only pick up anchor transactions whose batch is archived here
+var SidechainArchive = make(map[string]map[string]*ArchivedBatch)
+
+// ArchiveSidechainBatch stores a range of a sidechain's blocks in the archive
+// A range can be archived again only with the same blocks, unless its anchored
+// header was proven invalid and the corrected blocks replace it
+func ArchiveSidechainBatch(sc *Sidechain, startBlock, endBlock int) (*ArchivedBatch, error) {
+	if startBlock < 0 || endBlock >= len(sc.Blocks) || startBlock > endBlock {
+		return nil, fmt.Errorf("invalid block range: %d-%d", startBlock, endBlock)
+	}
+	batch := &ArchivedBatch{
+		SidechainID: sc.ID,
+		BlockRange:  fmt.Sprintf("%d-%d", startBlock, endBlock),
+		Blocks:      append([]SidechainBlock(nil), sc.Blocks[startBlock:endBlock+1]...),
+		ArchivedAt:  time.Now().String(),
+	}
+
+	if existing, err := FetchSidechainBatch(sc.ID, batch.BlockRange); err == nil {
+		if sameBlocks(existing.Blocks, batch.Blocks) {
+			return existing, nil
+		}
+		if !anchoredInvalid(sc.ID, batch.BlockRange) {
+			return nil, fmt.Errorf("range %s of %s is already archived with different blocks", batch.BlockRange, sc.ID)
+		}
+	}
+	if SidechainArchive[sc.ID] == nil {
+		SidechainArchive[sc.ID] = make(map[string]*ArchivedBatch)
+	}
+	SidechainArchive[sc.ID][batch.BlockRange] = batch
+	return batch, nil
+}
+
+// sameBlocks checks two block lists hold the same blocks in the same order
+func sameBlocks(a, b []SidechainBlock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Hash != b[i].Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// anchoredInvalid checks whether the latest header anchored for a range was proven invalid
+func anchoredInvalid(sidechainID, blockRange string) bool {
+	state, err := CurrentState()
+	if err != nil {
+		return false
+	}
+	anchor, exists := state.Sidechains[sidechainID]
+	if !exists {
+		return false
+	}
+	header, found := anchor.HeaderForRange(blockRange)
+	return found && header.Invalid
+}
+
+// FetchSidechainBatch retrieves an archived batch by sidechain ID and block range
+func FetchSidechainBatch(sidechainID, blockRange string) (*ArchivedBatch, error) {
+	batch, exists := SidechainArchive[sidechainID][blockRange]
+	if !exists {
+		return nil, fmt.Errorf("range %s of %s is not archived", blockRange, sidechainID)
+	}
+	return batch, nil
+}
+
+// Transactions returns the batch's transactions in block order
+func (b *ArchivedBatch) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, block := range b.Blocks {
+		txs = append(txs, block.Transactions...)
+	}
+	return txs
+}
+
+// Verify recomputes the batch's roots and checks them against a header for its range
+// The blocks must be the complete, linked range with untampered hashes
+func (b *ArchivedBatch) Verify(header SidechainHeader) error {
+	if header.SidechainID != b.SidechainID || header.BlockRange != b.BlockRange {
+		return fmt.Errorf("header for %s %s does not cover batch %s %s", header.SidechainID, header.BlockRange, b.SidechainID, b.BlockRange)
+	}
+	startBlock, endBlock, err := parseBlockRange(b.BlockRange)
+	if err != nil {
+		return err
+	}
+	if len(b.Blocks) != endBlock-startBlock+1 {
+		return fmt.Errorf("batch %s has %d blocks", b.BlockRange, len(b.Blocks))
+	}
+	for i, block := range b.Blocks {
+		if block.Index != startBlock+i {
+			return fmt.Errorf("batch %s holds block %d at position %d", b.BlockRange, block.Index, i)
+		}
+		if CalculateSidechainBlockHash(block) != block.Hash {
+			return fmt.Errorf("block %d hash does not match its contents", block.Index)
+		}
+		if i > 0 && block.PrevHash != b.Blocks[i-1].Hash {
+			return fmt.Errorf("block %d does not link to block %d", block.Index, block.Index-1)
+		}
+	}
+
+	txs := b.Transactions()
+	if len(txs) != header.TransactionCount {
+		return fmt.Errorf("batch has %d transactions, header commits to %d", len(txs), header.TransactionCount)
+	}
+	if root := CalculateMerkleRoot(txs); root != header.MerkleRoot {
+		return fmt.Errorf("batch merkle root %s, header commits to %s", root, header.MerkleRoot)
+	}
+	if root := b.Blocks[len(b.Blocks)-1].StateRoot; root != header.StateRoot {
+		return fmt.Errorf("batch state root %s, header commits to %s", root, header.StateRoot)
+	}
+	var trace []string
+	for _, block := range b.Blocks {
+		trace = append(trace, block.TxStateRoots...)
+	}
+	if root := CalculateTraceRoot(trace); root != header.TraceRoot {
+		return fmt.Errorf("batch trace root %s, header commits to %s", root, header.TraceRoot)
+	}
+	return nil
+}
+
+// CheckHeaderArchived checks that a header's batch is archived and matches it
+func CheckHeaderArchived(header SidechainHeader) error {
+	batch, err := FetchSidechainBatch(header.SidechainID, header.BlockRange)
+	if err != nil {
+		return err
+	}
+	if err := batch.Verify(header); err != nil {
+		return fmt.Errorf("archived range %s of %s: %v", header.BlockRange, header.SidechainID, err)
+	}
+	return nil
+}
+
+// ArchivedTransactions drops anchor transactions whose batch is not archived
+// This is relay policy, not consensus: proposers hold back headers nobody can fetch the
+// data for, but a block anchoring one is still valid, since block validity can't depend
+// on what a node's local archive holds. Headers in a block built outside SubmitProposal,
+// as anchor transactions or in Block.SidechainHeaders, are not checked at all
+func ArchivedTransactions(transactions []*Transaction) []*Transaction {
+	var archived []*Transaction
+	for _, tx := range transactions {
+		if tx.Type == TxSidechainAnchor {
+			header, err := anchorTransactionHeader(tx)
+			if err == nil {
+				err = CheckHeaderArchived(*header)
+			}
+			if err != nil {
+				fmt.Println("Holding back anchor transaction:", err)
+				continue
+			}
+		}
+		archived = append(archived, tx)
+	}
+	return archived
+}
+
+// SaveArchive writes the sidechain archive to a JSON file
+func SaveArchive(path string) error {
+	var batches []*ArchivedBatch
+	for _, ranges := range SidechainArchive {
+		for _, batch := range ranges {
+			batches = append(batches, batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		if batches[i].SidechainID != batches[j].SidechainID {
+			return batches[i].SidechainID < batches[j].SidechainID
+		}
+		start, _, _ := parseBlockRange(batches[i].BlockRange)
+		other, _, _ := parseBlockRange(batches[j].BlockRange)
+		return start < other
+	})
+
+	data, err := json.MarshalIndent(batches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadArchive reads batches written by SaveArchive into the sidechain archive
+func LoadArchive(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var batches []*ArchivedBatch
+	if err := json.Unmarshal(data, &batches); err != nil {
+		return fmt.Errorf("invalid archive file %s: %v", path, err)
+	}
+	for _, batch := range batches {
+		if SidechainArchive[batch.SidechainID] == nil {
+			SidechainArchive[batch.SidechainID] = make(map[string]*ArchivedBatch)
+		}
+		SidechainArchive[batch.SidechainID][batch.BlockRange] = batch
+	}
+	return nil
+}
+
+// GetArchiveStats returns the archived ranges of a sidechain
+func GetArchiveStats(sidechainID string) map[string]interface{} {
+	var ranges []string
+	blocks, txs := 0, 0
+	for blockRange, batch := range SidechainArchive[sidechainID] {
+		ranges = append(ranges, blockRange)
+		blocks += len(batch.Blocks)
+		txs += len(batch.Transactions())
+	}
+	sort.Strings(ranges)
+
+	return map[string]interface{}{
+		"sidechain_id":          sidechainID,
+		"archived_ranges":       ranges,
+		"archived_blocks":       blocks,
+		"archived_transactions": txs,
+	}
+}
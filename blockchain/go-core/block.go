@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -19,19 +20,17 @@ type Block struct {
 }
 
 // CalculateHash calculates the SHA256 hash of a block
+// Transactions are committed to through their merkle root
 func CalculateHash(block Block) string {
-	txHashes := ""
-	for _, tx := range block.Transactions {
-		txHashes += tx.ID
-	}
+	txRoot := CalculateMerkleRoot(block.Transactions)
 
 	// Include sidechain headers in hash
 	sidechainData := ""
 	for _, header := range block.SidechainHeaders {
-		sidechainData += header.MerkleRoot
+		sidechainData += header.CalculateHash()
 	}
 
-	record := fmt.Sprintf("%d%s%s%s%s%s", block.Index, block.Timestamp, txHashes, block.PrevHash, block.Validator, sidechainData)
+	record := fmt.Sprintf("%d%s%s%s%s%s", block.Index, block.Timestamp, txRoot, block.PrevHash, block.Validator, sidechainData)
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
@@ -53,3 +52,17 @@ func GenerateBlock(oldBlock Block, transactions []*Transaction, validator string
 
 	return newBlock
 }
+
+// ParseBlockTimestamp parses a block timestamp written by GenerateBlock
+// Returns the zero time if the timestamp is not in the expected format
+func ParseBlockTimestamp(timestamp string) time.Time {
+	// Drop the monotonic clock reading that time.Time.String appends
+	if i := strings.Index(timestamp, " m="); i >= 0 {
+		timestamp = timestamp[:i]
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -8,59 +8,70 @@ import (
 // Blockchain is a series of validated Blocks
 var Blockchain []Block
 
-// AddBlock adds a new block to the blockchain
-func AddBlock(newBlock Block) {
-	if IsBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
-		Blockchain = append(Blockchain, newBlock)
+// AddBlock validates a new block, applies it to the chain state and appends it
+// Returns false if the block is invalid or breaks a state invariant
+func AddBlock(newBlock Block) bool {
+	if !IsBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
+		return false
+	}
+
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return false
 	}
+
+	// Apply to a copy so a rejected block leaves the state untouched
+	next := state.Copy()
+	if err := next.ApplyBlock(newBlock); err != nil {
+		fmt.Println("Error applying block:", err)
+		return false
+	}
+
+	Blockchain = append(Blockchain, newBlock)
+	chainState = next
+	publishEvents(next.EventsAt(newBlock.Index))
+	return true
 }
 
 // IsBlockValid checks if the block is valid by checking index, hash, and previous hash
+// Sidechain headers are verified against their registration when the block is applied
 func IsBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-		fmt.Println("Index is invalid")
+	if err := CheckBlockStructure(newBlock, oldBlock); err != nil {
+		fmt.Println("Block is invalid:", err)
 		return false
 	}
 
+	return true
+}
+
+// CheckBlockStructure checks a block's index, links, hash and consensus limits
+func CheckBlockStructure(newBlock, oldBlock Block) error {
+	if oldBlock.Index+1 != newBlock.Index {
+		return fmt.Errorf("index %d does not follow %d", newBlock.Index, oldBlock.Index)
+	}
+
 	if oldBlock.Hash != newBlock.PrevHash {
-		fmt.Println("Previous Hash is invalid")
-		return false
+		return fmt.Errorf("previous hash %s does not match %s", newBlock.PrevHash, oldBlock.Hash)
 	}
 
 	if CalculateHash(newBlock) != newBlock.Hash {
-		fmt.Println("Hash is invalid")
-		return false
+		return fmt.Errorf("hash %s does not match block contents", newBlock.Hash)
 	}
 
-	// Verify sidechain headers
-	for _, header := range newBlock.SidechainHeaders {
-		if !VerifySidechainHeader(&header) {
-			fmt.Println("Invalid sidechain header")
-			return false
-		}
+	if err := CheckBlockLimits(newBlock); err != nil {
+		return err
 	}
 
-	return true
+	return nil
 }
 
-// GetBalance returns the balance of an address by iterating through all transactions
+// GetBalance returns the balance of an address in the current chain state
 func GetBalance(address string) *big.Int {
-	balance := big.NewInt(0)
-
-	for _, block := range Blockchain {
-		for _, tx := range block.Transactions {
-			if tx.Sender == address {
-				balance.Sub(balance, tx.Amount)
-				// Deduct fee if not sponsored
-				if !tx.IsSponsored && tx.Fee != nil {
-					balance.Sub(balance, tx.Fee)
-				}
-			}
-			if tx.Recipient == address {
-				balance.Add(balance, tx.Amount)
-			}
-		}
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return big.NewInt(0)
 	}
-
-	return balance
+	return state.BalanceOf(address)
 }
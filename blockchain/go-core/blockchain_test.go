@@ -1,11 +1,75 @@
 package main
 
 import (
+	"fmt"
 	"math/big"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+// resetTestChain replaces the global Blockchain with a genesis block holding the
+// given transactions and a 2-of-3 governance set, returning the governance members
+func resetTestChain(t *testing.T, genesisTxs ...*Transaction) []*Wallet {
+	var members []*Wallet
+	var keys []string
+	for i := 0; i < 3; i++ {
+		member := CreateWallet()
+		members = append(members, member)
+		keys = append(keys, member.GetAddress())
+	}
+	governanceTx, err := NewGovernanceSetTransaction(len(genesisTxs), GovernanceSet{Keys: keys, Threshold: 2})
+	if err != nil {
+		t.Fatalf("Creating governance set failed: %v", err)
+	}
+
+	genesisBlock := Block{0, time.Now().String(), append(genesisTxs, governanceTx), "", "", "", nil}
+	genesisBlock.Hash = CalculateHash(genesisBlock)
+	Blockchain = []Block{genesisBlock}
+	SidechainArchive = make(map[string]map[string]*ArchivedBatch)
+	return members
+}
+
+// coSign adds governance co-signatures to a transaction
+func coSign(t *testing.T, tx *Transaction, signers ...*Wallet) {
+	for _, signer := range signers {
+		if err := tx.AddCoSignature(signer); err != nil {
+			t.Fatalf("Co-signing failed: %v", err)
+		}
+	}
+}
+
+// testProposer returns an address eligible to propose the next block,
+// preferring "Miner" and then the latest sender other than the coalition
+func testProposer() string {
+	state, err := CurrentState()
+	if err != nil || state.IsEligibleProposer("Miner") {
+		return "Miner"
+	}
+	for i := len(state.EligibilityPool) - 1; i >= 0; i-- {
+		if state.EligibilityPool[i] != CoalitionAddress {
+			return state.EligibilityPool[i]
+		}
+	}
+	return CoalitionAddress
+}
+
+// nextBlock builds a block on the tip of the global Blockchain from an eligible proposer
+func nextBlock(txs ...*Transaction) Block {
+	return GenerateBlock(Blockchain[len(Blockchain)-1], txs, testProposer(), nil)
+}
+
+// signedTransfer creates a transfer paying the scheduled fee, signed by the sender
+func signedTransfer(t *testing.T, sender *Wallet, recipient string, amount int64, nonce int, payload string) *Transaction {
+	tx := NewTransaction(sender.GetAddress(), recipient, big.NewInt(amount), nonce, payload)
+	tx.ProcessTransactionFee()
+	if err := tx.SignTransaction(sender.PrivateKey); err != nil {
+		t.Fatalf("Signing failed: %v", err)
+	}
+	return tx
+}
+
 func TestBlockValidation(t *testing.T) {
 	tx := NewTransaction("Sender", "Recipient", big.NewInt(10), 0, "Test Data")
 	genesisBlock := Block{0, time.Now().String(), []*Transaction{tx}, "", "", "", nil}
@@ -28,13 +92,14 @@ func TestBlockValidation(t *testing.T) {
 }
 
 func TestBlockchain(t *testing.T) {
+	sender := CreateWallet()
 	Blockchain = []Block{}
-	tx := NewTransaction("Sender", "Recipient", big.NewInt(10), 0, "Genesis Block")
+	tx := NewTransaction("0", sender.GetAddress(), big.NewInt(20), 0, "Genesis Block")
 	genesisBlock := Block{0, time.Now().String(), []*Transaction{tx}, "", "", "", nil}
 	genesisBlock.Hash = CalculateHash(genesisBlock)
 	Blockchain = append(Blockchain, genesisBlock)
 
-	newTx := NewTransaction("Sender", "Recipient", big.NewInt(10), 1, "Block 1")
+	newTx := signedTransfer(t, sender, "Recipient", 10, 0, "Block 1")
 	newBlock := GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{newTx}, "Validator1", nil)
 	AddBlock(newBlock)
 
@@ -43,6 +108,40 @@ func TestBlockchain(t *testing.T) {
 	}
 }
 
+func TestAddBlockEnforcesReplayRules(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", TreasuryAddress, big.NewInt(1000), 0, "Genesis"))
+	mallory := CreateWallet()
+
+	// Unsigned spends are rejected, from the genesis treasury or anyone else
+	for _, sender := range []string{TreasuryAddress, "Mallory"} {
+		unsigned := NewTransaction(sender, "Recipient", big.NewInt(500), 0, "Transfer")
+		unsigned.ProcessTransactionFee()
+		block := nextBlock(unsigned)
+		if AddBlock(block) {
+			t.Fatalf("Unsigned transfer from %s should be rejected", sender)
+		}
+		if _, err := ValidateChain(append(append([]Block(nil), Blockchain...), block)); err == nil {
+			t.Fatalf("Chain with an unsigned transfer from %s should not validate", sender)
+		}
+	}
+
+	// A signed spend the sender cannot cover is rejected
+	if AddBlock(nextBlock(signedTransfer(t, mallory, "Recipient", 500, 0, "Transfer"))) {
+		t.Fatalf("Overdrawing transfer should be rejected")
+	}
+
+	// So is a fee the unfunded coalition cannot pay, even though the block's reward would cover it
+	approval, _ := NewPublisherApprovalTransaction(0, "Publisher", "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	if AddBlock(nextBlock(approval)) {
+		t.Fatalf("Governance fee the coalition cannot cover should be rejected")
+	}
+	if len(Blockchain) != 1 {
+		t.Errorf("No block should have been added, chain has %d", len(Blockchain))
+	}
+}
+
 func TestWallet(t *testing.T) {
 	wallet := CreateWallet()
 	if wallet == nil {
@@ -55,3 +154,2084 @@ func TestWallet(t *testing.T) {
 		t.Errorf("Address is empty")
 	}
 }
+
+func TestSupplyInvariant(t *testing.T) {
+	payer := CreateWallet()
+	Blockchain = []Block{}
+	genesisTxs := []*Transaction{
+		NewTransaction("0", TreasuryAddress, big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", payer.GetAddress(), big.NewInt(200), 1, "Genesis"),
+	}
+	genesisBlock := Block{0, time.Now().String(), genesisTxs, "", "", "", nil}
+	genesisBlock.Hash = CalculateHash(genesisBlock)
+	Blockchain = append(Blockchain, genesisBlock)
+
+	tx := NewTransaction(payer.GetAddress(), "Recipient", big.NewInt(100), 0, "Transfer")
+	tx.Fee = big.NewInt(4)
+	tx.ID = tx.CalculateHash()
+	tx.SignTransaction(payer.PrivateKey)
+	if !AddBlock(nextBlock(tx)) {
+		t.Fatalf("Block should be accepted")
+	}
+
+	report, err := GetSupplyAtHeight(1)
+	if err != nil {
+		t.Fatalf("Supply report failed: %v", err)
+	}
+	// 1200 genesis + 9 generated; base fee 1 and tip 3
+	// (9 + 1) / 3 = 3 to miner (plus the tip) and coalition, 4 burnt
+	if report.Minted.Cmp(big.NewInt(1209)) != 0 {
+		t.Errorf("Minted should be 1209, got %s", report.Minted)
+	}
+	if report.Burnt.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("Burnt should be 4, got %s", report.Burnt)
+	}
+	if report.TreasuryHeld.Cmp(big.NewInt(1003)) != 0 {
+		t.Errorf("TreasuryHeld should be 1003, got %s", report.TreasuryHeld)
+	}
+	if report.Circulating.Cmp(big.NewInt(202)) != 0 {
+		t.Errorf("Circulating should be 202, got %s", report.Circulating)
+	}
+
+	state, _ := CurrentState()
+	tampered := state.Copy()
+	tampered.credit("Recipient", big.NewInt(1), JournalTransfer, "")
+	if CheckSupplyInvariant(tampered) == nil {
+		t.Errorf("Invariant should catch value created outside the reward rules")
+	}
+}
+
+func TestFeeScheduleGovernance(t *testing.T) {
+	payer := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", payer.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 1, "Genesis Coalition Allocation"))
+
+	schedule := DefaultFeeSchedule()
+	schedule.BaseFee = big.NewInt(5)
+	schedule.TypeMultipliers[TxFeeScheduleUpdate] = 200
+
+	// Only governance may change the schedule, even with members' co-signatures
+	forged, _ := NewFeeScheduleUpdateTransaction(0, FeeScheduleUpdate{ActivationHeight: 3, Schedule: schedule})
+	forged.Sender = "Attacker"
+	forged.ProcessTransactionFee()
+	coSign(t, forged, members[0], members[1])
+	if AddBlock(nextBlock(forged)) {
+		t.Fatalf("Fee schedule update from non-governance sender should be rejected")
+	}
+
+	// A coalition update without co-signatures is rejected when accepted and when replayed
+	unsigned, _ := NewFeeScheduleUpdateTransaction(0, FeeScheduleUpdate{ActivationHeight: 3, Schedule: schedule})
+	unsigned.ProcessTransactionFee()
+	block := nextBlock(unsigned)
+	if AddBlock(block) {
+		t.Fatalf("Fee schedule update without co-signatures should be rejected")
+	}
+	if _, err := ValidateChain(append(append([]Block(nil), Blockchain...), block)); err == nil {
+		t.Fatalf("Chain with an unauthorized fee schedule update should not validate")
+	}
+
+	update, err := NewFeeScheduleUpdateTransaction(0, FeeScheduleUpdate{ActivationHeight: 3, Schedule: schedule})
+	if err != nil {
+		t.Fatalf("Creating fee schedule update failed: %v", err)
+	}
+	update.ProcessTransactionFee()
+	coSign(t, update, members[0])
+	if AddBlock(nextBlock(update)) {
+		t.Fatalf("Fee schedule update below the governance threshold should be rejected")
+	}
+	coSign(t, update, members[1])
+	if !AddBlock(nextBlock(update)) {
+		t.Fatalf("Fee schedule update should be accepted")
+	}
+
+	// Height 2 still uses the default schedule
+	tx := signedTransfer(t, payer, "Recipient", 1, 0, "Transfer")
+	if tx.Fee.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("Fee before activation should be 1, got %s", tx.Fee)
+	}
+	if !AddBlock(nextBlock(tx)) {
+		t.Fatalf("Transfer paying the default fee should be accepted")
+	}
+
+	// Height 3 requires the new base fee
+	underpaid := NewTransaction(payer.GetAddress(), "Recipient", big.NewInt(1), 1, "Transfer")
+	underpaid.Fee = big.NewInt(1)
+	underpaid.ID = underpaid.CalculateHash()
+	underpaid.SignTransaction(payer.PrivateKey)
+	if AddBlock(nextBlock(underpaid)) {
+		t.Fatalf("Transfer paying the old fee should be rejected after activation")
+	}
+	if fee := underpaid.CalculateFee(); fee.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("Fee after activation should be 5, got %s", fee)
+	}
+
+	state, _ := CurrentState()
+	next := &Transaction{Type: TxFeeScheduleUpdate, Amount: big.NewInt(0)}
+	if fee := state.FeeScheduleAt(3).FeeFor(next); fee.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("Type multiplier should double the governance fee to 10, got %s", fee)
+	}
+}
+
+func TestDynamicBaseFee(t *testing.T) {
+	payer := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", payer.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 1, "Genesis Coalition Allocation"))
+
+	schedule := DefaultFeeSchedule()
+	schedule.BaseFee = big.NewInt(8)
+	schedule.Dynamic = &DynamicBaseFee{TargetTransactions: 1, ChangeDenominator: 8, MinBaseFee: big.NewInt(1)}
+	update, _ := NewFeeScheduleUpdateTransaction(0, FeeScheduleUpdate{ActivationHeight: 2, Schedule: schedule})
+	update.ProcessTransactionFee()
+	coSign(t, update, members[0], members[1])
+	if !AddBlock(nextBlock(update)) {
+		t.Fatalf("Enabling the dynamic base fee should be accepted")
+	}
+	if fee := ActiveFeeSchedule().BaseFee; fee.Cmp(big.NewInt(8)) != 0 {
+		t.Fatalf("Dynamic base fee should start at 8, got %s", fee)
+	}
+
+	// A block at twice the target raises the base fee by 1/8, the tip goes to the miner
+	var txs []*Transaction
+	for i := 0; i < 2; i++ {
+		tx := NewTransaction(payer.GetAddress(), "Recipient", big.NewInt(1), i, "Transfer")
+		tx.Fee = new(big.Int).Add(tx.CalculateFee(), big.NewInt(2))
+		tx.ID = tx.CalculateHash()
+		tx.SignTransaction(payer.PrivateKey)
+		txs = append(txs, tx)
+	}
+	if !AddBlock(nextBlock(txs...)) {
+		t.Fatalf("Full block should be accepted")
+	}
+	if fee := ActiveFeeSchedule().BaseFee; fee.Cmp(big.NewInt(9)) != 0 {
+		t.Errorf("Base fee should rise to 9, got %s", fee)
+	}
+
+	state, _ := CurrentState()
+	// W = 16, (9 + 16) / 3 = 8 each, tips of 4 to the miner
+	if state.LastReward.Miner.Cmp(big.NewInt(12)) != 0 || state.LastReward.Tips.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("Miner should receive 8 plus 4 in tips, got %s", state.LastReward.Miner)
+	}
+	if state.LastReward.Burnt.Cmp(big.NewInt(9)) != 0 {
+		t.Errorf("Burnt should be 9, got %s", state.LastReward.Burnt)
+	}
+
+	// An empty block lowers it again
+	if !AddBlock(nextBlock()) {
+		t.Fatalf("Empty block should be accepted")
+	}
+	if fee := ActiveFeeSchedule().BaseFee; fee.Cmp(big.NewInt(8)) != 0 {
+		t.Errorf("Base fee should fall back to 8, got %s", fee)
+	}
+}
+
+func TestBlockLimits(t *testing.T) {
+	genesisBlock := Block{0, time.Now().String(), nil, "", "", "", nil}
+	genesisBlock.Hash = CalculateHash(genesisBlock)
+
+	var txs []*Transaction
+	for i := 0; i <= MaxBlockTxCount; i++ {
+		txs = append(txs, NewTransaction("Sender", "Recipient", big.NewInt(1), i, ""))
+	}
+	if IsBlockValid(GenerateBlock(genesisBlock, txs, "Miner", nil), genesisBlock) {
+		t.Errorf("Block over the transaction count limit should be invalid")
+	}
+
+	large := NewTransaction("Sender", "Recipient", big.NewInt(1), 0, strings.Repeat("x", MaxPayloadBytes+1))
+	if IsBlockValid(GenerateBlock(genesisBlock, []*Transaction{large}, "Miner", nil), genesisBlock) {
+		t.Errorf("Block with an oversized payload should be invalid")
+	}
+
+	var bulky []*Transaction
+	for i := 0; i < 100; i++ {
+		bulky = append(bulky, NewTransaction("Sender", "Recipient", big.NewInt(1), i, strings.Repeat("x", MaxPayloadBytes)))
+	}
+	if IsBlockValid(GenerateBlock(genesisBlock, bulky, "Miner", nil), genesisBlock) {
+		t.Errorf("Block over the size limit should be invalid")
+	}
+
+	// Proposals are packed to fit the limits
+	PreSubmissionPool = []Proposal{}
+	submitted := append(append(bulky, large), txs...)
+	SubmitProposal("Miner", submitted)
+	proposal := PreSubmissionPool[0]
+	if len(proposal.Transactions) == 0 || len(proposal.Transactions) >= len(submitted) {
+		t.Fatalf("Proposal should be trimmed, got %d transactions", len(proposal.Transactions))
+	}
+	if !IsBlockValid(GenerateBlock(genesisBlock, proposal.Transactions, "Miner", nil), genesisBlock) {
+		t.Errorf("Packed proposal should produce a valid block")
+	}
+}
+
+func TestValidateChain(t *testing.T) {
+	alice := CreateWallet()
+	bob := CreateWallet()
+
+	Blockchain = []Block{}
+	genesisTx := NewTransaction("0", alice.GetAddress(), big.NewInt(100), 0, "Genesis")
+	genesisBlock := Block{0, time.Now().String(), []*Transaction{genesisTx}, "", "", "", nil}
+	genesisBlock.Hash = CalculateHash(genesisBlock)
+	Blockchain = append(Blockchain, genesisBlock)
+
+	for i := 0; i < 2; i++ {
+		tx := NewTransaction(alice.GetAddress(), bob.GetAddress(), big.NewInt(10), i, "Transfer")
+		tx.ProcessTransactionFee()
+		tx.SignTransaction(alice.PrivateKey)
+		if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, alice.GetAddress(), nil)) {
+			t.Fatalf("Block %d should be accepted", i+1)
+		}
+	}
+
+	state, err := ValidateChain(Blockchain)
+	if err != nil {
+		t.Fatalf("Chain should be valid: %v", err)
+	}
+	if state.BalanceOf(bob.GetAddress()).Cmp(big.NewInt(20)) != 0 {
+		t.Errorf("Bob should hold 20, got %s", state.BalanceOf(bob.GetAddress()))
+	}
+
+	// Tampering with a transaction is reported at its height
+	tampered := append([]Block(nil), Blockchain...)
+	forged := *tampered[2].Transactions[0]
+	forged.Amount = big.NewInt(1000)
+	tampered[2].Transactions = []*Transaction{&forged}
+	_, err = ValidateChain(tampered)
+	invalid, ok := err.(*ChainValidationError)
+	if !ok || invalid.Height != 2 {
+		t.Fatalf("Tampered chain should be invalid at height 2, got %v", err)
+	}
+
+	// The proposer's credit is priced from the block by the fee schedule, so a reward
+	// split consistently over the wrong fees is caught
+	before, _ := BuildState(Blockchain[:2])
+	rewarded := func(fees, tips *big.Int) (*ChainState, *big.Int) {
+		next := before.Copy()
+		if _, _, err := next.applyBlockBody(Blockchain[2]); err != nil {
+			t.Fatalf("Applying block 2 failed: %v", err)
+		}
+		unrewarded := next.BalanceOf(alice.GetAddress())
+		next.finishBlock(Blockchain[2], fees, tips)
+		return next, new(big.Int).Sub(next.BalanceOf(alice.GetAddress()), unrewarded)
+	}
+	fee := Blockchain[2].Transactions[0].Fee
+	if after, credited := rewarded(fee, big.NewInt(0)); checkReward(before, after, Blockchain[2], credited) != nil {
+		t.Errorf("Reward for the scheduled fee should pass")
+	}
+	if after, credited := rewarded(new(big.Int).Add(fee, big.NewInt(3)), big.NewInt(0)); checkReward(before, after, Blockchain[2], credited) == nil {
+		t.Errorf("Reward for fees the block did not pay should be rejected")
+	}
+	if after, credited := rewarded(fee, big.NewInt(0)); checkReward(before, after, Blockchain[2], credited.Add(credited, big.NewInt(1))) == nil {
+		t.Errorf("Proposer credit above its share should be rejected")
+	}
+
+	// A proposer that has not participated is not eligible
+	tx := NewTransaction(alice.GetAddress(), bob.GetAddress(), big.NewInt(10), 2, "Transfer")
+	tx.ProcessTransactionFee()
+	tx.SignTransaction(bob.PrivateKey)
+	block := GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, bob.GetAddress(), nil)
+	_, err = ValidateChain(append(append([]Block(nil), Blockchain...), block))
+	if invalid, ok := err.(*ChainValidationError); !ok || invalid.Height != 3 || !strings.Contains(invalid.Reason, "proposer") {
+		t.Errorf("Ineligible proposer should be reported at height 3, got %v", err)
+	}
+}
+
+func TestCoalitionTreasuryDerivedFromBlocks(t *testing.T) {
+	user, publisher := CreateWallet(), CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(5), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(1000), 1, "Genesis"))
+
+	approval, _ := NewPublisherApprovalTransaction(0, publisher.GetAddress(), "Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+
+	tx := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(1), 0, "Sponsored")
+	tx.Publisher = publisher.GetAddress()
+	tx.IsSponsored = true
+	tx.Fee = big.NewInt(1)
+	tx.ID = tx.CalculateHash()
+	tx.SignTransaction(user.PrivateKey)
+	tx.SignAsPublisher(publisher)
+	if !AddBlock(nextBlock(approval, tx)) {
+		t.Fatalf("Sponsored transaction should be accepted")
+	}
+
+	// Two independent replays agree on the treasury
+	first, _ := BuildState(Blockchain)
+	second, _ := BuildState(Blockchain)
+	if first.Treasury.Balance.Cmp(second.Treasury.Balance) != 0 || len(first.Treasury.TransactionLog()) != len(second.Treasury.TransactionLog()) {
+		t.Errorf("Replays should derive the same treasury")
+	}
+
+	// 5 genesis - 3 approval fee (payload over 200 bytes) - 1 sponsored fee + (9 + 4) / 3 reward share
+	if GetTreasuryBalance().Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("Treasury balance should be 5, got %s", GetTreasuryBalance())
+	}
+	stats := GetTreasuryStats()
+	if stats["total_received"] != "9" || stats["total_spent"] != "4" || stats["transaction_count"] != 4 {
+		t.Errorf("Unexpected treasury stats: %v", stats)
+	}
+	activity := GetRecentTreasuryActivity(1)
+	if len(activity) != 1 || activity[0].Height != 1 || activity[0].Purpose != "Block Reward Share" {
+		t.Errorf("Latest treasury activity should be the block 1 reward share, got %+v", activity)
+	}
+
+	// The treasury cannot sponsor more than it holds
+	large := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(1), 1, "Sponsored"+strings.Repeat(".", 9900))
+	large.Publisher = publisher.GetAddress()
+	large.IsSponsored = true
+	large.Fee = big.NewInt(100)
+	large.ID = large.CalculateHash()
+	large.SignTransaction(user.PrivateKey)
+	large.SignAsPublisher(publisher)
+	if AddBlock(nextBlock(large)) {
+		t.Errorf("Sponsorship exceeding the treasury balance should be rejected")
+	}
+}
+
+func TestPublisherApprovalGovernance(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"))
+	outsider := CreateWallet()
+	user := CreateWallet()
+	partner := CreateWallet()
+
+	// Signatures from outside the governance set do not count
+	approval, _ := NewPublisherApprovalTransaction(0, partner.GetAddress(), "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], outsider)
+	if AddBlock(nextBlock(approval)) {
+		t.Fatalf("Approval with a single governance signature should be rejected")
+	}
+	if IsPublisherApproved(partner.GetAddress()) {
+		t.Fatalf("Publisher should not be approved yet")
+	}
+
+	coSign(t, approval, members[2])
+	if !AddBlock(nextBlock(approval)) {
+		t.Fatalf("Approval with 2 of 3 governance signatures should be accepted")
+	}
+	publisher, approved := GetApprovedPublisher(partner.GetAddress())
+	if !approved || publisher.ApprovedHeight != 1 {
+		t.Fatalf("Publisher should be approved at height 1")
+	}
+
+	// Replaying the chain derives the same approvals
+	replayed, _ := BuildState(Blockchain)
+	if !replayed.IsPublisherApproved(partner.GetAddress()) {
+		t.Errorf("Approval should be replayable from the chain")
+	}
+
+	removal, _ := NewPublisherRemovalTransaction(1, partner.GetAddress())
+	removal.ProcessTransactionFee()
+	coSign(t, removal, members[0], members[1])
+	sponsored := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(0), 0, "Sponsored")
+	sponsored.SetPublisher(partner.GetAddress())
+	sponsored.ProcessTransactionFee()
+	sponsored.SignTransaction(user.PrivateKey)
+	sponsored.SignAsPublisher(partner)
+	if !sponsored.IsSponsored {
+		t.Fatalf("Transaction from an approved publisher should be sponsored")
+	}
+	if AddBlock(nextBlock(removal, sponsored)) {
+		t.Errorf("Sponsorship after removal in the same block should be rejected")
+	}
+	if !AddBlock(nextBlock(removal)) {
+		t.Fatalf("Removal should be accepted")
+	}
+	if IsPublisherApproved(partner.GetAddress()) {
+		t.Errorf("Publisher should no longer be approved")
+	}
+}
+
+func TestSponsorshipLimits(t *testing.T) {
+	user := CreateWallet()
+	publisher := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(10), 1, "Genesis"))
+
+	limits := SponsorshipLimits{EpochBudget: big.NewInt(3), MaxTxPerBlock: 2, MaxFeePerTx: big.NewInt(2)}
+	approval, _ := NewPublisherApprovalTransaction(0, publisher.GetAddress(), "Partner Publisher", limits)
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	if !AddBlock(nextBlock(approval)) {
+		t.Fatalf("Approval should be accepted")
+	}
+
+	// The payload is sized so the scheduled fee is fee; the treasury never pays a tip
+	sponsoredTx := func(nonce int, fee int64) *Transaction {
+		tx := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(0), nonce, "Sponsored"+strings.Repeat(".", int(fee-1)*100))
+		tx.Publisher = publisher.GetAddress()
+		tx.IsSponsored = true
+		tx.Fee = big.NewInt(fee)
+		tx.ID = tx.CalculateHash()
+		tx.SignTransaction(user.PrivateKey)
+		tx.SignAsPublisher(publisher)
+		return tx
+	}
+
+	// Fee cap and per-block limit: the 2nd fee is too large, the 4th exceeds 2 per block
+	txs := []*Transaction{sponsoredTx(0, 1), sponsoredTx(1, 3), sponsoredTx(2, 1), sponsoredTx(3, 1)}
+	if !AddBlock(nextBlock(txs...)) {
+		t.Fatalf("Block with over-limit sponsorships should fall back, not be rejected")
+	}
+	state, _ := CurrentState()
+	if len(state.LastSponsorFallbacks) != 2 || state.LastSponsorFallbacks[0] != txs[1].ID || state.LastSponsorFallbacks[1] != txs[3].ID {
+		t.Fatalf("Expected the 2nd and 4th transactions to fall back, got %v", state.LastSponsorFallbacks)
+	}
+	// Sender paid 3 + 1 for the fallbacks
+	if state.BalanceOf(user.GetAddress()).Cmp(big.NewInt(6)) != 0 {
+		t.Errorf("Sender should pay the fallback fees, balance %s", state.BalanceOf(user.GetAddress()))
+	}
+
+	// 2 of the 3 coin epoch budget is used; a 2 coin fee no longer fits
+	tx := sponsoredTx(4, 2)
+	tx.ProcessTransactionFee()
+	if tx.IsSponsored {
+		t.Errorf("Fee over the remaining budget should fall back to sender-paid")
+	}
+	tx = sponsoredTx(4, 2)
+	if !AddBlock(nextBlock(tx)) {
+		t.Fatalf("Over-budget block should be accepted")
+	}
+
+	stats := GetPublisherStats()
+	if len(stats) != 1 || stats[0]["over_budget"] != true || stats[0]["epoch_spent"] != "2" || stats[0]["fallbacks"] != 3 {
+		t.Errorf("Stats should show the publisher over budget, got %v", stats)
+	}
+	if _, err := ValidateChain(Blockchain); err != nil && strings.Contains(err.Error(), "treasury") {
+		t.Errorf("Treasury audit should account for fallbacks: %v", err)
+	}
+}
+
+func TestCoalitionPaidFeeIsSigned(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(1000), 0, "Genesis Coalition Allocation"))
+
+	// Raising the fee of a co-signed governance transaction breaks its co-signatures
+	approval, _ := NewPublisherApprovalTransaction(0, "Publisher", "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	raised := *approval
+	raised.Fee = big.NewInt(999000)
+	raised.ID = raised.CalculateHash()
+	block := nextBlock(&raised)
+	if AddBlock(block) {
+		t.Fatalf("Governance transaction with a raised fee should be rejected")
+	}
+	if _, err := ValidateChain(append(append([]Block(nil), Blockchain...), block)); err == nil {
+		t.Errorf("Chain with a raised governance fee should not validate")
+	}
+
+	// Co-signing the higher fee does not let the treasury pay a tip either
+	tipped, _ := NewPublisherApprovalTransaction(0, "Publisher", "Partner Publisher", SponsorshipLimits{})
+	tipped.Fee = new(big.Int).Add(approval.Fee, big.NewInt(1))
+	tipped.ID = tipped.CalculateHash()
+	coSign(t, tipped, members[0], members[1])
+	if AddBlock(nextBlock(tipped)) {
+		t.Errorf("Coalition-paid transaction with a tip should be rejected")
+	}
+
+	if !AddBlock(nextBlock(approval)) {
+		t.Fatalf("Approval paying the scheduled fee should be accepted")
+	}
+}
+
+func TestSponsorshipIsSigned(t *testing.T) {
+	user := CreateWallet()
+	tx := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(0), 0, "Sponsored")
+	tx.Publisher = "Publisher"
+	tx.IsSponsored = true
+	tx.Fee = big.NewInt(1)
+	tx.ID = tx.CalculateHash()
+	if err := tx.SignTransaction(user.PrivateKey); err != nil {
+		t.Fatalf("Signing failed: %v", err)
+	}
+
+	// Flipping sponsorship or the publisher after signing invalidates the signature
+	flipped := *tx
+	flipped.IsSponsored = false
+	moved := *tx
+	moved.Publisher = "Other Publisher"
+	for _, tampered := range []*Transaction{&flipped, &moved} {
+		if tampered.VerifyTransaction() || tampered.CalculateHash() == tx.ID {
+			t.Errorf("Sponsorship fields should be covered by the signature")
+		}
+	}
+	if !tx.VerifyTransaction() {
+		t.Errorf("Untampered transaction should verify")
+	}
+}
+
+func TestTransactionHashIsDelimited(t *testing.T) {
+	// Adjacent fields cannot be shifted into each other to reuse a signature
+	pairs := [][2]*Transaction{
+		{NewTransaction("Sender", "Recipient", big.NewInt(1), 33, ""), NewTransaction("Sender", "Recipient", big.NewInt(13), 3, "")},
+		{NewTransaction("Sender", "Recipient", big.NewInt(1), 0, "2"), NewTransaction("Sender", "Recipient", big.NewInt(1), 2, "")},
+		{NewTransaction("Sender|", "Recipient", big.NewInt(1), 0, ""), NewTransaction("Sender", "|Recipient", big.NewInt(1), 0, "")},
+		{NewTransaction("Sender", "Recipient", big.NewInt(1), 0, `x"|"bridge_burn`), NewTransaction("Sender", "Recipient", big.NewInt(1), 0, "x")},
+	}
+	pairs[3][1].Type = TxBridgeBurn
+	for i, pair := range pairs {
+		if pair[0].CalculateHash() == pair[1].CalculateHash() {
+			t.Errorf("Pair %d should hash differently", i)
+		}
+	}
+
+	wallet := CreateWallet()
+	tx := NewTransaction(wallet.GetAddress(), "Recipient", big.NewInt(1), 33, "")
+	tx.SignTransaction(wallet.PrivateKey)
+	shifted := *tx
+	shifted.Amount, shifted.Nonce = big.NewInt(13), 3
+	if shifted.VerifyTransaction() {
+		t.Errorf("Signature should not carry over to a transaction with shifted fields")
+	}
+}
+
+func TestSponsorshipRequiresPublisher(t *testing.T) {
+	stranger, publisher := CreateWallet(), CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", stranger.GetAddress(), big.NewInt(10), 1, "Genesis"))
+	approval, _ := NewPublisherApprovalTransaction(0, publisher.GetAddress(), "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	if !AddBlock(nextBlock(approval)) {
+		t.Fatalf("Approval should be accepted")
+	}
+
+	// A stranger naming an approved publisher cannot spend its sponsorship
+	forged := NewTransaction(stranger.GetAddress(), "Recipient", big.NewInt(0), 0, "Sponsored")
+	forged.SetPublisher(publisher.GetAddress())
+	forged.ProcessTransactionFee()
+	forged.SignTransaction(stranger.PrivateKey)
+	if err := forged.SignAsPublisher(stranger); err == nil {
+		t.Errorf("Only the publisher should countersign as publisher")
+	}
+	forged.AddCoSignature(stranger)
+	if AddBlock(nextBlock(forged)) {
+		t.Fatalf("Sponsorship without the publisher's signature should be rejected")
+	}
+	if stats := GetPublisherStats(); stats[0]["epoch_spent"] != "0" || stats[0]["total_sponsored"] != "0" {
+		t.Errorf("Rejected sponsorship should not be charged to the publisher, got %v", stats[0])
+	}
+
+	// The publisher's countersignature or sending it itself authorizes sponsorship
+	countersigned := NewTransaction(stranger.GetAddress(), "Recipient", big.NewInt(0), 0, "Sponsored")
+	countersigned.SetPublisher(publisher.GetAddress())
+	countersigned.ProcessTransactionFee()
+	countersigned.SignTransaction(stranger.PrivateKey)
+	countersigned.SignAsPublisher(publisher)
+	own := NewTransaction(publisher.GetAddress(), "Recipient", big.NewInt(0), 0, "Sponsored")
+	own.SetPublisher(publisher.GetAddress())
+	own.ProcessTransactionFee()
+	own.SignTransaction(publisher.PrivateKey)
+	if !AddBlock(nextBlock(countersigned, own)) {
+		t.Fatalf("Sponsorship signed by the publisher should be accepted")
+	}
+	if stats := GetPublisherStats(); stats[0]["total_sponsored"] != "2" {
+		t.Errorf("Both sponsorships should be charged to the publisher, got %v", stats[0])
+	}
+}
+
+func TestTreasuryWithdrawalMultisig(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(1000), 0, "Genesis Coalition Allocation"))
+	addBlock := func(txs ...*Transaction) bool {
+		return AddBlock(nextBlock(txs...))
+	}
+
+	// Plain transfers cannot move coalition funds
+	transfer := NewTransaction(CoalitionAddress, "Thief", big.NewInt(10), 0, "Transfer")
+	transfer.ProcessTransactionFee()
+	if addBlock(transfer) {
+		t.Fatalf("Plain transfer from the coalition should be rejected")
+	}
+
+	// A single member cannot attach an amount to a treasury step and skip the threshold
+	drain, _ := NewWithdrawalProposalTransaction(0, "Grantee", big.NewInt(1), "Developer grant")
+	drain.Amount = big.NewInt(900)
+	drain.ProcessTransactionFee()
+	coSign(t, drain, members[0])
+	redirect, _ := NewWithdrawalProposalTransaction(0, "Grantee", big.NewInt(1), "Developer grant")
+	redirect.Recipient = "Thief"
+	redirect.ProcessTransactionFee()
+	coSign(t, redirect, members[0])
+	if addBlock(drain) || addBlock(redirect) || GetBalance("Thief").Sign() != 0 {
+		t.Fatalf("Treasury step carrying an amount or recipient should be rejected")
+	}
+
+	proposal, _ := NewWithdrawalProposalTransaction(0, "Grantee", big.NewInt(100), "Developer grant")
+	proposal.ProcessTransactionFee()
+	coSign(t, proposal, members[0])
+	if !addBlock(proposal) {
+		t.Fatalf("Proposal signed by a governance member should be accepted")
+	}
+	withdrawal, exists := GetTreasuryWithdrawal(proposal.ID)
+	if !exists || withdrawal.ExecutableHeight != 1+TreasuryWithdrawalTimelock {
+		t.Fatalf("Withdrawal should be pending until height %d", 1+TreasuryWithdrawalTimelock)
+	}
+
+	// Treasury steps need a member's signature, and a far-ahead nonce cannot skip pending ones
+	unsigned, _ := NewWithdrawalExecutionTransaction(1, proposal.ID)
+	unsigned.ProcessTransactionFee()
+	if addBlock(unsigned) {
+		t.Fatalf("Execution without a member's signature should be rejected")
+	}
+	gap, _ := NewWithdrawalExecutionTransaction(1<<40, proposal.ID)
+	gap.ProcessTransactionFee()
+	coSign(t, gap, members[2])
+	if addBlock(gap) {
+		t.Fatalf("Execution with a nonce gap should be rejected")
+	}
+
+	// One signature is below the 2-of-3 threshold
+	execution, _ := NewWithdrawalExecutionTransaction(1, proposal.ID)
+	execution.ProcessTransactionFee()
+	coSign(t, execution, members[2])
+	if addBlock(execution) {
+		t.Fatalf("Execution with a single signature should be rejected")
+	}
+
+	signature, _ := NewWithdrawalSignatureTransaction(1, proposal.ID)
+	signature.ProcessTransactionFee()
+	coSign(t, signature, members[0], members[1])
+	if !addBlock(signature) {
+		t.Fatalf("Signature from a second member should be accepted")
+	}
+	execution, _ = NewWithdrawalExecutionTransaction(2, proposal.ID)
+	execution.ProcessTransactionFee()
+	coSign(t, execution, members[2])
+	if addBlock(execution) {
+		t.Fatalf("Execution before the time lock should be rejected")
+	}
+
+	for len(Blockchain) <= 1+TreasuryWithdrawalTimelock {
+		if !addBlock() {
+			t.Fatalf("Empty block should be accepted")
+		}
+	}
+	if !addBlock(execution) {
+		t.Fatalf("Execution after the time lock should be accepted")
+	}
+	if GetBalance("Grantee").Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("Grantee should receive the withdrawal")
+	}
+	if addBlock(execution) {
+		t.Errorf("Withdrawal should not execute twice")
+	}
+
+	// Every step is logged with the signers that authorized it
+	state, _ := CurrentState()
+	var steps []string
+	for _, entry := range state.Treasury.TransactionLog() {
+		if len(entry.Signers) > 0 {
+			steps = append(steps, fmt.Sprintf("%s:%d", entry.Type, len(entry.Signers)))
+		}
+	}
+	if strings.Join(steps, ",") != "withdrawal_proposal:1,withdrawal_signature:1,withdrawal:2" {
+		t.Errorf("Unexpected withdrawal log: %v", steps)
+	}
+	if withdrawal, _ := GetTreasuryWithdrawal(proposal.ID); !withdrawal.Executed {
+		t.Errorf("Withdrawal should be marked executed")
+	}
+	if replayed, err := BuildState(Blockchain); err != nil || !replayed.Treasury.Withdrawals[proposal.ID].Executed {
+		t.Errorf("Withdrawal should be replayable from the chain: %v", err)
+	}
+}
+
+func TestWalletApprovals(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"))
+	addBlock := func(txs ...*Transaction) bool {
+		return AddBlock(nextBlock(txs...))
+	}
+
+	grant := WalletApprovalGrant{Wallet: "Agent", Scope: []string{"mcp-action"}, SpendingCap: big.NewInt(20), ExpiryHeight: 3}
+	approval, _ := NewWalletApprovalTransaction(0, grant)
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0])
+	if addBlock(approval) {
+		t.Fatalf("Approval without governance threshold should be rejected")
+	}
+	coSign(t, approval, members[1])
+	if !addBlock(approval) {
+		t.Fatalf("Approval signed by 2 of 3 members should be accepted")
+	}
+
+	if !IsApproved("Agent", approval.ID) {
+		t.Errorf("Wallet should be approved with the approval transaction ID")
+	}
+	if IsApproved("Agent", "forged") {
+		t.Errorf("Unknown approval hash should be rejected")
+	}
+	if IsApprovedFor("Agent", approval.ID, "transfer", nil) {
+		t.Errorf("Approval should not cover actions outside its scope")
+	}
+	if IsApprovedFor("Agent", approval.ID, "mcp-action", big.NewInt(21)) {
+		t.Errorf("Amount above the spending cap should be rejected")
+	}
+
+	// Tampered signatures no longer satisfy the governance threshold
+	state, _ := CurrentState()
+	tampered := state.Copy()
+	tampered.Approvals["Agent"].CoSignatures[1].Signature = tampered.Approvals["Agent"].CoSignatures[0].Signature
+	if err := tampered.CheckApproval("Agent", approval.ID, "", nil, 2); err == nil {
+		t.Errorf("Approval with an invalid signature should be rejected")
+	}
+
+	// The approval expires at its expiry height
+	if !addBlock() {
+		t.Fatalf("Empty block should be accepted")
+	}
+	if IsApproved("Agent", approval.ID) {
+		t.Errorf("Approval should expire at height %d", grant.ExpiryHeight)
+	}
+
+	revocation, _ := NewWalletRevocationTransaction(1, "Agent", 0)
+	revocation.ProcessTransactionFee()
+	coSign(t, revocation, members[1], members[2])
+	if !addBlock(revocation) {
+		t.Fatalf("Revocation should be accepted")
+	}
+	if revoked, exists := GetWalletApproval("Agent"); !exists || revoked.RevocationHash != revocation.ID {
+		t.Errorf("Revoked approval should stay queryable")
+	}
+}
+
+func TestFundedActions(t *testing.T) {
+	agent := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", agent.GetAddress(), big.NewInt(10), 1, "Genesis"))
+	addBlock := func(txs ...*Transaction) bool {
+		return AddBlock(nextBlock(txs...))
+	}
+	fundedAction := func(nonce int, amount int64, approvalHash, scope string) *Transaction {
+		tx, err := NewFundedActionTransaction(agent.GetAddress(), "Service", big.NewInt(amount), nonce, approvalHash, scope)
+		if err != nil {
+			t.Fatalf("Failed to create funded action: %v", err)
+		}
+		tx.ProcessTransactionFee()
+		tx.SignTransaction(agent.PrivateKey)
+		return tx
+	}
+
+	approval, _ := NewWalletApprovalTransaction(0, WalletApprovalGrant{Wallet: agent.GetAddress(), Scope: []string{"mcp-action"}, SpendingCap: big.NewInt(30), ExpiryHeight: 100})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	// The agent's transfer makes it eligible to propose the next blocks
+	if !addBlock(approval, signedTransfer(t, agent, "Recipient", 0, 0, "Join")) {
+		t.Fatalf("Approval should be accepted")
+	}
+
+	if addBlock(fundedAction(1, 10, "forged", "mcp-action")) {
+		t.Errorf("Funded action with an unknown approval hash should be rejected")
+	}
+	if addBlock(fundedAction(1, 10, approval.ID, "transfer")) {
+		t.Errorf("Funded action outside the approval scope should be rejected")
+	}
+
+	treasuryBefore := GetBalance(CoalitionAddress)
+	if !addBlock(fundedAction(1, 20, approval.ID, "mcp-action")) {
+		t.Fatalf("Approved funded action should be accepted")
+	}
+	if GetBalance("Service").Cmp(big.NewInt(20)) != 0 {
+		t.Errorf("Service should be paid by the treasury, got %s", GetBalance("Service").String())
+	}
+	state, _ := CurrentState()
+	expected := new(big.Int).Sub(treasuryBefore, big.NewInt(20))
+	expected.Add(expected, state.LastReward.Coalition)
+	if GetBalance(CoalitionAddress).Cmp(expected) != 0 {
+		t.Errorf("Treasury should pay the funded action, expected %s, got %s", expected.String(), GetBalance(CoalitionAddress).String())
+	}
+	if remaining := state.Approvals[agent.GetAddress()].Remaining(); remaining.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("Remaining allowance should be 10, got %s", remaining.String())
+	}
+	if addBlock(fundedAction(2, 11, approval.ID, "mcp-action")) {
+		t.Errorf("Funded action above the remaining allowance should be rejected")
+	}
+
+	revocation, _ := NewWalletRevocationTransaction(1, agent.GetAddress(), 0)
+	revocation.ProcessTransactionFee()
+	coSign(t, revocation, members[0], members[2])
+	if !addBlock(revocation) {
+		t.Fatalf("Revocation should be accepted")
+	}
+	if addBlock(fundedAction(2, 5, approval.ID, "mcp-action")) {
+		t.Errorf("Funded action after revocation should be rejected")
+	}
+}
+
+func TestApprovalRevocationGracePeriod(t *testing.T) {
+	members := resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"))
+	addBlock := func(txs ...*Transaction) bool {
+		return AddBlock(nextBlock(txs...))
+	}
+	var revoked []Event
+	SubscribeEvents(EventApprovalRevoked, func(event Event) {
+		revoked = append(revoked, event)
+	})
+	defer delete(eventSubscribers, EventApprovalRevoked)
+
+	first, _ := NewWalletApprovalTransaction(0, WalletApprovalGrant{Wallet: "Agent", ExpiryHeight: 100})
+	first.ProcessTransactionFee()
+	coSign(t, first, members[0], members[1])
+	if !addBlock(first) {
+		t.Fatalf("Approval should be accepted")
+	}
+	if events := GetBlockEvents(1); len(events) != 1 || events[0].Name != EventApprovalGranted {
+		t.Fatalf("Approval block should emit %s, got %v", EventApprovalGranted, events)
+	}
+
+	// Revocation takes effect at the grace height, leaving in-flight actions valid until then
+	revocation, _ := NewWalletRevocationTransaction(1, "Agent", 4)
+	revocation.ProcessTransactionFee()
+	coSign(t, revocation, members[0], members[1])
+	if !addBlock(revocation) {
+		t.Fatalf("Revocation should be accepted")
+	}
+	if len(revoked) != 1 || revoked[0].Height != 2 || revoked[0].Attributes["approvalHash"] != first.ID {
+		t.Fatalf("Subscriber should receive the %s event, got %v", EventApprovalRevoked, revoked)
+	}
+	if !IsApproved("Agent", first.ID) {
+		t.Errorf("Approval should stay valid during the grace period")
+	}
+	if !addBlock() {
+		t.Fatalf("Empty block should be accepted")
+	}
+	if IsApproved("Agent", first.ID) {
+		t.Errorf("Approval should be revoked from the grace height")
+	}
+
+	again, _ := NewWalletRevocationTransaction(2, "Agent", 0)
+	again.ProcessTransactionFee()
+	coSign(t, again, members[0], members[1])
+	if addBlock(again) {
+		t.Errorf("Revoking an already revoked approval should be rejected")
+	}
+
+	// A new approval keeps the revoked one in the wallet's history
+	second, _ := NewWalletApprovalTransaction(2, WalletApprovalGrant{Wallet: "Agent", ExpiryHeight: 100})
+	second.ProcessTransactionFee()
+	coSign(t, second, members[1], members[2])
+	if !addBlock(second) {
+		t.Fatalf("Re-approval should be accepted")
+	}
+	history := GetApprovalHistory("Agent")
+	if len(history) != 2 || history[0].Hash != first.ID || history[0].RevokedHeight != 2 || history[1].Hash != second.ID {
+		t.Errorf("Approval history should hold the revoked and the current approval")
+	}
+	if !IsApproved("Agent", second.ID) || IsApproved("Agent", first.ID) {
+		t.Errorf("Only the latest approval should be valid")
+	}
+}
+
+func TestTreasuryJournal(t *testing.T) {
+	user := CreateWallet()
+	publisher := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(10), 1, "Genesis"))
+	approval, _ := NewPublisherApprovalTransaction(0, publisher.GetAddress(), "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	// The user's transfer makes it eligible to propose the next block
+	AddBlock(nextBlock(approval, signedTransfer(t, user, "Recipient", 0, 0, "Join")))
+
+	sponsored := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(0), 1, "Sponsored")
+	sponsored.SetPublisher(publisher.GetAddress())
+	sponsored.ProcessTransactionFee()
+	sponsored.SignTransaction(user.PrivateKey)
+	sponsored.SignAsPublisher(publisher)
+	if !AddBlock(nextBlock(sponsored)) {
+		t.Fatalf("Sponsored transaction should be accepted")
+	}
+
+	state, _ := CurrentState()
+	journal := state.Treasury.TransactionLog()
+	if err := VerifyJournal(journal); err != nil {
+		t.Fatalf("Journal should verify: %v", err)
+	}
+	var types []string
+	for _, entry := range journal {
+		types = append(types, string(entry.Type))
+	}
+	if strings.Join(types, ",") != "genesis,fee,reward_share,sponsorship,reward_share" {
+		t.Errorf("Unexpected journal entry types: %v", types)
+	}
+	if journal[3].TxID != sponsored.ID || journal[3].Height != 2 || journal[4].TxID != "" {
+		t.Errorf("Entries should link to the height and transaction that caused them")
+	}
+
+	// Rewriting any entry breaks the hash chain
+	tampered := append([]TreasuryTransaction(nil), journal...)
+	tampered[1].Amount = big.NewInt(0)
+	if VerifyJournal(tampered) == nil {
+		t.Errorf("Tampered journal should fail verification")
+	}
+
+	report := BuildTreasuryReport(state, 2, 2)
+	if !report.Reconciled || len(report.Entries) != 2 || report.ClosingBalance.Cmp(GetBalance(CoalitionAddress)) != 0 {
+		t.Errorf("Report for height 2 should reconcile with the coalition account: %v", report.Discrepancies)
+	}
+	if report.Totals[JournalSponsorship].Cmp(new(big.Int).Neg(sponsored.Fee)) != 0 {
+		t.Errorf("Sponsorship total should be -%s, got %s", sponsored.Fee, report.Totals[JournalSponsorship])
+	}
+
+	var csvOut strings.Builder
+	if err := report.WriteCSV(&csvOut); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[1], sponsored.ID) {
+		t.Errorf("CSV should have a header and one row per entry, got %v", lines)
+	}
+
+	broken := state.Copy()
+	broken.Treasury.journal = &journalBlock{Height: 2, Entries: tampered}
+	if BuildTreasuryReport(broken, 0, 2).Reconciled {
+		t.Errorf("Report over a tampered journal should not reconcile")
+	}
+}
+
+func TestStateCopySharesHistory(t *testing.T) {
+	resetTestChain(t, NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"))
+	for i := 0; i < 3; i++ {
+		if !AddBlock(nextBlock()) {
+			t.Fatalf("Empty block should be accepted")
+		}
+	}
+	state, _ := CurrentState()
+	entries := len(state.Treasury.TransactionLog())
+
+	// A copy shares the applied blocks' journal and events rather than cloning them
+	c := state.Copy()
+	if c.Treasury.journal != state.Treasury.journal || c.EventLog != state.EventLog {
+		t.Fatalf("Copy should share the journal and event history")
+	}
+
+	// Writing to the copy at the same height leaves the original untouched
+	c.blockHeight = c.Height
+	c.credit(CoalitionAddress, big.NewInt(1), JournalTransfer, "Copy only")
+	c.emit(EventApprovalGranted, "", nil)
+	if len(state.Treasury.TransactionLog()) != entries || len(state.EventsAt(state.Height)) != 0 {
+		t.Errorf("Original state should not see entries written to its copy")
+	}
+	if len(c.Treasury.TransactionLog()) != entries+1 || len(c.EventsAt(c.Height)) != 1 {
+		t.Errorf("Copy should see its own entries")
+	}
+	if err := VerifyJournal(c.Treasury.TransactionLog()); err != nil {
+		t.Errorf("Copy's journal should still chain: %v", err)
+	}
+}
+
+func TestTreasurySolvency(t *testing.T) {
+	user := CreateWallet()
+	publisher := CreateWallet()
+	members := resetTestChain(t,
+		NewTransaction("0", CoalitionAddress, big.NewInt(100), 0, "Genesis Coalition Allocation"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(10), 1, "Genesis"))
+	approval, _ := NewPublisherApprovalTransaction(0, publisher.GetAddress(), "Partner Publisher", SponsorshipLimits{})
+	approval.ProcessTransactionFee()
+	coSign(t, approval, members[0], members[1])
+	AddBlock(nextBlock(approval, signedTransfer(t, user, "Recipient", 0, 0, "Join")))
+
+	// Reward income alone keeps the treasury growing
+	AddBlock(nextBlock())
+	state, _ := CurrentState()
+	report := AnalyzeTreasurySolvency(state, 1)
+	if !report.Sustainable || report.RunwayBlocks != -1 || report.NetIncome.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("Empty block should add 3 to the treasury sustainably, got net %s", report.NetIncome)
+	}
+	if report.ModelSupplyNet.Cmp(big.NewRat(6, 1)) != 0 {
+		t.Errorf("S_net should be 6 with W = 0, got %s", report.ModelSupplyNet.FloatString(2))
+	}
+
+	// Sponsoring large fees costs the coalition more than its (9 + W) / 3 share
+	for i := 0; i < 2; i++ {
+		sponsored := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(0), i+1, strings.Repeat("x", 2000))
+		sponsored.SetPublisher(publisher.GetAddress())
+		sponsored.ProcessTransactionFee()
+		sponsored.SignTransaction(user.PrivateKey)
+		sponsored.SignAsPublisher(publisher)
+		if !AddBlock(nextBlock(sponsored)) {
+			t.Fatalf("Sponsored transaction should be accepted")
+		}
+	}
+	state, _ = CurrentState()
+	report = AnalyzeTreasurySolvency(state, 2)
+	if report.Blocks != 2 || report.FromHeight != 3 {
+		t.Fatalf("Window should cover heights 3 to 4, got %d from %d", report.Blocks, report.FromHeight)
+	}
+	// Fee 21 each: income (9 + 21) / 3 = 10, sponsorship 21, net -11 per block
+	if report.SponsoredFees.Cmp(big.NewInt(42)) != 0 || report.RewardIncome.Cmp(big.NewInt(20)) != 0 {
+		t.Errorf("Expected 42 sponsored and 20 income, got %s and %s", report.SponsoredFees, report.RewardIncome)
+	}
+	if report.Sustainable {
+		t.Errorf("Sponsorship above the model income should be flagged")
+	}
+	expectedRunway := new(big.Int).Div(state.BalanceOf(CoalitionAddress), big.NewInt(11)).Int64()
+	if report.RunwayBlocks != expectedRunway {
+		t.Errorf("Runway should be %d blocks, got %d", expectedRunway, report.RunwayBlocks)
+	}
+}
+
+func TestFeePayer(t *testing.T) {
+	user := CreateWallet()
+	paymaster := CreateWallet()
+	resetTestChain(t,
+		NewTransaction("0", user.GetAddress(), big.NewInt(100), 0, "Genesis"),
+		NewTransaction("0", paymaster.GetAddress(), big.NewInt(100), 1, "Genesis"))
+	paidTx := func(nonce int, payer *Wallet) *Transaction {
+		tx := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(10), nonce, "Paid by paymaster")
+		tx.SetFeePayer(paymaster.GetAddress())
+		if !tx.ProcessTransactionFee() {
+			t.Fatalf("Paymaster should be able to cover the fee")
+		}
+		tx.SignTransaction(user.PrivateKey)
+		if payer != nil {
+			tx.FeePayer = payer.GetAddress()
+			tx.SignAsFeePayer(payer)
+			tx.FeePayer = paymaster.GetAddress()
+		} else if err := tx.SignAsFeePayer(paymaster); err != nil {
+			t.Fatalf("Failed to countersign: %v", err)
+		}
+		return tx
+	}
+
+	// A countersignature from another wallet does not authorize the payer
+	if AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{paidTx(0, CreateWallet())}, user.GetAddress(), nil)) {
+		t.Errorf("Transaction without the payer's countersignature should be rejected")
+	}
+
+	tx := paidTx(0, nil)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, user.GetAddress(), nil)) {
+		t.Fatalf("Transaction paid by a paymaster should be accepted")
+	}
+	state, _ := CurrentState()
+	if GetBalance(user.GetAddress()).Cmp(new(big.Int).Add(big.NewInt(90), state.LastReward.Miner)) != 0 {
+		t.Errorf("Sender should only pay the amount, got balance %s", GetBalance(user.GetAddress()))
+	}
+	if GetBalance(paymaster.GetAddress()).Cmp(new(big.Int).Sub(big.NewInt(100), tx.Fee)) != 0 {
+		t.Errorf("Paymaster should pay the fee, got balance %s", GetBalance(paymaster.GetAddress()))
+	}
+
+	// Raising the fee after the payer signed invalidates the countersignature
+	raised := paidTx(1, nil)
+	raised.Fee = new(big.Int).Add(raised.Fee, big.NewInt(50))
+	if AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{raised}, user.GetAddress(), nil)) {
+		t.Errorf("Fee changed after the payer signed should be rejected")
+	}
+
+	coalitionPaid := NewTransaction(user.GetAddress(), "Recipient", big.NewInt(1), 2, "")
+	coalitionPaid.SetFeePayer(CoalitionAddress)
+	coalitionPaid.ProcessTransactionFee()
+	coalitionPaid.SignTransaction(user.PrivateKey)
+	if AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{coalitionPaid}, user.GetAddress(), nil)) {
+		t.Errorf("Coalition should only pay fees through publisher sponsorship")
+	}
+
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with a paymaster transaction should validate: %v", err)
+	}
+}
+
+func TestSidechainMerkleProofs(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(100), 0, "Genesis"))
+	sc := CreateSidechain("proof-test", "Proof Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	txs := signedMicroTransfers(5)
+	addTestSidechainBlock(t, sc, txs[:3], validators[:2]...)
+	addTestSidechainBlock(t, sc, txs[3:], validators[:2]...)
+	header, _ := sc.GenerateSidechainHeader(1, 2)
+	block := Block{Index: 7, SidechainHeaders: []SidechainHeader{*header}}
+
+	// Every transaction, including the unpaired last one, has a verifiable proof
+	for _, tx := range txs {
+		proof, err := sc.GenerateMerkleProof(*header, tx.ID)
+		if err != nil {
+			t.Fatalf("Failed to generate proof: %v", err)
+		}
+		if err := VerifyTransactionInclusion(block, tx, proof); err != nil {
+			t.Errorf("Proof for transaction %d should verify: %v", proof.Index, err)
+		}
+	}
+
+	proof, _ := sc.GenerateMerkleProof(*header, txs[1].ID)
+	if VerifyTransactionInclusion(block, txs[2], proof) == nil {
+		t.Errorf("Proof should not cover a different transaction")
+	}
+	proof.Siblings[0] = txs[3].ID
+	if VerifyMerkleProof(block, proof) == nil {
+		t.Errorf("Proof with a tampered sibling should fail")
+	}
+	if VerifyMerkleProof(Block{Index: 8}, proof) == nil {
+		t.Errorf("Proof should fail against a block without the header")
+	}
+	if _, err := sc.GenerateMerkleProof(*header, "missing"); err == nil {
+		t.Errorf("Proof for a transaction outside the range should fail")
+	}
+}
+
+func TestMerkleTreeDomainSeparation(t *testing.T) {
+	var txs []*Transaction
+	for i := 0; i < 3; i++ {
+		txs = append(txs, NewTransaction("UserA", "UserB", big.NewInt(1), i, fmt.Sprintf("Leaf %d", i)))
+	}
+
+	// Repeating the unpaired last leaf must change the root
+	duplicated := append(append([]*Transaction{}, txs...), txs[2])
+	if CalculateMerkleRoot(txs) == CalculateMerkleRoot(duplicated) {
+		t.Errorf("Duplicating the last leaf should change the root")
+	}
+
+	// An inner node must not be accepted as a leaf
+	a, b := transactionLeaf(txs[0].ID), transactionLeaf(txs[1].ID)
+	inner := merkleNodeHash(merkleLeafHash(a), merkleLeafHash(b))
+	if MerkleRoot([][]byte{a, b}) == MerkleRoot([][]byte{inner}) {
+		t.Errorf("A single leaf should not collide with an inner node")
+	}
+	if CalculateMerkleRoot(nil) != EmptyMerkleRoot {
+		t.Errorf("Empty tree should have the empty root")
+	}
+
+	// Main-chain block hashes commit to the transaction root
+	block := GenerateBlock(Block{Hash: "prev"}, txs, "Validator", nil)
+	reordered := block
+	reordered.Transactions = []*Transaction{txs[1], txs[0], txs[2]}
+	if CalculateHash(reordered) == block.Hash {
+		t.Errorf("Reordering block transactions should change the block hash")
+	}
+}
+
+// registerTestSidechain registers a sidechain with a 2-of-3 validator set in a new block
+// proposed by the operator, returning the validators
+func registerTestSidechain(t *testing.T, operator *Wallet, nonce int, sc *Sidechain) []*Wallet {
+	return registerTestSidechainWithFee(t, operator, nonce, sc, nil)
+}
+
+// registerTestSidechainWithFee registers a sidechain charging a fee per sidechain transaction
+func registerTestSidechainWithFee(t *testing.T, operator *Wallet, nonce int, sc *Sidechain, fee *big.Int) []*Wallet {
+	var validators []*Wallet
+	var keys []string
+	for i := 0; i < 3; i++ {
+		validator := CreateWallet()
+		validators = append(validators, validator)
+		keys = append(keys, validator.GetAddress())
+	}
+	tx, err := NewSidechainRegistrationTransaction(operator.GetAddress(), nonce, SidechainRegistration{
+		SidechainID: sc.ID,
+		Name:        sc.Name,
+		Validators:  SidechainValidatorSet{Validators: keys, Threshold: 2},
+		Fee:         fee,
+	})
+	if err != nil {
+		t.Fatalf("Creating sidechain registration failed: %v", err)
+	}
+	tx.ProcessTransactionFee()
+	tx.SignTransaction(operator.PrivateKey)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil)) {
+		t.Fatalf("Sidechain registration should be accepted")
+	}
+	return validators
+}
+
+// addTestSidechainBlock adds a sidechain block signed by the given validators
+func addTestSidechainBlock(t *testing.T, sc *Sidechain, txs []*Transaction, signers ...*Wallet) {
+	if _, err := sc.AddSidechainBlock(txs, signers...); err != nil {
+		t.Fatalf("Adding sidechain block failed: %v", err)
+	}
+}
+
+// signedHeader archives a range, generates its header and signs it with the given validators
+func signedHeader(t *testing.T, sc *Sidechain, start, end int, signers ...*Wallet) SidechainHeader {
+	if _, err := ArchiveSidechainBatch(sc, start, end); err != nil {
+		t.Fatalf("Archiving range failed: %v", err)
+	}
+	header, err := sc.GenerateSidechainHeader(start, end)
+	if err != nil {
+		t.Fatalf("Generating header failed: %v", err)
+	}
+	for _, signer := range signers {
+		if err := header.Sign(signer); err != nil {
+			t.Fatalf("Signing header failed: %v", err)
+		}
+	}
+	return *header
+}
+
+// signedMicroTransfers returns zero-value sidechain transfers signed by a new wallet
+func signedMicroTransfers(n int) []*Transaction {
+	sender := CreateWallet()
+	var txs []*Transaction
+	for i := 0; i < n; i++ {
+		tx := NewTransaction(sender.GetAddress(), "UserB", big.NewInt(0), i, fmt.Sprintf("Micro %d", i))
+		tx.SignTransaction(sender.PrivateKey)
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// appendForgedSidechainBlock appends a block signed by the given validators without
+// checking its transactions or state root, as a dishonest federation could
+// Its trace skips invalid transactions, as if they left the ledger unchanged
+func appendForgedSidechainBlock(sc *Sidechain, txs []*Transaction, stateRoot string, signers ...*Wallet) {
+	prev := sc.Blocks[len(sc.Blocks)-1]
+	anchor := &SidechainAnchor{}
+	if state, err := CurrentState(); err == nil && state.Sidechains[sc.ID] != nil {
+		anchor = state.Sidechains[sc.ID]
+	}
+	ledger := sc.State.Copy()
+	var trace []string
+	for _, tx := range txs {
+		ledger.ApplyTransaction(tx, anchor)
+		trace = append(trace, ledger.StateRoot())
+	}
+	block := SidechainBlock{
+		Index:        prev.Index + 1,
+		Timestamp:    time.Now().String(),
+		Transactions: txs,
+		TxStateRoots: trace,
+		PrevHash:     prev.Hash,
+		StateRoot:    stateRoot,
+		Validator:    signers[0].GetAddress(),
+	}
+	block.Hash = CalculateSidechainBlockHash(block)
+	for _, signer := range signers {
+		block.Sign(signer)
+	}
+	sc.Blocks = append(sc.Blocks, block)
+}
+
+func TestSidechainHeaderAnchoring(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(100), 0, "Genesis"))
+	sc := CreateSidechain("anchor-test", "Anchor Chain")
+	defer delete(SidechainRegistry, sc.ID)
+
+	anchor := func(header SidechainHeader) bool {
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header}))
+	}
+
+	if anchor(signedHeader(t, sc, 0, 0)) {
+		t.Errorf("Header of an unregistered sidechain should be rejected")
+	}
+	validators := registerTestSidechain(t, operator, 0, sc)
+	addTestSidechainBlock(t, sc, signedMicroTransfers(1), validators[:2]...)
+
+	if anchor(signedHeader(t, sc, 0, 1, validators[0])) {
+		t.Errorf("Header below the validator threshold should be rejected")
+	}
+	if anchor(signedHeader(t, sc, 0, 1, validators[0], CreateWallet())) {
+		t.Errorf("Signature from outside the validator set should not count")
+	}
+	first := signedHeader(t, sc, 0, 1, validators[0], validators[1])
+	before := GetBalance(operator.GetAddress())
+	if !anchor(first) {
+		t.Fatalf("Header signed by the threshold should be anchored")
+	}
+
+	// The proposer pays the fee an anchor transaction would, and it goes into W
+	equivalent, _ := NewSidechainAnchorTransaction(operator.GetAddress(), 1, first)
+	fee := equivalent.CalculateFee()
+	state, _ := CurrentState()
+	if state.LastReward.Fees.Cmp(fee) != 0 {
+		t.Errorf("Block fees should include the %s anchoring fee, got %s", fee, state.LastReward.Fees)
+	}
+	expected := new(big.Int).Add(new(big.Int).Sub(before, fee), state.LastReward.Miner)
+	if balance := GetBalance(operator.GetAddress()); balance.Cmp(expected) != 0 {
+		t.Errorf("Proposer should pay the anchoring fee, balance %s, expected %s", balance, expected)
+	}
+
+	// Main-chain validation needs no sidechain blocks
+	delete(SidechainRegistry, sc.ID)
+	addTestSidechainBlock(t, sc, nil, validators[1:]...)
+	if anchor(signedHeader(t, sc, 1, 2, validators[1], validators[2])) {
+		t.Errorf("Header overlapping an anchored range should be rejected")
+	}
+	unlinked := signedHeader(t, sc, 2, 2)
+	unlinked.PrevHeaderHash = ""
+	unlinked.Sign(validators[1])
+	unlinked.Sign(validators[2])
+	if anchor(unlinked) {
+		t.Errorf("Header not linked to the previous anchored header should be rejected")
+	}
+	next := signedHeader(t, sc, 2, 2, validators[1], validators[2])
+	if next.PrevHeaderHash != first.CalculateHash() {
+		t.Errorf("Generated header should link to the last anchored header")
+	}
+	if !anchor(next) {
+		t.Fatalf("Linked header should be anchored")
+	}
+
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with anchored headers should validate: %v", err)
+	}
+}
+
+func TestSidechainValidatorRotation(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(100), 0, "Genesis"))
+	sc := CreateSidechain("rotation-test", "Rotation Chain")
+	defer delete(SidechainRegistry, sc.ID)
+
+	if _, err := sc.AddSidechainBlock(nil, CreateWallet()); err == nil {
+		t.Errorf("Unregistered sidechain should not accept blocks")
+	}
+	validators := registerTestSidechain(t, operator, 0, sc)
+	if _, err := sc.AddSidechainBlock(nil, validators[0]); err == nil {
+		t.Errorf("Block below the signing threshold should be rejected")
+	}
+	if _, err := sc.AddSidechainBlock(nil, CreateWallet(), validators[0]); err == nil {
+		t.Errorf("Block proposed by a non-validator should be rejected")
+	}
+	addTestSidechainBlock(t, sc, nil, validators[0], validators[1])
+	addTestSidechainBlock(t, sc, nil, validators[1], validators[2])
+
+	// Rotate to a 1-of-1 set from sidechain block 3
+	successor := CreateWallet()
+	rotate := func(nonce, effective int, signers ...*Wallet) bool {
+		tx, err := NewSidechainValidatorRotationTransaction(operator.GetAddress(), nonce, SidechainValidatorRotation{
+			SidechainID:    sc.ID,
+			Validators:     SidechainValidatorSet{Validators: []string{successor.GetAddress()}, Threshold: 1},
+			EffectiveBlock: effective,
+		})
+		if err != nil {
+			t.Fatalf("Creating rotation failed: %v", err)
+		}
+		tx.ProcessTransactionFee()
+		coSign(t, tx, signers...)
+		tx.SignTransaction(operator.PrivateKey)
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil))
+	}
+	if rotate(1, 3, validators[0]) {
+		t.Errorf("Rotation below the current threshold should be rejected")
+	}
+	if !rotate(1, 3, validators[0], validators[2]) {
+		t.Fatalf("Rotation signed by the current threshold should be accepted")
+	}
+
+	if _, err := sc.AddSidechainBlock(nil, validators[0], validators[1]); err == nil {
+		t.Errorf("Retired validators should not sign blocks after the rotation")
+	}
+	addTestSidechainBlock(t, sc, nil, successor)
+
+	anchor := func(header SidechainHeader) bool {
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header}))
+	}
+	if anchor(signedHeader(t, sc, 0, 3, validators[0], validators[1])) {
+		t.Errorf("Header spanning a validator set change should be rejected")
+	}
+	if anchor(signedHeader(t, sc, 0, 2, successor)) {
+		t.Errorf("Header before the rotation should need the old set")
+	}
+	if !anchor(signedHeader(t, sc, 0, 2, validators[0], validators[1])) {
+		t.Fatalf("Header before the rotation signed by the old set should be anchored")
+	}
+	if !anchor(signedHeader(t, sc, 3, 3, successor)) {
+		t.Fatalf("Header after the rotation signed by the new set should be anchored")
+	}
+	if rotate(2, 2, successor) {
+		t.Errorf("Rotation cannot take effect on anchored blocks")
+	}
+
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with validator rotation should validate: %v", err)
+	}
+}
+
+func TestSidechainAnchorContinuity(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(100), 0, "Genesis"))
+	sc := CreateSidechain("continuity-test", "Continuity Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	for i := 0; i < 4; i++ {
+		addTestSidechainBlock(t, sc, nil, validators[:2]...)
+	}
+	anchor := func(headers ...SidechainHeader) bool {
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), headers))
+	}
+
+	if anchor(signedHeader(t, sc, 1, 2, validators[:2]...)) {
+		t.Errorf("First header must start at sidechain block 0")
+	}
+	first := signedHeader(t, sc, 0, 1, validators[:2]...)
+	if anchor(first, first) {
+		t.Errorf("Anchoring the same header twice in a block should be rejected")
+	}
+	if !anchor(first) {
+		t.Fatalf("First header should be anchored")
+	}
+	if anchor(first) {
+		t.Errorf("Anchoring a header again should be rejected")
+	}
+	if anchor(signedHeader(t, sc, 3, 4, validators[:2]...)) {
+		t.Errorf("Range leaving a gap should be rejected")
+	}
+
+	// Consecutive headers can share a block when each links to the one before it
+	second := signedHeader(t, sc, 2, 2, validators[:2]...)
+	third, _ := sc.GenerateSidechainHeader(3, 4)
+	third.PrevHeaderHash = second.CalculateHash()
+	third.Sign(validators[0])
+	third.Sign(validators[1])
+	if !anchor(second, *third) {
+		t.Fatalf("Consecutive linked headers should be anchored")
+	}
+
+	stats := GetSidechainAnchor(sc.ID)
+	if stats["last_block"] != 4 || stats["anchored_headers"] != 3 || stats["last_header_hash"] != third.CalculateHash() {
+		t.Errorf("Anchor should track the last range and header, got %v", stats)
+	}
+	state, _ := CurrentState()
+	if header, ok := state.Sidechains[sc.ID].HeaderFor(2); !ok || header.HeaderHash != second.CalculateHash() {
+		t.Errorf("Block 2 should be covered by the second header")
+	}
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with contiguous anchors should validate: %v", err)
+	}
+}
+
+func TestAnchoringService(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(1000), 0, "Genesis"))
+	sc := CreateSidechain("service-test", "Service Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	service := NewAnchoringService(sc, operator, validators, AnchoringPolicy{BlockInterval: 3, TimeInterval: time.Hour})
+	include := func(tx *Transaction) Block {
+		block := GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil)
+		if !AddBlock(block) {
+			t.Fatalf("Anchor transaction should be accepted")
+		}
+		return block
+	}
+
+	micro := signedMicroTransfers(1)[0]
+	addTestSidechainBlock(t, sc, []*Transaction{micro}, validators[:2]...)
+	if tx, err := service.Tick(time.Now()); err != nil || tx != nil {
+		t.Fatalf("Two unanchored blocks within the hour should not be anchored yet: %v", err)
+	}
+
+	// The time policy triggers once the oldest unanchored block is an hour old
+	tx, err := service.Tick(time.Now().Add(2 * time.Hour))
+	if err != nil || tx == nil {
+		t.Fatalf("Aged blocks should be anchored: %v", err)
+	}
+	if retried, _ := service.Tick(time.Now()); retried != tx || service.Retries != 1 {
+		t.Errorf("Pending anchor should be resubmitted until included")
+	}
+	if stats := service.GetAnchoringStats(time.Now()); stats["unanchored_blocks"] != 2 || stats["pending"] != true {
+		t.Errorf("Unexpected lag before inclusion: %v", stats)
+	}
+	anchoredBlock := include(tx)
+	if next, _ := service.Tick(time.Now()); next != nil || service.Included != 1 {
+		t.Errorf("Included anchor should be recorded and nothing left to anchor")
+	}
+	stats := service.GetAnchoringStats(time.Now())
+	if stats["unanchored_blocks"] != 0 || stats["last_anchored_block"] != 1 || stats["fees_paid"] != tx.Fee.String() {
+		t.Errorf("Unexpected stats after inclusion: %v", stats)
+	}
+
+	// Headers anchored by transaction support inclusion proofs
+	header, _ := anchorTransactionHeader(tx)
+	proof, err := sc.GenerateMerkleProof(*header, micro.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate proof: %v", err)
+	}
+	if err := VerifyTransactionInclusion(anchoredBlock, micro, proof); err != nil {
+		t.Errorf("Proof should verify against the anchoring block: %v", err)
+	}
+
+	// The block policy triggers after three more blocks
+	for i := 0; i < 3; i++ {
+		addTestSidechainBlock(t, sc, nil, validators[:2]...)
+	}
+	tx, err = service.Tick(time.Now())
+	if err != nil || tx == nil {
+		t.Fatalf("Three unanchored blocks should be anchored: %v", err)
+	}
+	include(tx)
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain anchored by the service should validate: %v", err)
+	}
+	if GetSidechainAnchor(sc.ID)["last_block"] != 4 {
+		t.Errorf("Service should have anchored every block")
+	}
+}
+
+func TestSidechainBridge(t *testing.T) {
+	operator := CreateWallet()
+	user := CreateWallet()
+	resetTestChain(t,
+		NewTransaction("0", operator.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(1000), 1, "Genesis"))
+	sc := CreateSidechain("bridge-test", "Bridge Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	submit := func(tx *Transaction, signer *Wallet) bool {
+		tx.ProcessTransactionFee()
+		tx.SignTransaction(signer.PrivateKey)
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil))
+	}
+
+	// Lock 100 on the main chain and mint it on the sidechain
+	deposit, _ := NewBridgeDepositTransaction(user.GetAddress(), 0, sc.ID, user.GetAddress(), big.NewInt(100))
+	if !submit(deposit, user) {
+		t.Fatalf("Deposit should be accepted")
+	}
+	if GetBalance(BridgeEscrowAddress(sc.ID)).Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("Deposit should be locked in escrow")
+	}
+	mints, err := sc.PendingDeposits()
+	if err != nil || len(mints) != 1 {
+		t.Fatalf("Deposit should be pending on the sidechain: %v", err)
+	}
+	forged := *mints[0]
+	forged.Amount = big.NewInt(1000)
+	forged.ID = forged.CalculateHash()
+	if _, err := sc.AddSidechainBlock([]*Transaction{&forged}, validators[:2]...); err == nil {
+		t.Errorf("Mint not matching the deposit should be rejected")
+	}
+	addTestSidechainBlock(t, sc, mints, validators[:2]...)
+	if mints, _ := sc.PendingDeposits(); len(mints) != 0 {
+		t.Errorf("Minted deposit should no longer be pending")
+	}
+	if _, err := sc.AddSidechainBlock([]*Transaction{mints[0]}, validators[:2]...); err == nil {
+		t.Errorf("Deposit should only be minted once")
+	}
+
+	// Burn 40 on the sidechain and anchor the batch
+	burn := NewBridgeBurnTransaction(user.GetAddress(), user.GetAddress(), big.NewInt(40), 0)
+	burn.SignTransaction(user.PrivateKey)
+	addTestSidechainBlock(t, sc, []*Transaction{burn}, validators[:2]...)
+	if sc.BridgedSupply().Cmp(big.NewInt(60)) != 0 {
+		t.Errorf("Bridged supply should be 60, got %s", sc.BridgedSupply())
+	}
+	header := signedHeader(t, sc, 0, 2, validators[:2]...)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header})) {
+		t.Fatalf("Header should be anchored")
+	}
+	proof, _ := sc.GenerateMerkleProof(header, burn.ID)
+
+	inflated := *burn
+	inflated.Amount = big.NewInt(90)
+	inflated.ID = inflated.CalculateHash()
+	badClaim, _ := NewBridgeWithdrawalTransaction(user.GetAddress(), 1, &inflated, proof)
+	if submit(badClaim, user) {
+		t.Errorf("Claim for a burn not covered by the proof should be rejected")
+	}
+	claim, _ := NewBridgeWithdrawalTransaction(user.GetAddress(), 1, burn, proof)
+	if !submit(claim, user) {
+		t.Fatalf("Proven withdrawal should be claimed")
+	}
+	again, _ := NewBridgeWithdrawalTransaction(user.GetAddress(), 2, burn, proof)
+	if submit(again, user) {
+		t.Errorf("Burn should only be claimed once")
+	}
+
+	release, _ := NewBridgeReleaseTransaction(user.GetAddress(), 2, sc.ID, burn.ID)
+	if submit(release, user) {
+		t.Errorf("Release during the challenge period should be rejected")
+	}
+	for i := 0; i < BridgeChallengePeriod; i++ {
+		AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), nil))
+	}
+	before := GetBalance(user.GetAddress())
+	release, _ = NewBridgeReleaseTransaction(user.GetAddress(), 2, sc.ID, burn.ID)
+	if !submit(release, user) {
+		t.Fatalf("Release after the challenge period should be accepted")
+	}
+	if gained := new(big.Int).Sub(GetBalance(user.GetAddress()), before); gained.Cmp(new(big.Int).Sub(big.NewInt(40), release.Fee)) != 0 {
+		t.Errorf("Recipient should receive 40 less the fee, gained %s", gained)
+	}
+	stats := GetBridgeStats(sc.ID)
+	if stats["locked"] != "60" || stats["released"] != 1 || stats["pending_withdrawals"] != 0 {
+		t.Errorf("Unexpected bridge stats: %v", stats)
+	}
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with bridge transfers should validate: %v", err)
+	}
+}
+
+func TestSidechainFraudProof(t *testing.T) {
+	operator := CreateWallet()
+	user := CreateWallet()
+	challenger := CreateWallet()
+	resetTestChain(t,
+		NewTransaction("0", operator.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(1000), 1, "Genesis"),
+		NewTransaction("0", challenger.GetAddress(), big.NewInt(1000), 2, "Genesis"))
+	sc := CreateSidechain("fraud-test", "Fraud Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	submit := func(tx *Transaction, signer *Wallet) bool {
+		tx.ProcessTransactionFee()
+		tx.SignTransaction(signer.PrivateKey)
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil))
+	}
+	anchor := func(header SidechainHeader) {
+		if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header})) {
+			t.Fatalf("Header %s should be anchored", header.BlockRange)
+		}
+	}
+	state := func() *SidechainAnchor {
+		s, err := CurrentState()
+		if err != nil {
+			t.Fatalf("Error building state: %v", err)
+		}
+		return s.Sidechains[sc.ID]
+	}
+
+	// Mint 100 and burn 40 of it in a valid batch
+	deposit, _ := NewBridgeDepositTransaction(user.GetAddress(), 0, sc.ID, user.GetAddress(), big.NewInt(100))
+	if !submit(deposit, user) {
+		t.Fatalf("Deposit should be accepted")
+	}
+	mints, _ := sc.PendingDeposits()
+	addTestSidechainBlock(t, sc, mints, validators[:2]...)
+	burn := NewBridgeBurnTransaction(user.GetAddress(), user.GetAddress(), big.NewInt(40), 0)
+	burn.SignTransaction(user.PrivateKey)
+	addTestSidechainBlock(t, sc, []*Transaction{burn}, validators[:2]...)
+	validHeader := signedHeader(t, sc, 0, 2, validators[:2]...)
+	anchor(validHeader)
+
+	// The validators then sign a batch burning more than the user holds
+	overspend := NewBridgeBurnTransaction(user.GetAddress(), user.GetAddress(), big.NewInt(500), 1)
+	overspend.SignTransaction(user.PrivateKey)
+	appendForgedSidechainBlock(sc, []*Transaction{overspend}, sc.State.StateRoot(), validators[:2]...)
+	badHeader := signedHeader(t, sc, 3, 3, validators[:2]...)
+	anchor(badHeader)
+
+	// A later range is anchored on top of the invalid one before anyone challenges it
+	laterBurn := NewBridgeBurnTransaction(user.GetAddress(), user.GetAddress(), big.NewInt(10), 1)
+	laterBurn.SignTransaction(user.PrivateKey)
+	addTestSidechainBlock(t, sc, []*Transaction{laterBurn}, validators[:2]...)
+	laterHeader := signedHeader(t, sc, 4, 4, validators[:2]...)
+	anchor(laterHeader)
+
+	proof, _ := sc.GenerateMerkleProof(validHeader, burn.ID)
+	claim, _ := NewBridgeWithdrawalTransaction(user.GetAddress(), 1, burn, proof)
+	if !submit(claim, user) {
+		t.Fatalf("Withdrawal from the valid range should be claimed")
+	}
+	proof, _ = sc.GenerateMerkleProof(badHeader, overspend.ID)
+	claim, _ = NewBridgeWithdrawalTransaction(user.GetAddress(), 2, overspend, proof)
+	if !submit(claim, user) {
+		t.Fatalf("Withdrawal from the unchallenged range should be claimed")
+	}
+
+	// A fraud proof against a valid transaction is rejected
+	evidence, err := sc.BuildFraudProof(state(), validHeader.BlockRange, burn.ID)
+	if err != nil {
+		t.Fatalf("Error building fraud proof: %v", err)
+	}
+	fraudTx, _ := NewSidechainFraudProofTransaction(challenger.GetAddress(), 0, *evidence)
+	if submit(fraudTx, challenger) {
+		t.Errorf("Fraud proof against a valid transaction should be rejected")
+	}
+
+	// Pre-state evidence must prove the values the batch reads against the previous state root
+	evidence, err = sc.BuildFraudProof(state(), badHeader.BlockRange, overspend.ID)
+	if err != nil {
+		t.Fatalf("Error building fraud proof: %v", err)
+	}
+	if evidence.TxIndex != 0 || evidence.Transaction.ID != overspend.ID || len(evidence.PreState) != 1 || evidence.PreState[0].Value != "60|1" {
+		t.Errorf("Fraud proof should carry the transaction and the sender's account, got %+v", evidence)
+	}
+	tampered := *evidence
+	tampered.PreState = []StateKeyProof{evidence.PreState[0]}
+	tampered.PreState[0].Value = "0|1"
+	fraudTx, _ = NewSidechainFraudProofTransaction(challenger.GetAddress(), 0, tampered)
+	if submit(fraudTx, challenger) {
+		t.Errorf("Fraud proof with a forged pre-state should be rejected")
+	}
+	tampered.PreState = nil
+	fraudTx, _ = NewSidechainFraudProofTransaction(challenger.GetAddress(), 0, tampered)
+	if submit(fraudTx, challenger) {
+		t.Errorf("Fraud proof without the sender's account should be rejected")
+	}
+
+	fraudTx, _ = NewSidechainFraudProofTransaction(challenger.GetAddress(), 0, *evidence)
+	if !submit(fraudTx, challenger) {
+		t.Fatalf("Fraud proof of an overspend should be accepted")
+	}
+	if header, _ := state().HeaderForRange("3-3"); !header.Invalid {
+		t.Errorf("Range should be marked invalid")
+	}
+	if header, _ := state().HeaderForRange("4-4"); !header.Invalid {
+		t.Errorf("Range anchored on the invalid one should be marked invalid")
+	}
+	if rolledBack := state(); rolledBack.LastBlock != 2 || rolledBack.LastHeaderHash != validHeader.CalculateHash() {
+		t.Errorf("Anchoring should resume after the last valid range, got block %d", rolledBack.LastBlock)
+	}
+	proof, _ = sc.GenerateMerkleProof(laterHeader, laterBurn.ID)
+	claim, _ = NewBridgeWithdrawalTransaction(user.GetAddress(), 3, laterBurn, proof)
+	if submit(claim, user) {
+		t.Errorf("Withdrawal from a range anchored after the invalid one should be refused")
+	}
+	fraudTx, _ = NewSidechainFraudProofTransaction(challenger.GetAddress(), 1, *evidence)
+	if submit(fraudTx, challenger) {
+		t.Errorf("Range should only be proven invalid once")
+	}
+	if info := GetSidechainAnchor(sc.ID); info["invalid_headers"] != 2 || info["penalized"] != 2 {
+		t.Errorf("Unexpected anchor info: %v", info)
+	}
+
+	// Withdrawals from the invalid range stay frozen; earlier ones are released
+	for i := 0; i < BridgeChallengePeriod; i++ {
+		AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), nil))
+	}
+	release, _ := NewBridgeReleaseTransaction(user.GetAddress(), 3, sc.ID, overspend.ID)
+	if submit(release, user) {
+		t.Errorf("Frozen withdrawal should not be released")
+	}
+	release, _ = NewBridgeReleaseTransaction(user.GetAddress(), 3, sc.ID, burn.ID)
+	if !submit(release, user) {
+		t.Errorf("Withdrawal from the valid range should be released")
+	}
+	if stats := GetBridgeStats(sc.ID); stats["frozen"] != 1 || stats["released"] != 1 {
+		t.Errorf("Unexpected bridge stats: %v", stats)
+	}
+
+	// Penalized validators can neither rotate the set nor sign blocks
+	rotation, _ := NewSidechainValidatorRotationTransaction(operator.GetAddress(), 1, SidechainValidatorRotation{
+		SidechainID:    sc.ID,
+		Validators:     SidechainValidatorSet{Validators: []string{challenger.GetAddress()}, Threshold: 1},
+		EffectiveBlock: 5,
+	})
+	rotation.ProcessTransactionFee()
+	coSign(t, rotation, validators...)
+	if submit(rotation, operator) {
+		t.Errorf("Rotation counting penalized validators toward the threshold should be rejected")
+	}
+	if _, err := sc.AddSidechainBlock(nil, validators...); err == nil {
+		t.Errorf("Block signed by one unpenalized validator should be rejected")
+	}
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with a fraud proof should validate: %v", err)
+	}
+}
+
+func TestSidechainFraudProofSize(t *testing.T) {
+	operator := CreateWallet()
+	user := CreateWallet()
+	resetTestChain(t,
+		NewTransaction("0", operator.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(1000), 1, "Genesis"))
+	sc := CreateSidechain("fraud-size-test", "Fraud Size Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	anchor := func(header SidechainHeader) {
+		if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header})) {
+			t.Fatalf("Header %s should be anchored", header.BlockRange)
+		}
+	}
+
+	deposit, _ := NewBridgeDepositTransaction(user.GetAddress(), 0, sc.ID, user.GetAddress(), big.NewInt(100))
+	deposit.ProcessTransactionFee()
+	deposit.SignTransaction(user.PrivateKey)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{deposit}, operator.GetAddress(), nil)) {
+		t.Fatalf("Deposit should be accepted")
+	}
+	mints, _ := sc.PendingDeposits()
+	addTestSidechainBlock(t, sc, mints, validators[:2]...)
+	anchor(signedHeader(t, sc, 0, 1, validators[:2]...))
+
+	// A long history of large ranges paying many accounts
+	nonce := 0
+	transfers := func(n int) []*Transaction {
+		var txs []*Transaction
+		for i := 0; i < n; i++ {
+			tx := NewTransaction(user.GetAddress(), CreateWallet().GetAddress(), big.NewInt(1), nonce, "")
+			tx.SignTransaction(user.PrivateKey)
+			txs = append(txs, tx)
+			nonce++
+		}
+		return txs
+	}
+	for block := 2; block < 7; block++ {
+		addTestSidechainBlock(t, sc, transfers(12), validators[:2]...)
+		anchor(signedHeader(t, sc, block, block, validators[:2]...))
+	}
+
+	// The federation forges the ledger root after one transaction of a large range
+	// and carries on from it, ending at the root its own trace claims
+	txs := transfers(24)
+	ledger := sc.State.Copy()
+	for _, tx := range txs {
+		ledger.ApplyTransaction(tx, &SidechainAnchor{})
+	}
+	appendForgedSidechainBlock(sc, txs, ledger.StateRoot(), validators[:2]...)
+	forged := &sc.Blocks[len(sc.Blocks)-1]
+	forged.TxStateRoots[17] = strings.Repeat("e", 64)
+	forged.Hash = CalculateSidechainBlockHash(*forged)
+	forged.Signatures = nil
+	for _, signer := range validators[:2] {
+		forged.Sign(signer)
+	}
+	anchor(signedHeader(t, sc, 7, 7, validators[:2]...))
+
+	state, _ := CurrentState()
+	if _, err := sc.BuildFraudProof(state.Sidechains[sc.ID], "7-7", txs[20].ID); err == nil {
+		t.Errorf("Fraud proof should not skip the first wrong step")
+	}
+	evidence, err := sc.BuildFraudProof(state.Sidechains[sc.ID], "7-7", txs[3].ID)
+	if err != nil {
+		t.Fatalf("Error building fraud proof: %v", err)
+	}
+	if _, _, err := verifyFraudProof(state.Sidechains[sc.ID], evidence); err == nil {
+		t.Errorf("Fraud proof of a correct step should be rejected")
+	}
+
+	// The proof replays the one wrong step, not the range or the history
+	evidence, err = sc.BuildFraudProof(state.Sidechains[sc.ID], "7-7", "")
+	if err != nil {
+		t.Fatalf("Error building fraud proof: %v", err)
+	}
+	if evidence.TxIndex != 17 || evidence.PostRoot.Root != forged.TxStateRoots[17] {
+		t.Errorf("Fraud proof should replay transaction 17, got %d", evidence.TxIndex)
+	}
+	tampered := *evidence
+	tampered.PostRoot = &TraceStep{Index: 17, Root: txs[17].ID, Siblings: evidence.PostRoot.Siblings}
+	if _, _, err := verifyFraudProof(state.Sidechains[sc.ID], &tampered); err == nil {
+		t.Errorf("Fraud proof with a root outside the trace should be rejected")
+	}
+	fraudTx, _ := NewSidechainFraudProofTransaction(operator.GetAddress(), 1, *evidence)
+	if size := len(fraudTx.Payload); size > 4096 {
+		t.Errorf("Fraud proof is %d bytes for a range of %d transactions", size, len(txs))
+	}
+	fraudTx.ProcessTransactionFee()
+	fraudTx.SignTransaction(operator.PrivateKey)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{fraudTx}, operator.GetAddress(), nil)) {
+		t.Errorf("Fraud proof of a forged step should be accepted")
+	}
+	state, _ = CurrentState()
+	if header, _ := state.Sidechains[sc.ID].HeaderForRange("7-7"); !header.Invalid {
+		t.Errorf("Range with a forged step should be marked invalid")
+	}
+}
+
+func TestSidechainAccountState(t *testing.T) {
+	operator := CreateWallet()
+	user := CreateWallet()
+	recipient := CreateWallet()
+	resetTestChain(t,
+		NewTransaction("0", operator.GetAddress(), big.NewInt(1000), 0, "Genesis"),
+		NewTransaction("0", user.GetAddress(), big.NewInt(1000), 1, "Genesis"))
+	sc := CreateSidechain("ledger-test", "Ledger Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechainWithFee(t, operator, 0, sc, big.NewInt(1))
+	anchor := func(header SidechainHeader) {
+		if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header})) {
+			t.Fatalf("Header %s should be anchored", header.BlockRange)
+		}
+	}
+	transfer := func(to string, amount int64, nonce int) *Transaction {
+		tx := NewTransaction(user.GetAddress(), to, big.NewInt(amount), nonce, "")
+		tx.SignTransaction(user.PrivateKey)
+		return tx
+	}
+
+	deposit, _ := NewBridgeDepositTransaction(user.GetAddress(), 0, sc.ID, user.GetAddress(), big.NewInt(100))
+	deposit.ProcessTransactionFee()
+	deposit.SignTransaction(user.PrivateKey)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{deposit}, operator.GetAddress(), nil)) {
+		t.Fatalf("Deposit should be accepted")
+	}
+	mints, _ := sc.PendingDeposits()
+	addTestSidechainBlock(t, sc, mints, validators[:2]...)
+
+	// Transfers follow the main chain's rules and pay the sidechain fee to the operator
+	unsigned := NewTransaction(user.GetAddress(), recipient.GetAddress(), big.NewInt(1), 0, "")
+	if _, err := sc.AddSidechainBlock([]*Transaction{unsigned}, validators[:2]...); err == nil {
+		t.Errorf("Unsigned transfer should be rejected")
+	}
+	addTestSidechainBlock(t, sc, []*Transaction{transfer(recipient.GetAddress(), 30, 0)}, validators[:2]...)
+	if _, err := sc.AddSidechainBlock([]*Transaction{transfer(recipient.GetAddress(), 1, 0)}, validators[:2]...); err == nil {
+		t.Errorf("Reused nonce should be rejected")
+	}
+	if _, err := sc.AddSidechainBlock([]*Transaction{transfer(recipient.GetAddress(), 69, 1)}, validators[:2]...); err == nil {
+		t.Errorf("Transfer not covering the fee should be rejected")
+	}
+	anchorTx, _ := NewSidechainAnchorTransaction(user.GetAddress(), 0, SidechainHeader{})
+	anchorTx.SignTransaction(user.PrivateKey)
+	if _, err := sc.AddSidechainBlock([]*Transaction{anchorTx}, validators[:2]...); err == nil {
+		t.Errorf("Main-chain transaction types should be rejected")
+	}
+	if sc.State.BalanceOf(user.GetAddress()).Cmp(big.NewInt(69)) != 0 ||
+		sc.State.BalanceOf(recipient.GetAddress()).Cmp(big.NewInt(30)) != 0 ||
+		sc.State.BalanceOf(operator.GetAddress()).Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("Unexpected sidechain balances")
+	}
+	if sc.BridgedSupply().Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("Fees should stay on the sidechain, supply is %s", sc.BridgedSupply())
+	}
+
+	// Headers commit to the ledger root after their range
+	validHeader := signedHeader(t, sc, 0, 2, validators[:2]...)
+	if validHeader.StateRoot != sc.State.StateRoot() {
+		t.Errorf("Header should carry the ledger root")
+	}
+	anchor(validHeader)
+
+	// A block whose transactions are valid but whose state root credits extra coins
+	honest := transfer(recipient.GetAddress(), 10, 1)
+	registered, _ := sc.registeredAnchor()
+	forged := sc.State.Copy()
+	forged.ApplyTransaction(honest, registered)
+	forged.addBalance(recipient.GetAddress(), big.NewInt(40))
+	appendForgedSidechainBlock(sc, []*Transaction{honest}, forged.StateRoot(), validators[:2]...)
+	badHeader := signedHeader(t, sc, 3, 3, validators[:2]...)
+	anchor(badHeader)
+
+	challenge := func(blockRange string, nonce int) bool {
+		state, _ := CurrentState()
+		evidence, err := sc.BuildFraudProof(state.Sidechains[sc.ID], blockRange, "")
+		if err != nil {
+			t.Fatalf("Error building fraud proof: %v", err)
+		}
+		tx, _ := NewSidechainFraudProofTransaction(user.GetAddress(), nonce, *evidence)
+		tx.ProcessTransactionFee()
+		tx.SignTransaction(user.PrivateKey)
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, operator.GetAddress(), nil))
+	}
+	if challenge(validHeader.BlockRange, 1) {
+		t.Errorf("Challenge of a correct state root should be rejected")
+	}
+	if !challenge(badHeader.BlockRange, 1) {
+		t.Fatalf("Challenge of a forged state root should be accepted")
+	}
+	state, _ := CurrentState()
+	if header, _ := state.Sidechains[sc.ID].HeaderForRange("3-3"); !header.Invalid || header.StateRoot != badHeader.StateRoot {
+		t.Errorf("Range with the forged state root should be marked invalid")
+	}
+	if _, err := ValidateChain(Blockchain); err != nil {
+		t.Errorf("Chain with sidechain state should validate: %v", err)
+	}
+}
+
+func TestSidechainArchive(t *testing.T) {
+	operator := CreateWallet()
+	resetTestChain(t, NewTransaction("0", operator.GetAddress(), big.NewInt(100), 0, "Genesis"))
+	sc := CreateSidechain("archive-test", "Archive Chain")
+	defer delete(SidechainRegistry, sc.ID)
+	validators := registerTestSidechain(t, operator, 0, sc)
+	addTestSidechainBlock(t, sc, signedMicroTransfers(3), validators[:2]...)
+	anchor := func(header SidechainHeader) bool {
+		return AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], nil, operator.GetAddress(), []SidechainHeader{header}))
+	}
+
+	// Proposers hold back an anchor transaction until its batch is archived
+	header, _ := sc.GenerateSidechainHeader(0, 1)
+	header.Sign(validators[0])
+	header.Sign(validators[1])
+	anchorTx, _ := NewSidechainAnchorTransaction(operator.GetAddress(), 1, *header)
+	anchorTx.ProcessTransactionFee()
+	anchorTx.SignTransaction(operator.PrivateKey)
+	PreSubmissionPool = nil
+	defer func() { PreSubmissionPool = nil }()
+	SubmitProposal(operator.GetAddress(), []*Transaction{anchorTx})
+	if len(PreSubmissionPool[0].Transactions) != 0 {
+		t.Errorf("Anchor transaction of an unarchived batch should be held back")
+	}
+	if _, err := ArchiveSidechainBatch(sc, 0, 1); err != nil {
+		t.Fatalf("Archiving failed: %v", err)
+	}
+	if _, err := ArchiveSidechainBatch(sc, 0, 1); err != nil {
+		t.Errorf("Archiving the same range again should be accepted: %v", err)
+	}
+	SubmitProposal(operator.GetAddress(), []*Transaction{anchorTx})
+	if len(PreSubmissionPool[1].Transactions) != 1 {
+		t.Errorf("Anchor transaction of an archived batch should be proposed")
+	}
+	if !anchor(*header) {
+		t.Fatalf("Header of an archived batch should be anchored")
+	}
+
+	// The archive is not consensus: a block built outside the proposal flow can anchor an
+	// unarchived batch, as a header or an anchor transaction, and is still valid
+	addTestSidechainBlock(t, sc, signedMicroTransfers(1), validators[:2]...)
+	unarchived, _ := sc.GenerateSidechainHeader(2, 2)
+	unarchived.Sign(validators[0])
+	unarchived.Sign(validators[1])
+	if !anchor(*unarchived) {
+		t.Errorf("Block anchoring an unarchived batch should be accepted")
+	}
+	if _, err := FetchSidechainBatch(sc.ID, "2-2"); err == nil {
+		t.Errorf("Range anchored outside the proposal flow should not be archived")
+	}
+
+	// Anyone holding the header can fetch the batch and recompute its roots
+	batch, err := FetchSidechainBatch(sc.ID, "0-1")
+	if err != nil {
+		t.Fatalf("Archived batch should be fetched: %v", err)
+	}
+	if err := batch.Verify(*header); err != nil {
+		t.Errorf("Archived batch should match its header: %v", err)
+	}
+	tampered := *batch
+	tampered.Blocks = append([]SidechainBlock(nil), batch.Blocks...)
+	tampered.Blocks[1].Transactions = tampered.Blocks[1].Transactions[1:]
+	if tampered.Verify(*header) == nil {
+		t.Errorf("Batch missing a transaction should not verify")
+	}
+	if _, err := FetchSidechainBatch(sc.ID, "1-1"); err == nil {
+		t.Errorf("Range that was never archived should not be found")
+	}
+
+	// The archive survives a save and load
+	path := filepath.Join(t.TempDir(), "archive.json")
+	if err := SaveArchive(path); err != nil {
+		t.Fatalf("Saving archive failed: %v", err)
+	}
+	SidechainArchive = make(map[string]map[string]*ArchivedBatch)
+	if err := LoadArchive(path); err != nil {
+		t.Fatalf("Loading archive failed: %v", err)
+	}
+	if loaded, err := FetchSidechainBatch(sc.ID, "0-1"); err != nil || loaded.Verify(*header) != nil {
+		t.Errorf("Loaded batch should match its header: %v", err)
+	}
+	if stats := GetArchiveStats(sc.ID); stats["archived_blocks"] != 2 || stats["archived_transactions"] != 3 {
+		t.Errorf("Unexpected archive stats: %v", stats)
+	}
+
+	// A loaded batch of the wrong length is reported, not indexed past its end
+	loaded, _ := FetchSidechainBatch(sc.ID, "0-1")
+	for _, blocks := range [][]SidechainBlock{loaded.Blocks[:1], append(loaded.Blocks, loaded.Blocks[1])} {
+		SidechainArchive[sc.ID]["0-1"] = &ArchivedBatch{SidechainID: sc.ID, BlockRange: "0-1", Blocks: blocks}
+		if _, err := ArchiveSidechainBatch(sc, 0, 1); err == nil {
+			t.Errorf("Range archived with %d blocks should be reported as different", len(blocks))
+		}
+	}
+
+	// A range whose header was proven invalid can be archived again with corrected blocks
+	appendForgedSidechainBlock(sc, signedMicroTransfers(1), strings.Repeat("f", 64), validators[:2]...)
+	if !anchor(signedHeader(t, sc, 3, 3, validators[:2]...)) {
+		t.Fatalf("Forged header should be anchored")
+	}
+	state, _ := CurrentState()
+	evidence, err := sc.BuildFraudProof(state.Sidechains[sc.ID], "3-3", "")
+	if err != nil {
+		t.Fatalf("Error building fraud proof: %v", err)
+	}
+	sc.Blocks = sc.Blocks[:3]
+	addTestSidechainBlock(t, sc, nil, validators[:2]...)
+	if _, err := ArchiveSidechainBatch(sc, 3, 3); err == nil {
+		t.Errorf("Range with a valid anchor should not be replaced")
+	}
+	fraudTx, _ := NewSidechainFraudProofTransaction(operator.GetAddress(), 1, *evidence)
+	fraudTx.ProcessTransactionFee()
+	fraudTx.SignTransaction(operator.PrivateKey)
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{fraudTx}, operator.GetAddress(), nil)) {
+		t.Fatalf("Fraud proof of the forged state root should be accepted")
+	}
+	if _, err := ArchiveSidechainBatch(sc, 3, 3); err != nil {
+		t.Fatalf("Corrected range should replace the invalidated batch: %v", err)
+	}
+	corrected, _ := sc.GenerateSidechainHeader(3, 3)
+	if err := CheckHeaderArchived(*corrected); err != nil {
+		t.Errorf("Archive should hold the corrected range: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// BridgeChallengePeriod is the number of blocks between a withdrawal claim
+// and the earliest height its funds can be released
+const BridgeChallengePeriod = 10
+
+// BridgeEscrowAddress is the main-chain account holding the coins locked for a sidechain
+func BridgeEscrowAddress(sidechainID string) string {
+	return "Bridge:" + sidechainID
+}
+
+// BridgeDeposit is a main-chain deposit locked in escrow and minted on the sidechain
+type BridgeDeposit struct {
+	ID          string // ID of the deposit transaction
+	SidechainID string
+	Depositor   string
+	Recipient   string // Sidechain account credited by the mint
+	Amount      *big.Int
+	Height      int
+}
+
+// BridgeDepositRequest is the payload of a TxBridgeDeposit transaction
+type BridgeDepositRequest struct {
+	SidechainID string
+	Recipient   string
+}
+
+// BridgeWithdrawal is a sidechain burn claimed on the main chain
+type BridgeWithdrawal struct {
+	ID            string // ID of the sidechain burn transaction
+	SidechainID   string
+	BlockRange    string // Anchored range the burn was proven in
+	Recipient     string
+	Amount        *big.Int
+	ClaimedHeight int
+	ReleaseHeight int // First height the funds can be released, after the challenge period
+	Released      bool
+	Frozen        bool // Set when its range or an earlier one is proven invalid
+}
+
+// BridgeWithdrawalClaim is the payload of a TxBridgeWithdrawal transaction
+type BridgeWithdrawalClaim struct {
+	Burn  *Transaction
+	Proof *MerkleProof
+}
+
+// BridgeRelease is the payload of a TxBridgeRelease transaction
+type BridgeRelease struct {
+	SidechainID  string
+	WithdrawalID string
+}
+
+// Copy returns a deep copy of the withdrawal
+func (w *BridgeWithdrawal) Copy() *BridgeWithdrawal {
+	c := *w
+	c.Amount = new(big.Int).Set(w.Amount)
+	return &c
+}
+
+// NewBridgeDepositTransaction creates a main-chain transaction locking coins for a sidechain account
+func NewBridgeDepositTransaction(sender string, nonce int, sidechainID, recipient string, amount *big.Int) (*Transaction, error) {
+	return newBridgeTransaction(TxBridgeDeposit, sender, BridgeEscrowAddress(sidechainID), amount, nonce,
+		BridgeDepositRequest{SidechainID: sidechainID, Recipient: recipient})
+}
+
+// NewBridgeWithdrawalTransaction creates a main-chain transaction claiming a sidechain burn
+// The proof must hold against a header anchored on the main chain
+func NewBridgeWithdrawalTransaction(sender string, nonce int, burn *Transaction, proof *MerkleProof) (*Transaction, error) {
+	return newBridgeTransaction(TxBridgeWithdrawal, sender, sender, big.NewInt(0), nonce,
+		BridgeWithdrawalClaim{Burn: burn, Proof: proof})
+}
+
+// NewBridgeReleaseTransaction creates a main-chain transaction releasing a claimed
+// withdrawal once its challenge period has passed
+func NewBridgeReleaseTransaction(sender string, nonce int, sidechainID, withdrawalID string) (*Transaction, error) {
+	return newBridgeTransaction(TxBridgeRelease, sender, sender, big.NewInt(0), nonce,
+		BridgeRelease{SidechainID: sidechainID, WithdrawalID: withdrawalID})
+}
+
+// newBridgeTransaction creates a bridge transaction carrying a JSON payload
+func newBridgeTransaction(txType TxType, sender, recipient string, amount *big.Int, nonce int, payload interface{}) (*Transaction, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      txType,
+		Sender:    sender,
+		Recipient: recipient,
+		Amount:    amount,
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// NewBridgeMintTransaction creates the sidechain transaction minting a main-chain deposit
+// It is issued by the bridge and authorized by the validators signing its block
+func NewBridgeMintTransaction(deposit BridgeDeposit) *Transaction {
+	tx := &Transaction{
+		Type:      TxBridgeMint,
+		Sender:    BridgeEscrowAddress(deposit.SidechainID),
+		Recipient: deposit.Recipient,
+		Amount:    new(big.Int).Set(deposit.Amount),
+		Payload:   deposit.ID,
+	}
+	tx.ID = tx.CalculateHash()
+	return tx
+}
+
+// NewBridgeBurnTransaction creates the sidechain transaction burning coins to withdraw
+// them to a main-chain recipient. The sender must sign it.
+func NewBridgeBurnTransaction(sender, recipient string, amount *big.Int, nonce int) *Transaction {
+	tx := &Transaction{
+		Type:      TxBridgeBurn,
+		Sender:    sender,
+		Recipient: recipient,
+		Amount:    amount,
+		Nonce:     nonce,
+	}
+	tx.ID = tx.CalculateHash()
+	return tx
+}
+
+// applyBridgeDeposit records a deposit; the amount moves to the escrow account as a transfer
+func (s *ChainState) applyBridgeDeposit(tx *Transaction) error {
+	var request BridgeDepositRequest
+	if err := json.Unmarshal([]byte(tx.Payload), &request); err != nil {
+		return fmt.Errorf("invalid bridge deposit payload: %v", err)
+	}
+	anchor, exists := s.Sidechains[request.SidechainID]
+	if !exists {
+		return fmt.Errorf("sidechain %s is not registered", request.SidechainID)
+	}
+	if tx.Recipient != BridgeEscrowAddress(request.SidechainID) {
+		return fmt.Errorf("deposit must be sent to %s", BridgeEscrowAddress(request.SidechainID))
+	}
+	if request.Recipient == "" || tx.Amount == nil || tx.Amount.Sign() <= 0 {
+		return fmt.Errorf("deposit needs a sidechain recipient and a positive amount")
+	}
+
+	anchor.Deposits = append(anchor.Deposits, BridgeDeposit{
+		ID:          tx.ID,
+		SidechainID: request.SidechainID,
+		Depositor:   tx.Sender,
+		Recipient:   request.Recipient,
+		Amount:      new(big.Int).Set(tx.Amount),
+		Height:      s.blockHeight,
+	})
+	return nil
+}
+
+// applyBridgeWithdrawal records a sidechain burn proven against an anchored header
+func (s *ChainState) applyBridgeWithdrawal(tx *Transaction) error {
+	var claim BridgeWithdrawalClaim
+	if err := json.Unmarshal([]byte(tx.Payload), &claim); err != nil {
+		return fmt.Errorf("invalid bridge withdrawal payload: %v", err)
+	}
+	burn, proof := claim.Burn, claim.Proof
+	if burn == nil || proof == nil {
+		return fmt.Errorf("withdrawal needs a burn transaction and its proof")
+	}
+	anchor, exists := s.Sidechains[proof.SidechainID]
+	if !exists {
+		return fmt.Errorf("sidechain %s is not registered", proof.SidechainID)
+	}
+
+	if burn.Type != TxBridgeBurn {
+		return fmt.Errorf("transaction %s is not a bridge burn", burn.ID)
+	}
+	if burn.ID != burn.CalculateHash() || proof.TxID != burn.ID {
+		return fmt.Errorf("proof does not cover burn %s", burn.ID)
+	}
+	if !burn.VerifyTransaction() {
+		return fmt.Errorf("burn %s is not signed by %s", burn.ID, burn.Sender)
+	}
+	if burn.Recipient == "" || burn.Recipient == CoalitionAddress || burn.Amount == nil || burn.Amount.Sign() <= 0 {
+		return fmt.Errorf("burn %s needs a main-chain recipient and a positive amount", burn.ID)
+	}
+	if _, claimed := anchor.Withdrawals[burn.ID]; claimed {
+		return fmt.Errorf("burn %s already claimed", burn.ID)
+	}
+
+	header, anchored := anchor.HeaderForRange(proof.BlockRange)
+	if !anchored {
+		return fmt.Errorf("range %s of %s is not anchored", proof.BlockRange, proof.SidechainID)
+	}
+	if header.Invalid {
+		return fmt.Errorf("range %s of %s is invalid or anchored on an invalid range", proof.BlockRange, proof.SidechainID)
+	}
+	root, err := proof.ComputeRoot(header.TransactionCount)
+	if err != nil {
+		return err
+	}
+	if root != header.MerkleRoot {
+		return fmt.Errorf("proof computes root %s, anchored root is %s", root, header.MerkleRoot)
+	}
+
+	anchor.Withdrawals[burn.ID] = &BridgeWithdrawal{
+		ID:            burn.ID,
+		SidechainID:   proof.SidechainID,
+		BlockRange:    proof.BlockRange,
+		Recipient:     burn.Recipient,
+		Amount:        new(big.Int).Set(burn.Amount),
+		ClaimedHeight: s.blockHeight,
+		ReleaseHeight: s.blockHeight + BridgeChallengePeriod,
+	}
+	return nil
+}
+
+// applyBridgeRelease pays a claimed withdrawal out of escrow after its challenge period
+func (s *ChainState) applyBridgeRelease(tx *Transaction) error {
+	var release BridgeRelease
+	if err := json.Unmarshal([]byte(tx.Payload), &release); err != nil {
+		return fmt.Errorf("invalid bridge release payload: %v", err)
+	}
+	anchor, exists := s.Sidechains[release.SidechainID]
+	if !exists {
+		return fmt.Errorf("sidechain %s is not registered", release.SidechainID)
+	}
+	withdrawal, exists := anchor.Withdrawals[release.WithdrawalID]
+	if !exists {
+		return fmt.Errorf("unknown withdrawal %s", release.WithdrawalID)
+	}
+	if withdrawal.Released {
+		return fmt.Errorf("withdrawal %s already released", withdrawal.ID)
+	}
+	if withdrawal.Frozen {
+		return fmt.Errorf("withdrawal %s is frozen by a fraud proof", withdrawal.ID)
+	}
+	if s.blockHeight < withdrawal.ReleaseHeight {
+		return fmt.Errorf("withdrawal %s is in its challenge period until height %d", withdrawal.ID, withdrawal.ReleaseHeight)
+	}
+	escrow := BridgeEscrowAddress(release.SidechainID)
+	if err := s.debit(escrow, withdrawal.Amount, JournalTransfer, fmt.Sprintf("Bridge release %s", withdrawal.ID)); err != nil {
+		return fmt.Errorf("escrow cannot cover withdrawal: %v", err)
+	}
+
+	withdrawal.Released = true
+	s.credit(withdrawal.Recipient, withdrawal.Amount, JournalTransfer, fmt.Sprintf("Bridge release %s", withdrawal.ID))
+	return nil
+}
+
+// PendingDeposits returns mint transactions for main-chain deposits not yet minted on the sidechain
+func (sc *Sidechain) PendingDeposits() ([]*Transaction, error) {
+	anchor, err := sc.registeredAnchor()
+	if err != nil {
+		return nil, err
+	}
+
+	var mints []*Transaction
+	for _, deposit := range anchor.Deposits {
+		if !sc.State.Minted[deposit.ID] {
+			mints = append(mints, NewBridgeMintTransaction(deposit))
+		}
+	}
+	return mints, nil
+}
+
+// BridgedSupply returns the coins minted on the sidechain from deposits less those burnt
+// Sidechain fees stay on the sidechain, so this is the ledger's total balance
+func (sc *Sidechain) BridgedSupply() *big.Int {
+	return sc.State.Supply()
+}
+
+// GetBridgeStats returns the main chain's view of a sidechain bridge
+func GetBridgeStats(sidechainID string) map[string]interface{} {
+	state, err := CurrentState()
+	if err != nil {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Error building chain state: %v", err),
+		}
+	}
+	anchor, exists := state.Sidechains[sidechainID]
+	if !exists {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Sidechain %s is not registered", sidechainID),
+		}
+	}
+
+	pending, released, frozen := 0, 0, 0
+	for _, withdrawal := range anchor.Withdrawals {
+		if withdrawal.Released {
+			released++
+		} else if withdrawal.Frozen {
+			frozen++
+		} else {
+			pending++
+		}
+	}
+	return map[string]interface{}{
+		"sidechain_id":        sidechainID,
+		"locked":              state.BalanceOf(BridgeEscrowAddress(sidechainID)).String(),
+		"deposits":            len(anchor.Deposits),
+		"pending_withdrawals": pending,
+		"released":            released,
+		"frozen":              frozen,
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SaveChain writes a chain to a JSON file
+func SaveChain(path string, chain []Block) error {
+	data, err := json.MarshalIndent(chain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// LoadChain reads a chain from a JSON file written by SaveChain
+func LoadChain(path string) ([]Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []Block
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("invalid chain file %s: %v", path, err)
+	}
+	return chain, nil
+}
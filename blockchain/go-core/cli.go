@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runCommand dispatches a vuser subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "demo":
+		return runDemoCommand(args)
+	case "verify":
+		return runVerifyCommand(args)
+	case "treasury":
+		return runTreasuryCommand(args)
+	case "archive":
+		return runArchiveCommand(args)
+	default:
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Println("Usage: vuser [command] [flags]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  demo     Run the chain simulation (default when no command is given)")
+	fmt.Println("  verify   Replay a chain file from genesis and report the first invalid block")
+	fmt.Println("  treasury report")
+	fmt.Println("           Export the treasury journal for a height range and reconcile it")
+	fmt.Println("  archive fetch")
+	fmt.Println("           Fetch an archived sidechain batch and check it against its anchored header")
+}
+
+// runDemoCommand runs the simulation, optionally exporting the resulting chain
+func runDemoCommand(args []string) int {
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	exportPath := fs.String("export", "", "write the resulting chain to this file")
+	archivePath := fs.String("archive", "", "write the sidechain archive to this file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	runDemo(*exportPath, *archivePath)
+	return 0
+}
+
+// runVerifyCommand validates a chain file end to end
+func runVerifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	chainPath := fs.String("chain", "vuser-chain.json", "chain file to verify")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	chain, err := LoadChain(*chainPath)
+	if err != nil {
+		fmt.Println("Error loading chain:", err)
+		return 1
+	}
+
+	state, err := ValidateChain(chain)
+	if err != nil {
+		if invalid, ok := err.(*ChainValidationError); ok {
+			fmt.Printf("Chain INVALID at height %d: %s\n", invalid.Height, invalid.Reason)
+		} else {
+			fmt.Println("Chain INVALID:", err)
+		}
+		return 1
+	}
+
+	supply := GetSupplyReport(state)
+	fmt.Printf("Chain valid: %d blocks, tip %s\n", len(chain), state.TipHash)
+	fmt.Printf("Supply: Minted=%s Burnt=%s TreasuryHeld=%s Circulating=%s\n",
+		supply.Minted.String(), supply.Burnt.String(), supply.TreasuryHeld.String(), supply.Circulating.String())
+	return 0
+}
+
+// runTreasuryCommand dispatches treasury subcommands
+func runTreasuryCommand(args []string) int {
+	if len(args) == 0 || args[0] != "report" {
+		printUsage()
+		return 2
+	}
+	return runTreasuryReportCommand(args[1:])
+}
+
+// runTreasuryReportCommand exports the treasury journal of a chain file as CSV or JSON
+// and reconciles it against the coalition account
+func runTreasuryReportCommand(args []string) int {
+	fs := flag.NewFlagSet("treasury report", flag.ContinueOnError)
+	chainPath := fs.String("chain", "vuser-chain.json", "chain file to report on")
+	from := fs.Int("from", 0, "first block height to include")
+	to := fs.Int("to", -1, "last block height to include, -1 for the tip")
+	format := fs.String("format", "csv", "output format: csv or json")
+	outPath := fs.String("out", "", "write the report to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "csv" && *format != "json" {
+		fmt.Println("Unknown format:", *format)
+		return 2
+	}
+
+	chain, err := LoadChain(*chainPath)
+	if err != nil {
+		fmt.Println("Error loading chain:", err)
+		return 1
+	}
+	if *to < 0 || *to >= len(chain) {
+		*to = len(chain) - 1
+	}
+	if *from < 0 || *from > *to {
+		fmt.Printf("Invalid height range %d to %d\n", *from, *to)
+		return 2
+	}
+
+	// Replay up to the end of the range so the journal reconciles against the balance at that height.
+	// The replay validates, so a report is never built from a chain file with forged blocks
+	state, err := ValidateChain(chain[:*to+1])
+	if err != nil {
+		fmt.Println("Error validating chain:", err)
+		return 1
+	}
+	report := BuildTreasuryReport(state, *from, *to)
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Println("Error creating report file:", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	if *format == "json" {
+		err = report.WriteJSON(out)
+	} else {
+		err = report.WriteCSV(out)
+	}
+	if err != nil {
+		fmt.Println("Error writing report:", err)
+		return 1
+	}
+
+	// Keep stdout clean for the report itself
+	summary := os.Stderr
+	fmt.Fprintf(summary, "Treasury journal %d to %d: %d entries, opening %s, closing %s, account %s\n",
+		report.FromHeight, report.ToHeight, len(report.Entries), report.OpeningBalance.String(),
+		report.ClosingBalance.String(), report.AccountBalance.String())
+	if !report.Reconciled {
+		for _, discrepancy := range report.Discrepancies {
+			fmt.Fprintln(summary, "Discrepancy:", discrepancy)
+		}
+		return 1
+	}
+	fmt.Fprintln(summary, "Journal reconciled with the coalition account")
+	return 0
+}
+
+// runArchiveCommand dispatches archive subcommands
+func runArchiveCommand(args []string) int {
+	if len(args) == 0 || args[0] != "fetch" {
+		printUsage()
+		return 2
+	}
+	return runArchiveFetchCommand(args[1:])
+}
+
+// runArchiveFetchCommand writes an archived batch as JSON after checking it
+// against the header the chain anchored for its range
+func runArchiveFetchCommand(args []string) int {
+	fs := flag.NewFlagSet("archive fetch", flag.ContinueOnError)
+	archivePath := fs.String("archive", "vuser-archive.json", "sidechain archive file")
+	chainPath := fs.String("chain", "vuser-chain.json", "chain file with the anchored header")
+	sidechainID := fs.String("sidechain", "", "sidechain ID")
+	blockRange := fs.String("range", "", "anchored block range, e.g. 0-1")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := LoadArchive(*archivePath); err != nil {
+		fmt.Println("Error loading archive:", err)
+		return 1
+	}
+	batch, err := FetchSidechainBatch(*sidechainID, *blockRange)
+	if err != nil {
+		fmt.Println("Error fetching batch:", err)
+		return 1
+	}
+	chain, err := LoadChain(*chainPath)
+	if err != nil {
+		fmt.Println("Error loading chain:", err)
+		return 1
+	}
+	state, err := ValidateChain(chain)
+	if err != nil {
+		fmt.Println("Error validating chain:", err)
+		return 1
+	}
+	anchor, exists := state.Sidechains[*sidechainID]
+	if !exists {
+		fmt.Printf("Sidechain %s is not registered\n", *sidechainID)
+		return 1
+	}
+	anchored, exists := anchor.HeaderForRange(*blockRange)
+	if !exists {
+		fmt.Printf("Range %s of %s is not anchored\n", *blockRange, *sidechainID)
+		return 1
+	}
+
+	// Find the full header in the block that anchored it
+	for _, header := range chain[anchored.AnchorHeight].AnchoredHeaders() {
+		if header.CalculateHash() != anchored.HeaderHash {
+			continue
+		}
+		if err := batch.Verify(header); err != nil {
+			fmt.Println("Batch does not match its anchored header:", err)
+			return 1
+		}
+		data, err := json.MarshalIndent(batch, "", "  ")
+		if err != nil {
+			fmt.Println("Error encoding batch:", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		fmt.Fprintf(os.Stderr, "Range %s of %s matches the header anchored in block %d: %d transactions, merkle root %s\n",
+			batch.BlockRange, batch.SidechainID, anchored.AnchorHeight, header.TransactionCount, header.MerkleRoot)
+		return 0
+	}
+	fmt.Printf("Anchored header %s not found in block %d\n", anchored.HeaderHash, anchored.AnchorHeight)
+	return 1
+}
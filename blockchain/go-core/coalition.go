@@ -1,25 +1,68 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"time"
 )
 
-// CoalitionTreasury manages the coalition's funds for paying publisher fees
+// CoalitionTreasury is the coalition's fund for paying publisher fees
+// It is a view of the CoalitionAddress account, derived purely from applying blocks
 type CoalitionTreasury struct {
-	Balance        *big.Int
-	TotalReceived  *big.Int
-	TotalSpent     *big.Int
-	TransactionLog []TreasuryTransaction
+	Balance       *big.Int
+	TotalReceived *big.Int
+	TotalSpent    *big.Int
+	SponsoredFees map[string]*big.Int            // Publisher address -> total fees sponsored
+	Withdrawals   map[string]*TreasuryWithdrawal // Multisig withdrawals by proposal ID
+
+	journal      *journalBlock // Journal entries, most recent block first
+	ownJournal   *journalBlock // Journal block started by this treasury, the only one it appends to
+	journalCount int
 }
 
-// TreasuryTransaction records treasury activity
+// journalBlock holds the journal entries of one block, linked to the entries of earlier blocks
+// Blocks already applied are never changed, so treasury copies share them instead of the journal
+type journalBlock struct {
+	Height  int
+	Entries []TreasuryTransaction
+	Prev    *journalBlock
+}
+
+// TreasuryTransaction is an entry in the treasury journal
+// Each entry commits to the previous one through PrevHash, making the journal append-only
 type TreasuryTransaction struct {
-	Type      string // "deposit" or "withdrawal"
+	Sequence  int
+	Type      JournalEntryType
 	Amount    *big.Int
+	Change    *big.Int // Signed effect on the treasury balance
+	Balance   *big.Int // Treasury balance after the entry
 	Purpose   string
+	Signers   []string // Governance members that authorized the entry, if any
+	Height    int      // Block that caused the change
+	TxID      string   // Transaction that caused the change, empty for block rewards
 	Timestamp time.Time
+	PrevHash  string
+	Hash      string
+}
+
+// SponsorshipEpochLength is the number of blocks in a sponsorship budget epoch
+const SponsorshipEpochLength = 100
+
+// Reasons a sponsored transaction falls back to sender-paid
+var (
+	errEpochBudgetExceeded = errors.New("epoch sponsorship budget exceeded")
+	errBlockLimitExceeded  = errors.New("sponsored transactions per block exceeded")
+	errFeeLimitExceeded    = errors.New("fee above the sponsored maximum")
+)
+
+// SponsorshipLimits caps how much the coalition sponsors for a publisher
+// Zero values mean no limit
+type SponsorshipLimits struct {
+	EpochBudget   *big.Int // Total fees sponsored per epoch
+	MaxTxPerBlock int      // Sponsored transactions per block
+	MaxFeePerTx   *big.Int // Largest fee sponsored for a single transaction
 }
 
 // ApprovedPublisher represents a publisher approved for coalition sponsorship
@@ -27,93 +70,281 @@ type ApprovedPublisher struct {
 	Address        string
 	Name           string
 	ApprovedAt     time.Time
-	TotalSponsored *big.Int // Total fees sponsored for this publisher
+	ApprovedHeight int // Block that included the governance approval
+	Limits         SponsorshipLimits
+
+	// Sponsorship usage, derived from applied blocks
+	Epoch               int      // Epoch that EpochSpent refers to
+	EpochSpent          *big.Int // Fees sponsored in Epoch
+	BlockHeight         int      // Block that BlockSponsored refers to
+	BlockSponsored      int      // Transactions sponsored in BlockHeight
+	BudgetExceededEpoch int      // Last epoch a transaction fell back for lack of budget, -1 if never
+	Fallbacks           int      // Sponsored transactions that fell back to sender-paid
+}
+
+// PublisherApproval is the payload of publisher approval and removal transactions
+type PublisherApproval struct {
+	Address string
+	Name    string
+	Limits  SponsorshipLimits
+}
+
+// Copy returns a deep copy of the publisher
+func (p *ApprovedPublisher) Copy() *ApprovedPublisher {
+	c := *p
+	c.EpochSpent = new(big.Int).Set(p.EpochSpent)
+	return &c
+}
+
+// SponsorshipEpoch returns the budget epoch of a block height
+func SponsorshipEpoch(height int) int {
+	return height / SponsorshipEpochLength
+}
+
+// epochSpentAt returns the fees sponsored in the epoch of a height
+func (p *ApprovedPublisher) epochSpentAt(height int) *big.Int {
+	if p.Epoch != SponsorshipEpoch(height) {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(p.EpochSpent)
+}
+
+// checkSponsorshipLimits returns why a fee cannot be sponsored at a height, or nil
+func (p *ApprovedPublisher) checkSponsorshipLimits(fee *big.Int, height int) error {
+	if fee == nil {
+		fee = big.NewInt(0)
+	}
+	if p.Limits.MaxFeePerTx != nil && p.Limits.MaxFeePerTx.Sign() > 0 && fee.Cmp(p.Limits.MaxFeePerTx) > 0 {
+		return errFeeLimitExceeded
+	}
+	if p.Limits.MaxTxPerBlock > 0 && p.BlockHeight == height && p.BlockSponsored >= p.Limits.MaxTxPerBlock {
+		return errBlockLimitExceeded
+	}
+	if p.Limits.EpochBudget != nil && p.Limits.EpochBudget.Sign() > 0 {
+		spent := p.epochSpentAt(height)
+		if spent.Add(spent, fee).Cmp(p.Limits.EpochBudget) > 0 {
+			return errEpochBudgetExceeded
+		}
+	}
+	return nil
+}
+
+// recordSponsorship counts a sponsored fee against the publisher's limits
+func (p *ApprovedPublisher) recordSponsorship(fee *big.Int, height int) {
+	p.EpochSpent = p.epochSpentAt(height)
+	if fee != nil {
+		p.EpochSpent.Add(p.EpochSpent, fee)
+	}
+	p.Epoch = SponsorshipEpoch(height)
+
+	if p.BlockHeight != height {
+		p.BlockHeight = height
+		p.BlockSponsored = 0
+	}
+	p.BlockSponsored++
+}
+
+// recordFallback counts a sponsored transaction that fell back to sender-paid
+func (p *ApprovedPublisher) recordFallback(reason error, height int) {
+	p.Fallbacks++
+	if reason == errEpochBudgetExceeded {
+		p.BudgetExceededEpoch = SponsorshipEpoch(height)
+	}
+}
+
+// IsOverBudget reports whether the publisher's epoch budget is used up at a height
+func (p *ApprovedPublisher) IsOverBudget(height int) bool {
+	if p.BudgetExceededEpoch == SponsorshipEpoch(height) {
+		return true
+	}
+	budget := p.Limits.EpochBudget
+	return budget != nil && budget.Sign() > 0 && p.epochSpentAt(height).Cmp(budget) >= 0
+}
+
+// NewCoalitionTreasury creates an empty treasury
+func NewCoalitionTreasury() *CoalitionTreasury {
+	return &CoalitionTreasury{
+		Balance:       big.NewInt(0),
+		TotalReceived: big.NewInt(0),
+		TotalSpent:    big.NewInt(0),
+		SponsoredFees: make(map[string]*big.Int),
+		Withdrawals:   make(map[string]*TreasuryWithdrawal),
+	}
+}
+
+// Copy returns a deep copy of the treasury
+func (t *CoalitionTreasury) Copy() *CoalitionTreasury {
+	c := &CoalitionTreasury{
+		Balance:       new(big.Int).Set(t.Balance),
+		TotalReceived: new(big.Int).Set(t.TotalReceived),
+		TotalSpent:    new(big.Int).Set(t.TotalSpent),
+		SponsoredFees: make(map[string]*big.Int, len(t.SponsoredFees)),
+		Withdrawals:   make(map[string]*TreasuryWithdrawal, len(t.Withdrawals)),
+		journal:       t.journal,
+		journalCount:  t.journalCount,
+	}
+	for publisher, total := range t.SponsoredFees {
+		c.SponsoredFees[publisher] = new(big.Int).Set(total)
+	}
+	for id, withdrawal := range t.Withdrawals {
+		c.Withdrawals[id] = withdrawal.Copy()
+	}
+	return c
 }
 
-// Global coalition treasury instance
-var Treasury *CoalitionTreasury
+// record appends an entry to the treasury journal, chaining it to the previous entry
+// Entries go into a block this treasury started itself, never one it shares with a copy
+func (t *CoalitionTreasury) record(entry TreasuryTransaction) {
+	entry.Sequence = t.journalCount
+	if entry.Change == nil {
+		entry.Change = big.NewInt(0)
+	}
+	entry.Balance = new(big.Int).Set(t.Balance)
+	if last, exists := t.LastEntry(); exists {
+		entry.PrevHash = last.Hash
+	}
+	entry.Hash = entry.CalculateHash()
 
-// Global registry of approved publishers
-var ApprovedPublishers = make(map[string]*ApprovedPublisher)
+	if t.journal == nil || t.journal != t.ownJournal || t.journal.Height != entry.Height {
+		t.journal = &journalBlock{Height: entry.Height, Prev: t.journal}
+		t.ownJournal = t.journal
+	}
+	t.journal.Entries = append(t.journal.Entries, entry)
+	t.journalCount++
+}
 
-// InitializeCoalitionTreasury creates and initializes the coalition treasury
-func InitializeCoalitionTreasury(initialBalance *big.Int) {
-	Treasury = &CoalitionTreasury{
-		Balance:        new(big.Int).Set(initialBalance),
-		TotalReceived:  new(big.Int).Set(initialBalance),
-		TotalSpent:     big.NewInt(0),
-		TransactionLog: []TreasuryTransaction{},
+// TransactionLog returns the treasury journal, oldest entry first
+func (t *CoalitionTreasury) TransactionLog() []TreasuryTransaction {
+	log := make([]TreasuryTransaction, t.journalCount)
+	end := len(log)
+	for block := t.journal; block != nil; block = block.Prev {
+		end -= len(block.Entries)
+		copy(log[end:], block.Entries)
 	}
+	return log
+}
+
+// LastEntry returns the most recent journal entry
+func (t *CoalitionTreasury) LastEntry() (TreasuryTransaction, bool) {
+	if t.journal == nil {
+		return TreasuryTransaction{}, false
+	}
+	return t.journal.Entries[len(t.journal.Entries)-1], true
+}
+
+// deposit records funds received by the treasury
+func (t *CoalitionTreasury) deposit(entry TreasuryTransaction) {
+	t.Balance.Add(t.Balance, entry.Amount)
+	t.TotalReceived.Add(t.TotalReceived, entry.Amount)
+	entry.Change = new(big.Int).Set(entry.Amount)
+	t.record(entry)
+}
+
+// withdraw records funds spent by the treasury
+func (t *CoalitionTreasury) withdraw(entry TreasuryTransaction) {
+	t.Balance.Sub(t.Balance, entry.Amount)
+	t.TotalSpent.Add(t.TotalSpent, entry.Amount)
+	entry.Change = new(big.Int).Neg(entry.Amount)
+	t.record(entry)
+}
 
-	// Log initial deposit
-	Treasury.TransactionLog = append(Treasury.TransactionLog, TreasuryTransaction{
-		Type:      "deposit",
-		Amount:    new(big.Int).Set(initialBalance),
-		Purpose:   "Genesis allocation",
-		Timestamp: time.Now(),
-	})
+// NewPublisherApprovalTransaction creates a governance transaction approving a publisher
+// with sponsorship limits. The approval takes effect at the height of the block that includes it.
+// Approving an already approved publisher updates its name and limits.
+func NewPublisherApprovalTransaction(nonce int, address, name string, limits SponsorshipLimits) (*Transaction, error) {
+	return newGovernanceTransaction(TxPublisherApproval, nonce, PublisherApproval{Address: address, Name: name, Limits: limits})
+}
 
-	fmt.Printf("Coalition Treasury initialized with balance: %s\n", initialBalance.String())
+// NewPublisherRemovalTransaction creates a governance transaction removing a publisher's approval
+func NewPublisherRemovalTransaction(nonce int, address string) (*Transaction, error) {
+	return newGovernanceTransaction(TxPublisherRemoval, nonce, PublisherApproval{Address: address})
 }
 
-// AddApprovedPublisher adds a publisher to the approved list
-func AddApprovedPublisher(address, name string) {
-	publisher := &ApprovedPublisher{
-		Address:        address,
-		Name:           name,
-		ApprovedAt:     time.Now(),
-		TotalSponsored: big.NewInt(0),
+// applyPublisherApproval adds a publisher to the approved list
+func (s *ChainState) applyPublisherApproval(tx *Transaction) error {
+	var approval PublisherApproval
+	if err := json.Unmarshal([]byte(tx.Payload), &approval); err != nil {
+		return fmt.Errorf("invalid publisher approval payload: %v", err)
+	}
+	if approval.Address == "" {
+		return fmt.Errorf("publisher approval without an address")
+	}
+	limits := approval.Limits
+	if (limits.EpochBudget != nil && limits.EpochBudget.Sign() < 0) ||
+		(limits.MaxFeePerTx != nil && limits.MaxFeePerTx.Sign() < 0) || limits.MaxTxPerBlock < 0 {
+		return fmt.Errorf("negative sponsorship limit")
+	}
+
+	// Re-approval keeps the usage counters of the current epoch
+	if existing, exists := s.Publishers[approval.Address]; exists {
+		existing.Name = approval.Name
+		existing.Limits = limits
+		return nil
 	}
-	ApprovedPublishers[address] = publisher
-	fmt.Printf("Publisher approved: %s (%s)\n", name, address)
+
+	s.Publishers[approval.Address] = &ApprovedPublisher{
+		Address:             approval.Address,
+		Name:                approval.Name,
+		ApprovedAt:          s.blockTime,
+		ApprovedHeight:      s.blockHeight,
+		Limits:              limits,
+		EpochSpent:          big.NewInt(0),
+		BudgetExceededEpoch: -1,
+	}
+	return nil
 }
 
-// RemoveApprovedPublisher removes a publisher from the approved list
-func RemoveApprovedPublisher(address string) {
-	if publisher, exists := ApprovedPublishers[address]; exists {
-		delete(ApprovedPublishers, address)
-		fmt.Printf("Publisher removed from approval: %s (%s)\n", publisher.Name, address)
+// applyPublisherRemoval removes a publisher from the approved list
+func (s *ChainState) applyPublisherRemoval(tx *Transaction) error {
+	var removal PublisherApproval
+	if err := json.Unmarshal([]byte(tx.Payload), &removal); err != nil {
+		return fmt.Errorf("invalid publisher removal payload: %v", err)
+	}
+	if _, exists := s.Publishers[removal.Address]; !exists {
+		return fmt.Errorf("publisher %s is not approved", removal.Address)
 	}
+	delete(s.Publishers, removal.Address)
+	return nil
+}
+
+// IsPublisherApproved checks if a publisher is approved for coalition sponsorship in this state
+func (s *ChainState) IsPublisherApproved(address string) bool {
+	_, exists := s.Publishers[address]
+	return exists
 }
 
 // IsPublisherApproved checks if a publisher is approved for coalition sponsorship
 func IsPublisherApproved(address string) bool {
-	_, exists := ApprovedPublishers[address]
+	_, exists := GetApprovedPublisher(address)
 	return exists
 }
 
 // GetApprovedPublisher retrieves an approved publisher by address
 func GetApprovedPublisher(address string) (*ApprovedPublisher, bool) {
-	publisher, exists := ApprovedPublishers[address]
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return nil, false
+	}
+	publisher, exists := state.Publishers[address]
 	return publisher, exists
 }
 
-// DepositToTreasury adds funds to the coalition treasury (from block rewards)
-func DepositToTreasury(amount *big.Int, purpose string) {
-	if Treasury == nil {
-		fmt.Println("Error: Treasury not initialized")
-		return
+// currentTreasury returns the treasury at the tip of the global Blockchain
+func currentTreasury() *CoalitionTreasury {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return nil
 	}
-
-	Treasury.Balance.Add(Treasury.Balance, amount)
-	Treasury.TotalReceived.Add(Treasury.TotalReceived, amount)
-
-	Treasury.TransactionLog = append(Treasury.TransactionLog, TreasuryTransaction{
-		Type:      "deposit",
-		Amount:    new(big.Int).Set(amount),
-		Purpose:   purpose,
-		Timestamp: time.Now(),
-	})
-
-	fmt.Printf("Treasury deposit: %s (%s). New balance: %s\n",
-		amount.String(), purpose, Treasury.Balance.String())
+	return state.Treasury
 }
 
-// SponsorTransactionFee pays a transaction fee on behalf of an approved publisher
-// Returns true if successful, false if insufficient funds or publisher not approved
-func SponsorTransactionFee(publisherAddress string, feeAmount *big.Int) bool {
-	if Treasury == nil {
-		fmt.Println("Error: Treasury not initialized")
+// CanSponsorTransactionFee checks whether the treasury can pay a fee on behalf of an
+// approved publisher. The fee is withdrawn when the transaction's block is applied.
+func CanSponsorTransactionFee(publisherAddress string, feeAmount *big.Int) bool {
+	treasury := currentTreasury()
+	if treasury == nil {
 		return false
 	}
 
@@ -124,55 +355,53 @@ func SponsorTransactionFee(publisherAddress string, feeAmount *big.Int) bool {
 		return false
 	}
 
+	// Check the publisher's sponsorship limits for the next block
+	if err := publisher.checkSponsorshipLimits(feeAmount, len(Blockchain)); err != nil {
+		fmt.Printf("Sponsorship unavailable for %s: %v\n", publisher.Name, err)
+		return false
+	}
+
 	// Check if treasury has sufficient funds
-	if Treasury.Balance.Cmp(feeAmount) < 0 {
+	if treasury.Balance.Cmp(feeAmount) < 0 {
 		fmt.Printf("Insufficient treasury funds. Required: %s, Available: %s\n",
-			feeAmount.String(), Treasury.Balance.String())
+			feeAmount.String(), treasury.Balance.String())
 		return false
 	}
 
-	// Deduct from treasury
-	Treasury.Balance.Sub(Treasury.Balance, feeAmount)
-	Treasury.TotalSpent.Add(Treasury.TotalSpent, feeAmount)
-
-	// Update publisher's sponsored amount
-	publisher.TotalSponsored.Add(publisher.TotalSponsored, feeAmount)
-
-	// Log transaction
-	Treasury.TransactionLog = append(Treasury.TransactionLog, TreasuryTransaction{
-		Type:      "withdrawal",
-		Amount:    new(big.Int).Set(feeAmount),
-		Purpose:   fmt.Sprintf("Fee sponsorship for %s", publisher.Name),
-		Timestamp: time.Now(),
-	})
-
-	fmt.Printf("Sponsored fee of %s for publisher %s. New treasury balance: %s\n",
-		feeAmount.String(), publisher.Name, Treasury.Balance.String())
-
 	return true
 }
 
 // GetTreasuryBalance returns the current treasury balance
 func GetTreasuryBalance() *big.Int {
-	if Treasury == nil {
+	treasury := currentTreasury()
+	if treasury == nil {
 		return big.NewInt(0)
 	}
-	return new(big.Int).Set(Treasury.Balance)
+	return new(big.Int).Set(treasury.Balance)
 }
 
 // GetTreasuryStats returns statistics about the treasury
 func GetTreasuryStats() map[string]interface{} {
-	if Treasury == nil {
+	treasury := currentTreasury()
+	if treasury == nil {
 		return map[string]interface{}{
-			"error": "Treasury not initialized",
+			"error": "Treasury not available",
+		}
+	}
+
+	pending := 0
+	for _, withdrawal := range treasury.Withdrawals {
+		if !withdrawal.Executed {
+			pending++
 		}
 	}
 
 	return map[string]interface{}{
-		"balance":           Treasury.Balance.String(),
-		"total_received":    Treasury.TotalReceived.String(),
-		"total_spent":       Treasury.TotalSpent.String(),
-		"transaction_count": len(Treasury.TransactionLog),
+		"balance":             treasury.Balance.String(),
+		"total_received":      treasury.TotalReceived.String(),
+		"total_spent":         treasury.TotalSpent.String(),
+		"transaction_count":   treasury.journalCount,
+		"pending_withdrawals": pending,
 	}
 }
 
@@ -180,28 +409,58 @@ func GetTreasuryStats() map[string]interface{} {
 func GetPublisherStats() []map[string]interface{} {
 	var stats []map[string]interface{}
 
-	for _, publisher := range ApprovedPublishers {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return stats
+	}
+
+	// Usage is reported for the epoch of the next block
+	height := state.Height + 1
+	for _, publisher := range state.Publishers {
+		totalSponsored := big.NewInt(0)
+		if total, exists := state.Treasury.SponsoredFees[publisher.Address]; exists {
+			totalSponsored = total
+		}
 		stats = append(stats, map[string]interface{}{
-			"address":         publisher.Address,
-			"name":            publisher.Name,
-			"approved_at":     publisher.ApprovedAt,
-			"total_sponsored": publisher.TotalSponsored.String(),
+			"address":          publisher.Address,
+			"name":             publisher.Name,
+			"approved_at":      publisher.ApprovedAt,
+			"approved_height":  publisher.ApprovedHeight,
+			"total_sponsored":  totalSponsored.String(),
+			"epoch":            SponsorshipEpoch(height),
+			"epoch_spent":      publisher.epochSpentAt(height).String(),
+			"epoch_budget":     limitString(publisher.Limits.EpochBudget),
+			"max_tx_per_block": publisher.Limits.MaxTxPerBlock,
+			"max_fee_per_tx":   limitString(publisher.Limits.MaxFeePerTx),
+			"over_budget":      publisher.IsOverBudget(height),
+			"fallbacks":        publisher.Fallbacks,
 		})
 	}
 
 	return stats
 }
 
+// limitString formats an optional limit, "0" meaning unlimited
+func limitString(limit *big.Int) string {
+	if limit == nil {
+		return "0"
+	}
+	return limit.String()
+}
+
 // GetRecentTreasuryActivity returns the last N treasury transactions
 func GetRecentTreasuryActivity(limit int) []TreasuryTransaction {
-	if Treasury == nil || len(Treasury.TransactionLog) == 0 {
+	treasury := currentTreasury()
+	if treasury == nil || treasury.journalCount == 0 {
 		return []TreasuryTransaction{}
 	}
 
-	start := len(Treasury.TransactionLog) - limit
+	log := treasury.TransactionLog()
+	start := len(log) - limit
 	if start < 0 {
 		start = 0
 	}
 
-	return Treasury.TransactionLog[start:]
+	return log[start:]
 }
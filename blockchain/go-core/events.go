@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+
+// Event names, matching the events emitted by VuserApprovalRegistry.sol
+const (
+	EventApprovalGranted = "ApprovalGranted"
+	EventApprovalRevoked = "ApprovalRevoked"
+)
+
+// EventSidechainFraudProven is emitted when a fraud proof invalidates an anchored sidechain range
+const EventSidechainFraudProven = "SidechainFraudProven"
+
+// Event is an entry in a block's event log
+type Event struct {
+	Name       string
+	Height     int    // Block that emitted the event
+	TxID       string // Transaction that emitted the event
+	Attributes map[string]string
+}
+
+// eventBlock holds the events one block emitted, linked to the events of earlier blocks
+// Blocks already applied are never changed, so state copies share them instead of the whole log
+type eventBlock struct {
+	Height int
+	Events []Event
+	Prev   *eventBlock
+}
+
+// EventHandler is called for each event a subscriber watches
+type EventHandler func(Event)
+
+// Subscribers by event name; handlers under "" receive every event
+var eventSubscribers = make(map[string][]EventHandler)
+
+// SubscribeEvents registers a handler called for events with the given name once their
+// block is added to the chain. An empty name subscribes to all events.
+func SubscribeEvents(name string, handler EventHandler) {
+	eventSubscribers[name] = append(eventSubscribers[name], handler)
+}
+
+// publishEvents delivers events to their subscribers
+func publishEvents(events []Event) {
+	for _, event := range events {
+		for _, handler := range eventSubscribers[event.Name] {
+			handler(event)
+		}
+		for _, handler := range eventSubscribers[""] {
+			handler(event)
+		}
+	}
+}
+
+// emit appends an event to the log of the block being applied
+// Events go into a block this state started itself, never one it shares with a copy
+func (s *ChainState) emit(name, txID string, attributes map[string]string) {
+	if s.EventLog == nil || s.EventLog != s.ownEvents || s.EventLog.Height != s.blockHeight {
+		s.EventLog = &eventBlock{Height: s.blockHeight, Prev: s.EventLog}
+		s.ownEvents = s.EventLog
+	}
+	s.EventLog.Events = append(s.EventLog.Events, Event{Name: name, Height: s.blockHeight, TxID: txID, Attributes: attributes})
+}
+
+// EventsAt returns the event log of the block at a height
+func (s *ChainState) EventsAt(height int) []Event {
+	var events []Event
+	for block := s.EventLog; block != nil && block.Height >= height; block = block.Prev {
+		if block.Height == height {
+			events = append(append([]Event(nil), block.Events...), events...)
+		}
+	}
+	return events
+}
+
+// GetBlockEvents returns the event log of a block in the current chain
+func GetBlockEvents(height int) []Event {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return nil
+	}
+	return state.EventsAt(height)
+}
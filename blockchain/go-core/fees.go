@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// FeeSchedule defines the fee charged for a transaction
+// Fee = (BaseFee + ByteFee * (payload bytes / ByteUnit)) * multiplier / 100
+// Anything a transaction pays above this fee is a tip for the miner
+type FeeSchedule struct {
+	BaseFee         *big.Int
+	ByteFee         *big.Int         // Charged per full ByteUnit of payload
+	ByteUnit        int              // Payload bytes covered by one ByteFee
+	TypeMultipliers map[TxType]int64 // Percent per transaction type, 100 = 1x (default)
+	Dynamic         *DynamicBaseFee  // Optional EIP-1559 style base fee, nil keeps BaseFee fixed
+}
+
+// DynamicBaseFee configures a base fee that follows block fullness
+// Blocks fuller than the target raise the base fee, emptier blocks lower it
+type DynamicBaseFee struct {
+	TargetTransactions int      // Transactions per block at which the base fee is unchanged
+	ChangeDenominator  int64    // Maximum change per block is 1/ChangeDenominator (8 = 12.5%)
+	MinBaseFee         *big.Int // Floor for the base fee
+}
+
+// FeeScheduleUpdate is the payload of a TxFeeScheduleUpdate governance transaction
+type FeeScheduleUpdate struct {
+	ActivationHeight int // First block height the schedule applies to
+	Schedule         FeeSchedule
+}
+
+// ScheduledFee is a fee schedule together with the height it takes effect
+type ScheduledFee struct {
+	ActivationHeight int
+	Schedule         FeeSchedule
+}
+
+// DefaultFeeSchedule returns the genesis fee schedule
+// 1 coin base fee plus 1 coin per 100 bytes of payload
+func DefaultFeeSchedule() FeeSchedule {
+	return FeeSchedule{
+		BaseFee:         big.NewInt(1),
+		ByteFee:         big.NewInt(1),
+		ByteUnit:        100,
+		TypeMultipliers: map[TxType]int64{},
+	}
+}
+
+// Copy returns a deep copy of the fee schedule
+func (fs FeeSchedule) Copy() FeeSchedule {
+	c := FeeSchedule{
+		BaseFee:         new(big.Int).Set(fs.BaseFee),
+		ByteFee:         new(big.Int).Set(fs.ByteFee),
+		ByteUnit:        fs.ByteUnit,
+		TypeMultipliers: make(map[TxType]int64, len(fs.TypeMultipliers)),
+	}
+	for txType, multiplier := range fs.TypeMultipliers {
+		c.TypeMultipliers[txType] = multiplier
+	}
+	if fs.Dynamic != nil {
+		c.Dynamic = &DynamicBaseFee{
+			TargetTransactions: fs.Dynamic.TargetTransactions,
+			ChangeDenominator:  fs.Dynamic.ChangeDenominator,
+			MinBaseFee:         new(big.Int).Set(fs.Dynamic.MinBaseFee),
+		}
+	}
+	return c
+}
+
+// Validate checks that the fee schedule is well formed
+func (fs FeeSchedule) Validate() error {
+	if fs.BaseFee == nil || fs.BaseFee.Sign() < 0 {
+		return fmt.Errorf("base fee must be non-negative")
+	}
+	if fs.ByteFee == nil || fs.ByteFee.Sign() < 0 {
+		return fmt.Errorf("byte fee must be non-negative")
+	}
+	if fs.ByteUnit <= 0 {
+		return fmt.Errorf("byte unit must be positive")
+	}
+	for txType, multiplier := range fs.TypeMultipliers {
+		if multiplier < 0 {
+			return fmt.Errorf("negative multiplier for transaction type %q", txType)
+		}
+	}
+	if fs.Dynamic != nil {
+		if fs.Dynamic.TargetTransactions <= 0 {
+			return fmt.Errorf("dynamic base fee target must be positive")
+		}
+		if fs.Dynamic.ChangeDenominator <= 0 {
+			return fmt.Errorf("dynamic base fee change denominator must be positive")
+		}
+		if fs.Dynamic.MinBaseFee == nil || fs.Dynamic.MinBaseFee.Sign() <= 0 {
+			return fmt.Errorf("dynamic base fee floor must be positive")
+		}
+	}
+	return nil
+}
+
+// FeeFor returns the fee the schedule charges for a transaction
+func (fs FeeSchedule) FeeFor(tx *Transaction) *big.Int {
+	units := big.NewInt(int64(len(tx.Payload) / fs.ByteUnit))
+	fee := new(big.Int).Mul(fs.ByteFee, units)
+	fee.Add(fee, fs.BaseFee)
+
+	if multiplier, exists := fs.TypeMultipliers[tx.Type]; exists {
+		fee.Mul(fee, big.NewInt(multiplier))
+		fee.Div(fee, big.NewInt(100))
+	}
+	return fee
+}
+
+// FeeScheduleAt returns the fee schedule active at a block height
+func (s *ChainState) FeeScheduleAt(height int) FeeSchedule {
+	active := DefaultFeeSchedule()
+	for _, scheduled := range s.FeeSchedules {
+		if scheduled.ActivationHeight > height {
+			break
+		}
+		active = scheduled.Schedule
+	}
+	return active
+}
+
+// NextFeeSchedule returns the fee schedule for the block after the current height
+// with the dynamic base fee substituted when it is enabled
+func (s *ChainState) NextFeeSchedule() FeeSchedule {
+	schedule := s.FeeScheduleAt(s.Height + 1)
+	if schedule.Dynamic != nil && s.DynamicBaseFee != nil {
+		schedule = schedule.Copy()
+		schedule.BaseFee = new(big.Int).Set(s.DynamicBaseFee)
+	}
+	return schedule
+}
+
+// updateDynamicBaseFee moves the base fee for the next block towards the
+// target fullness, using the number of transactions in the block just applied
+func (s *ChainState) updateDynamicBaseFee(block Block) {
+	next := s.FeeScheduleAt(block.Index + 1)
+	if next.Dynamic == nil {
+		s.DynamicBaseFee = nil
+		return
+	}
+
+	// The dynamic fee starts from the static base fee when first enabled
+	if s.DynamicBaseFee == nil {
+		s.DynamicBaseFee = new(big.Int).Set(next.BaseFee)
+	} else {
+		target := int64(next.Dynamic.TargetTransactions)
+		used := int64(len(block.Transactions))
+
+		// delta = baseFee * (used - target) / target / denominator
+		delta := new(big.Int).Mul(s.DynamicBaseFee, big.NewInt(used-target))
+		delta.Quo(delta, big.NewInt(target*next.Dynamic.ChangeDenominator))
+		if used > target && delta.Sign() == 0 {
+			delta.SetInt64(1) // Always rise on a congested block
+		}
+		s.DynamicBaseFee.Add(s.DynamicBaseFee, delta)
+	}
+
+	if s.DynamicBaseFee.Cmp(next.Dynamic.MinBaseFee) < 0 {
+		s.DynamicBaseFee.Set(next.Dynamic.MinBaseFee)
+	}
+}
+
+// ActiveFeeSchedule returns the fee schedule for the next block of the global Blockchain
+func ActiveFeeSchedule() FeeSchedule {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return DefaultFeeSchedule()
+	}
+	return state.NextFeeSchedule()
+}
+
+// NewFeeScheduleUpdateTransaction creates a governance transaction scheduling a new fee schedule
+// Governance members authorize it with AddCoSignature
+func NewFeeScheduleUpdateTransaction(nonce int, update FeeScheduleUpdate) (*Transaction, error) {
+	return newGovernanceTransaction(TxFeeScheduleUpdate, nonce, update)
+}
+
+// applyFeeScheduleUpdate schedules a fee schedule change voted in by governance
+// The change must take effect at a height after the block that includes it
+func (s *ChainState) applyFeeScheduleUpdate(tx *Transaction, height int) error {
+	var update FeeScheduleUpdate
+	if err := json.Unmarshal([]byte(tx.Payload), &update); err != nil {
+		return fmt.Errorf("invalid fee schedule update payload: %v", err)
+	}
+	if update.ActivationHeight <= height {
+		return fmt.Errorf("fee schedule activation height %d is not after block %d", update.ActivationHeight, height)
+	}
+	if update.Schedule.TypeMultipliers == nil {
+		update.Schedule.TypeMultipliers = map[TxType]int64{}
+	}
+	if err := update.Schedule.Validate(); err != nil {
+		return fmt.Errorf("invalid fee schedule: %v", err)
+	}
+
+	// Keep the list ordered by activation height; a later vote for the same
+	// height replaces the earlier one
+	scheduled := ScheduledFee{ActivationHeight: update.ActivationHeight, Schedule: update.Schedule}
+	for i, existing := range s.FeeSchedules {
+		if existing.ActivationHeight == update.ActivationHeight {
+			s.FeeSchedules[i] = scheduled
+			return nil
+		}
+		if existing.ActivationHeight > update.ActivationHeight {
+			s.FeeSchedules = append(s.FeeSchedules[:i], append([]ScheduledFee{scheduled}, s.FeeSchedules[i:]...)...)
+			return nil
+		}
+	}
+	s.FeeSchedules = append(s.FeeSchedules, scheduled)
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// FraudProof shows that an anchored sidechain range is invalid by replaying a single step
+// of it. Each header commits to the ledger root after every transaction in its range, so
+// a step is one transaction, the roots before and after it, and proofs of the ledger values
+// it reads. Its size grows with neither the range nor the sidechain's history.
+// A step proves fraud if its transaction is invalid or the root after it is wrong. With no
+// transaction given, it proves the range's state root differs from the last root of its trace.
+type FraudProof struct {
+	SidechainID string
+	BlockRange  string          // Challenged anchored range
+	TxIndex     int             // Replayed transaction in the range, -1 to challenge the state root
+	Transaction *Transaction    // Replayed transaction
+	TxSiblings  []string        // Inclusion proof of the transaction against the header's merkle root
+	PreRoot     *TraceStep      // Ledger root before the transaction, nil for the first in the range
+	PostRoot    *TraceStep      // Ledger root after the transaction, or after the last for a state challenge
+	PreState    []StateKeyProof // Ledger values the transaction reads, against the root before it
+}
+
+// TraceStep proves the ledger root after one transaction of a range against the header's trace root
+type TraceStep struct {
+	Index    int
+	Root     string
+	Siblings []string
+}
+
+// traceStep builds the proof of the root after the transaction at index
+func traceStep(trace []string, index int) *TraceStep {
+	leaves := make([][]byte, len(trace))
+	for i, root := range trace {
+		leaves[i] = transactionLeaf(root)
+	}
+	return &TraceStep{Index: index, Root: trace[index], Siblings: merkleSiblings(leaves, index)}
+}
+
+// verify checks the step against a trace root over count transactions
+func (t *TraceStep) verify(traceRoot string, count int) error {
+	root, err := merkleProofRoot(transactionLeaf(t.Root), t.Index, count, t.Siblings)
+	if err != nil {
+		return err
+	}
+	if root != traceRoot {
+		return fmt.Errorf("root after transaction %d is not in the anchored trace", t.Index)
+	}
+	return nil
+}
+
+// NewSidechainFraudProofTransaction creates a main-chain transaction submitting a fraud proof
+// The challenger signs it and pays its fee
+func NewSidechainFraudProofTransaction(challenger string, nonce int, proof FraudProof) (*Transaction, error) {
+	data, err := json.Marshal(proof)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      TxSidechainFraudProof,
+		Sender:    challenger,
+		Recipient: challenger,
+		Amount:    big.NewInt(0),
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// BuildFraudProof collects the evidence that an anchored range is invalid
+// With a transaction ID it replays that transaction; otherwise it finds the first
+// step the range gets wrong, or challenges the state root if every step is right
+func (sc *Sidechain) BuildFraudProof(anchor *SidechainAnchor, blockRange, txID string) (*FraudProof, error) {
+	challenged := anchor.headerIndex(blockRange)
+	if challenged < 0 {
+		return nil, fmt.Errorf("range %s is not anchored", blockRange)
+	}
+	header := anchor.Headers[challenged]
+	var transactions []*Transaction
+	var trace []string
+	for i := header.StartBlock; i <= header.EndBlock && i < len(sc.Blocks); i++ {
+		transactions = append(transactions, sc.Blocks[i].Transactions...)
+		trace = append(trace, sc.Blocks[i].TxStateRoots...)
+	}
+	if len(transactions) != header.TransactionCount || len(trace) != len(transactions) ||
+		CalculateMerkleRoot(transactions) != header.MerkleRoot || CalculateTraceRoot(trace) != header.TraceRoot {
+		return nil, fmt.Errorf("sidechain blocks %s do not match the anchored header", blockRange)
+	}
+
+	// Rebuild the ledger the range was applied to from the valid ranges before it
+	ledger := NewSidechainState()
+	for _, anchored := range anchor.Headers[:challenged] {
+		if anchored.Invalid {
+			continue
+		}
+		for i := anchored.StartBlock; i <= anchored.EndBlock && i < len(sc.Blocks); i++ {
+			for _, tx := range sc.Blocks[i].Transactions {
+				if err := ledger.ApplyTransaction(tx, anchor); err != nil {
+					return nil, fmt.Errorf("range %d-%d does not replay: %v", anchored.StartBlock, anchored.EndBlock, err)
+				}
+			}
+		}
+	}
+
+	fraud := &FraudProof{SidechainID: sc.ID, BlockRange: blockRange, TxIndex: -1}
+	for i, tx := range transactions {
+		before := ledger.Copy()
+		err := ledger.ApplyTransaction(tx, anchor)
+		wrong := err != nil || ledger.StateRoot() != trace[i]
+		if tx.ID == txID || (txID == "" && wrong) {
+			leaves := make([][]byte, len(transactions))
+			for j, leaf := range transactions {
+				leaves[j] = transactionLeaf(leaf.ID)
+			}
+			fraud.TxIndex = i
+			fraud.Transaction = tx
+			fraud.TxSiblings = merkleSiblings(leaves, i)
+			if i > 0 {
+				fraud.PreRoot = traceStep(trace, i-1)
+			}
+			fraud.PostRoot = traceStep(trace, i)
+			fraud.PreState = before.ProveState(batchStateKeys([]*Transaction{tx}, anchor))
+			return checkFraudProofSize(fraud)
+		}
+		if wrong {
+			return nil, fmt.Errorf("range %s goes wrong at transaction %d, before %s", blockRange, i, txID)
+		}
+	}
+	if txID != "" {
+		return nil, fmt.Errorf("transaction %s is not in range %s", txID, blockRange)
+	}
+	if len(trace) > 0 {
+		fraud.PostRoot = traceStep(trace, len(trace)-1)
+	}
+	return checkFraudProofSize(fraud)
+}
+
+// checkFraudProofSize checks a fraud proof fits in a transaction payload
+func checkFraudProofSize(fraud *FraudProof) (*FraudProof, error) {
+	data, err := json.Marshal(fraud)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxPayloadBytes {
+		return nil, fmt.Errorf("fraud proof is %d bytes, limit is %d", len(data), MaxPayloadBytes)
+	}
+	return fraud, nil
+}
+
+// batchStateKeys returns the ledger keys that applying transactions reads
+func batchStateKeys(transactions []*Transaction, anchor *SidechainAnchor) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, tx := range transactions {
+		switch tx.Type {
+		case TxBridgeMint:
+			add(mintedKey(tx.Payload))
+			add(accountKey(tx.Recipient))
+		case TxTransfer, TxBridgeBurn:
+			add(accountKey(tx.Sender))
+			if tx.Type == TxTransfer {
+				add(accountKey(tx.Recipient))
+			}
+			if anchor.TransactionFee().Sign() > 0 {
+				add(accountKey(anchor.Operator))
+			}
+		}
+	}
+	return keys
+}
+
+// verifyFraudProof checks a fraud proof against the anchored headers and returns
+// the index of the challenged header and the reason it is invalid
+func verifyFraudProof(anchor *SidechainAnchor, fraud *FraudProof) (int, string, error) {
+	challenged := anchor.headerIndex(fraud.BlockRange)
+	if challenged < 0 {
+		return 0, "", fmt.Errorf("range %s is not anchored", fraud.BlockRange)
+	}
+	header := anchor.Headers[challenged]
+	if header.Invalid {
+		return 0, "", fmt.Errorf("range %s is already proven invalid", fraud.BlockRange)
+	}
+	count := header.TransactionCount
+	preRoot := anchor.stateRootBefore(challenged)
+
+	// A state challenge compares the range's state root with the end of its trace
+	if fraud.TxIndex == -1 {
+		final := preRoot
+		if count > 0 {
+			if fraud.PostRoot == nil || fraud.PostRoot.Index != count-1 {
+				return 0, "", fmt.Errorf("state challenge must prove the root after transaction %d", count-1)
+			}
+			if err := fraud.PostRoot.verify(header.TraceRoot, count); err != nil {
+				return 0, "", err
+			}
+			final = fraud.PostRoot.Root
+		}
+		if final == header.StateRoot {
+			return 0, "", fmt.Errorf("state root of range %s matches its trace", fraud.BlockRange)
+		}
+		return challenged, fmt.Sprintf("state root %s, trace ends at %s", header.StateRoot, final), nil
+	}
+
+	if fraud.TxIndex < 0 || fraud.TxIndex >= count {
+		return 0, "", fmt.Errorf("transaction %d is outside the range's %d transactions", fraud.TxIndex, count)
+	}
+	tx := fraud.Transaction
+	if tx == nil {
+		return 0, "", fmt.Errorf("missing replayed transaction")
+	}
+	if root, err := merkleProofRoot(transactionLeaf(tx.ID), fraud.TxIndex, count, fraud.TxSiblings); err != nil || root != header.MerkleRoot {
+		return 0, "", fmt.Errorf("transaction %s is not at position %d of range %s", tx.ID, fraud.TxIndex, fraud.BlockRange)
+	}
+	if fraud.TxIndex > 0 {
+		if fraud.PreRoot == nil || fraud.PreRoot.Index != fraud.TxIndex-1 {
+			return 0, "", fmt.Errorf("missing the root before transaction %d", fraud.TxIndex)
+		}
+		if err := fraud.PreRoot.verify(header.TraceRoot, count); err != nil {
+			return 0, "", err
+		}
+		preRoot = fraud.PreRoot.Root
+	}
+
+	// The pre-state must prove every value the transaction reads against the root before it
+	values := make(map[string]string)
+	proven := make(map[string]bool)
+	for _, proof := range fraud.PreState {
+		values[proof.Key] = proof.Value
+		proven[proof.Key] = true
+	}
+	for _, key := range batchStateKeys([]*Transaction{tx}, anchor) {
+		if !proven[key] {
+			return 0, "", fmt.Errorf("pre-state does not prove %s", key)
+		}
+	}
+	root, err := stateProofRoot(fraud.PreState, func(key string) string { return values[key] })
+	if err != nil {
+		return 0, "", err
+	}
+	if root != preRoot {
+		return 0, "", fmt.Errorf("pre-state proves root %s, root before transaction %d is %s", root, fraud.TxIndex, preRoot)
+	}
+	ledger, err := provenLedger(fraud.PreState)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if reason := ledger.ApplyTransaction(tx, anchor); reason != nil {
+		return challenged, reason.Error(), nil
+	}
+
+	// Every value the transaction changed is proven, so the tree gives the root after it
+	if fraud.PostRoot == nil || fraud.PostRoot.Index != fraud.TxIndex {
+		return 0, "", fmt.Errorf("missing the root after transaction %d", fraud.TxIndex)
+	}
+	if err := fraud.PostRoot.verify(header.TraceRoot, count); err != nil {
+		return 0, "", err
+	}
+	root, err = stateProofRoot(fraud.PreState, ledger.stateValue)
+	if err != nil {
+		return 0, "", err
+	}
+	if root == fraud.PostRoot.Root {
+		return 0, "", fmt.Errorf("transaction %s is valid against the pre-state and the root after it matches", tx.ID)
+	}
+	return challenged, fmt.Sprintf("root after transaction %d is %s, replayed ledger root %s", fraud.TxIndex, fraud.PostRoot.Root, root), nil
+}
+
+// applyFraudProof marks a range proven invalid, along with the ranges anchored on top of it,
+// freezes the withdrawals claimed from them and penalizes the validators that signed its
+// header. Anchoring resumes from the last valid header.
+func (s *ChainState) applyFraudProof(tx *Transaction) error {
+	var fraud FraudProof
+	if err := json.Unmarshal([]byte(tx.Payload), &fraud); err != nil {
+		return fmt.Errorf("invalid fraud proof payload: %v", err)
+	}
+	anchor, exists := s.Sidechains[fraud.SidechainID]
+	if !exists {
+		return fmt.Errorf("sidechain %s is not registered", fraud.SidechainID)
+	}
+	challenged, reason, err := verifyFraudProof(anchor, &fraud)
+	if err != nil {
+		return err
+	}
+
+	// Later ranges build on the invalid ledger, so none of them stands either
+	for i := challenged; i < len(anchor.Headers); i++ {
+		if !anchor.Headers[i].Invalid {
+			anchor.Headers[i].Invalid = true
+			anchor.Headers[i].InvalidHeight = s.blockHeight
+		}
+	}
+	anchor.LastBlock, anchor.LastHeaderHash, anchor.LastAnchorHeight = -1, "", 0
+	for i := challenged - 1; i >= 0; i-- {
+		if previous := anchor.Headers[i]; !previous.Invalid {
+			anchor.LastBlock, anchor.LastHeaderHash, anchor.LastAnchorHeight = previous.EndBlock, previous.HeaderHash, previous.AnchorHeight
+			break
+		}
+	}
+
+	header := &anchor.Headers[challenged]
+	for _, withdrawal := range anchor.Withdrawals {
+		if start, _, err := parseBlockRange(withdrawal.BlockRange); err == nil && start >= header.StartBlock && !withdrawal.Released {
+			withdrawal.Frozen = true
+		}
+	}
+	for _, signer := range header.Signers {
+		if _, penalized := anchor.Penalized[signer]; !penalized {
+			anchor.Penalized[signer] = s.blockHeight
+		}
+	}
+
+	attributes := map[string]string{
+		"sidechainID": anchor.ID,
+		"blockRange":  fraud.BlockRange,
+		"reason":      reason,
+	}
+	if fraud.TxIndex >= 0 {
+		attributes["offendingTx"] = fraud.Transaction.ID
+	}
+	s.emit(EventSidechainFraudProven, tx.ID, attributes)
+	return nil
+}
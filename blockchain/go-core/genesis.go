@@ -13,6 +13,9 @@ const CoinName = "Vuser Open Coin"
 // CoinSymbol is the symbol of the coin
 const CoinSymbol = "VOC"
 
+// TreasuryAddress receives the genesis coin supply
+const TreasuryAddress = "Treasury"
+
 // TotalSupply is the total supply of coins in the genesis block
 // 10^80 coins * 10^18 (decimals) = 10^98 base units
 var TotalSupply *big.Int
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// GovernanceSet is the coalition's M-of-N governance key set
+// Governance transactions need co-signatures from Threshold distinct keys
+type GovernanceSet struct {
+	Keys      []string // Wallet addresses of the coalition governance members
+	Threshold int
+}
+
+// Validate checks that the governance set is well formed
+func (g GovernanceSet) Validate() error {
+	if len(g.Keys) == 0 {
+		return fmt.Errorf("governance set has no keys")
+	}
+	if g.Threshold < 1 || g.Threshold > len(g.Keys) {
+		return fmt.Errorf("threshold %d must be between 1 and %d", g.Threshold, len(g.Keys))
+	}
+	seen := make(map[string]bool)
+	for _, key := range g.Keys {
+		if seen[key] {
+			return fmt.Errorf("duplicate governance key %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// IsMember checks whether an address is one of the governance keys
+func (g GovernanceSet) IsMember(address string) bool {
+	for _, key := range g.Keys {
+		if key == address {
+			return true
+		}
+	}
+	return false
+}
+
+// isGovernanceType reports whether a transaction type requires governance authorization
+func isGovernanceType(txType TxType) bool {
+	switch txType {
+	case TxFeeScheduleUpdate, TxPublisherApproval, TxPublisherRemoval, TxWalletApproval, TxWalletRevocation:
+		return true
+	}
+	return false
+}
+
+// isCoalitionType reports whether a transaction type is sent by the coalition account
+// and authorized by governance co-signatures rather than a sender signature
+func isCoalitionType(txType TxType) bool {
+	switch txType {
+	case TxTreasuryProposal, TxTreasurySignature, TxTreasuryExecution:
+		return true
+	}
+	return isGovernanceType(txType)
+}
+
+// NewGovernanceSetTransaction creates the genesis transaction that installs the governance key set
+func NewGovernanceSetTransaction(nonce int, set GovernanceSet) (*Transaction, error) {
+	return newGovernanceTransaction(TxGovernanceSet, nonce, set)
+}
+
+// newGovernanceTransaction creates a coalition transaction carrying a JSON payload
+// Governance members authorize it with AddCoSignature; the coalition pays its fee
+func newGovernanceTransaction(txType TxType, nonce int, payload interface{}) (*Transaction, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:      txType,
+		Sender:    CoalitionAddress,
+		Recipient: CoalitionAddress,
+		Amount:    big.NewInt(0),
+		Nonce:     nonce,
+		Payload:   string(data),
+	}
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// applyGovernanceSet installs the governance key set from a genesis transaction
+func (s *ChainState) applyGovernanceSet(tx *Transaction) error {
+	var set GovernanceSet
+	if err := json.Unmarshal([]byte(tx.Payload), &set); err != nil {
+		return fmt.Errorf("invalid governance set payload: %v", err)
+	}
+	if err := set.Validate(); err != nil {
+		return err
+	}
+	s.Governance = set
+	return nil
+}
+
+// IsGovernanceAuthorized checks whether a governance transaction is sent by the coalition
+// and carries valid co-signatures from at least Threshold distinct governance keys
+func (s *ChainState) IsGovernanceAuthorized(tx *Transaction) bool {
+	if tx.Sender != CoalitionAddress || len(s.Governance.Keys) == 0 {
+		return false
+	}
+	return len(tx.ValidCoSigners(s.Governance.IsMember)) >= s.Governance.Threshold
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JournalEntryType is the kind of activity a treasury journal entry records
+type JournalEntryType string
+
+const (
+	JournalGenesis             JournalEntryType = "genesis"              // Genesis allocation to the coalition
+	JournalRewardShare         JournalEntryType = "reward_share"         // Coalition share of a block reward
+	JournalMinerReward         JournalEntryType = "miner_reward"         // Miner reward for a block proposed by the coalition
+	JournalTransfer            JournalEntryType = "transfer"             // Transfer into the coalition account
+	JournalFee                 JournalEntryType = "fee"                  // Fee of a coalition transaction
+	JournalSponsorship         JournalEntryType = "sponsorship"          // Fee sponsored for an approved publisher
+	JournalWithdrawalProposal  JournalEntryType = "withdrawal_proposal"  // Multisig withdrawal proposed, no balance change
+	JournalWithdrawalSignature JournalEntryType = "withdrawal_signature" // Multisig withdrawal signed, no balance change
+	JournalWithdrawal          JournalEntryType = "withdrawal"           // Multisig withdrawal executed
+	JournalFundedAction        JournalEntryType = "funded_action"        // VEP2 funded action paid by the treasury
+)
+
+// CalculateHash hashes the entry together with the hash of the previous entry
+func (e TreasuryTransaction) CalculateHash() string {
+	record := fmt.Sprintf("%d|%s|%s|%s|%s|%s|%s|%d|%s|%s",
+		e.Sequence, e.Type, e.Amount.String(), e.Change.String(), e.Balance.String(),
+		e.Purpose, strings.Join(e.Signers, ","), e.Height, e.TxID, e.PrevHash)
+	h := sha256.Sum256([]byte(record))
+	return hex.EncodeToString(h[:])
+}
+
+// VerifyJournal checks the hash chain, sequence numbers and running balance of a journal
+func VerifyJournal(journal []TreasuryTransaction) error {
+	balance := big.NewInt(0)
+	prevHash := ""
+	for i, entry := range journal {
+		if entry.Sequence != i {
+			return fmt.Errorf("entry %d has sequence %d", i, entry.Sequence)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("entry %d does not link to the previous entry", i)
+		}
+		if entry.Hash != entry.CalculateHash() {
+			return fmt.Errorf("entry %d hash mismatch", i)
+		}
+		balance.Add(balance, entry.Change)
+		if entry.Balance.Cmp(balance) != 0 {
+			return fmt.Errorf("entry %d balance %s, running balance is %s", i, entry.Balance.String(), balance.String())
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+// TreasuryReport is the treasury journal for a height range, reconciled
+// against the coalition account
+type TreasuryReport struct {
+	FromHeight     int
+	ToHeight       int
+	OpeningBalance *big.Int // Journal balance before FromHeight
+	ClosingBalance *big.Int // Journal balance after ToHeight
+	AccountBalance *big.Int // Coalition account balance at the state's height
+	Totals         map[JournalEntryType]*big.Int
+	Entries        []TreasuryTransaction
+	Reconciled     bool
+	Discrepancies  []string
+}
+
+// BuildTreasuryReport selects the journal entries between two heights, inclusive, and
+// reconciles the journal against the coalition account of a state at height to
+func BuildTreasuryReport(state *ChainState, from, to int) *TreasuryReport {
+	report := &TreasuryReport{
+		FromHeight:     from,
+		ToHeight:       to,
+		OpeningBalance: big.NewInt(0),
+		ClosingBalance: big.NewInt(0),
+		AccountBalance: state.BalanceOf(CoalitionAddress),
+		Totals:         make(map[JournalEntryType]*big.Int),
+	}
+
+	journal := state.Treasury.TransactionLog()
+	if err := VerifyJournal(journal); err != nil {
+		report.Discrepancies = append(report.Discrepancies, err.Error())
+	}
+	for _, entry := range journal {
+		if entry.Height < from {
+			report.OpeningBalance.Set(entry.Balance)
+		}
+		if entry.Height <= to {
+			report.ClosingBalance.Set(entry.Balance)
+		}
+		if entry.Height < from || entry.Height > to {
+			continue
+		}
+		report.Entries = append(report.Entries, entry)
+		if _, exists := report.Totals[entry.Type]; !exists {
+			report.Totals[entry.Type] = big.NewInt(0)
+		}
+		report.Totals[entry.Type].Add(report.Totals[entry.Type], entry.Change)
+	}
+
+	if state.Height == to && report.ClosingBalance.Cmp(report.AccountBalance) != 0 {
+		report.Discrepancies = append(report.Discrepancies, fmt.Sprintf("journal closing balance %s, coalition account holds %s",
+			report.ClosingBalance.String(), report.AccountBalance.String()))
+	}
+	if state.Treasury.Balance.Cmp(report.AccountBalance) != 0 {
+		report.Discrepancies = append(report.Discrepancies, fmt.Sprintf("treasury view holds %s, coalition account holds %s",
+			state.Treasury.Balance.String(), report.AccountBalance.String()))
+	}
+	report.Reconciled = len(report.Discrepancies) == 0
+	return report
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *TreasuryReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes one row per journal entry
+func (r *TreasuryReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"sequence", "height", "timestamp", "type", "tx_id", "amount", "change", "balance", "purpose", "signers", "prev_hash", "hash"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, entry := range r.Entries {
+		row := []string{
+			strconv.Itoa(entry.Sequence),
+			strconv.Itoa(entry.Height),
+			entry.Timestamp.Format(time.RFC3339),
+			string(entry.Type),
+			entry.TxID,
+			entry.Amount.String(),
+			entry.Change.String(),
+			entry.Balance.String(),
+			entry.Purpose,
+			strings.Join(entry.Signers, ";"),
+			entry.PrevHash,
+			entry.Hash,
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
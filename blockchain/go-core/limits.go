@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Consensus limits on block contents
+const (
+	MaxBlockSize        = 1 << 20   // Serialized block size in bytes
+	MaxBlockTxCount     = 1000      // Transactions per block
+	MaxPayloadBytes     = 16 * 1024 // Payload bytes per transaction
+	MaxSidechainHeaders = 16        // Anchored sidechain headers per block
+)
+
+// BlockSize returns the serialized size of a block in bytes
+func BlockSize(block Block) int {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// transactionSize returns the serialized size of a transaction inside a block
+func transactionSize(tx *Transaction) int {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return 0
+	}
+	return len(data) + 1 // Separator in the transaction list
+}
+
+// CheckBlockLimits verifies that a block stays within the consensus limits
+func CheckBlockLimits(block Block) error {
+	if len(block.Transactions) > MaxBlockTxCount {
+		return fmt.Errorf("block has %d transactions, limit is %d", len(block.Transactions), MaxBlockTxCount)
+	}
+
+	if len(block.SidechainHeaders) > MaxSidechainHeaders {
+		return fmt.Errorf("block has %d sidechain headers, limit is %d", len(block.SidechainHeaders), MaxSidechainHeaders)
+	}
+
+	for _, tx := range block.Transactions {
+		if len(tx.Payload) > MaxPayloadBytes {
+			return fmt.Errorf("transaction %s payload is %d bytes, limit is %d", tx.ID, len(tx.Payload), MaxPayloadBytes)
+		}
+	}
+
+	if size := BlockSize(block); size > MaxBlockSize {
+		return fmt.Errorf("block is %d bytes, limit is %d", size, MaxBlockSize)
+	}
+
+	return nil
+}
+
+// PackTransactions selects transactions in order until a block built from them
+// would exceed the consensus limits. Transactions that can never fit are skipped.
+func PackTransactions(transactions []*Transaction, validator string, sidechainHeaders []SidechainHeader) []*Transaction {
+	// Estimate the block overhead with full-length hashes and a current timestamp
+	template := Block{
+		Index:            1 << 30,
+		Timestamp:        time.Now().String(),
+		Hash:             strings.Repeat("0", 64),
+		PrevHash:         strings.Repeat("0", 64),
+		Validator:        validator,
+		SidechainHeaders: sidechainHeaders,
+	}
+	remaining := MaxBlockSize - BlockSize(template)
+
+	var packed []*Transaction
+	for _, tx := range transactions {
+		if len(packed) >= MaxBlockTxCount {
+			break
+		}
+		if len(tx.Payload) > MaxPayloadBytes {
+			continue
+		}
+		size := transactionSize(tx)
+		if size > remaining {
+			continue
+		}
+		packed = append(packed, tx)
+		remaining -= size
+	}
+	return packed
+}
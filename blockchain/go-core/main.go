@@ -4,25 +4,65 @@ import (
 	"fmt"
 	"math/big"
 	"math/rand"
+	"os"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	runDemo("", "")
+}
+
+// runDemo simulates a few rounds of the chain and optionally exports it to a file
+func runDemo(exportPath, archivePath string) {
 	fmt.Println("Starting Vuser Blockchain Core...")
 
-	// Initialize Coalition Treasury
+	// Coalition Treasury starts with a genesis allocation
 	initialTreasury := big.NewInt(1000000) // Start with some funds
-	InitializeCoalitionTreasury(initialTreasury)
+
+	// Create a list of participants (wallet addresses) with a small genesis allocation each
+	participantAllocation := big.NewInt(1000)
+	wallets := make(map[string]*Wallet)
+	var participants []string
+	for i := 0; i < 5; i++ {
+		wallet := CreateWallet()
+		wallets[wallet.GetAddress()] = wallet
+		participants = append(participants, wallet.GetAddress())
+	}
+
+	// Coalition governance: 2-of-3 members must co-sign governance transactions
+	var members []*Wallet
+	var memberKeys []string
+	for i := 0; i < 3; i++ {
+		member := CreateWallet()
+		members = append(members, member)
+		memberKeys = append(memberKeys, member.GetAddress())
+	}
+	governanceTx, err := NewGovernanceSetTransaction(0, GovernanceSet{Keys: memberKeys, Threshold: 2})
+	if err != nil {
+		fmt.Println("Error creating governance set:", err)
+		return
+	}
 
 	// Initialize Blockchain with Genesis Block
 	t := time.Now()
-	// Genesis Transaction (Coinbase)
-	genesisTx := NewTransaction("0", "Treasury", TotalSupply, 0, "Genesis Coin Supply")
+	// Genesis Transactions (Coinbase): the coalition and participant allocations
+	// come out of the total supply, the rest goes to the Treasury
+	treasuryAllocation := new(big.Int).Sub(TotalSupply, initialTreasury)
+	genesisTxs := []*Transaction{NewTransaction("0", CoalitionAddress, initialTreasury, 0, "Genesis Coalition Allocation")}
+	for i, p := range participants {
+		genesisTxs = append(genesisTxs, NewTransaction("0", p, participantAllocation, i+1, "Genesis Participant Allocation"))
+		treasuryAllocation.Sub(treasuryAllocation, participantAllocation)
+	}
+	genesisTxs = append(genesisTxs, NewTransaction("0", TreasuryAddress, treasuryAllocation, len(genesisTxs), "Genesis Coin Supply"))
+	genesisTxs = append(genesisTxs, governanceTx)
 	// Initialize Genesis Block with empty sidechain headers
 	genesisBlock := Block{
 		Index:            0,
 		Timestamp:        t.String(),
-		Transactions:     []*Transaction{genesisTx},
+		Transactions:     genesisTxs,
 		PrevHash:         "",
 		Validator:        "",
 		Hash:             "",
@@ -32,34 +72,71 @@ func main() {
 	Blockchain = append(Blockchain, genesisBlock)
 
 	fmt.Printf("Genesis Block Created. Total Supply: %s base units (10^80 %s - %s)\n", TotalSupply.String(), CoinName, CoinSymbol)
-
-	// Create a list of participants (addresses)
-	participants := []string{
-		"Address1", "Address2", "Address3", "Address4", "Address5",
+	fmt.Printf("Coalition Treasury initialized with balance: %s\n", GetTreasuryBalance().String())
+
+	// Approve a publisher for demonstration; the approval is included in the first block
+	// and takes effect from that height
+	publisher := participants[0]
+	// Sponsorship is capped at 3 coins per epoch, 1 transaction per block and 5 coins per fee
+	limits := SponsorshipLimits{EpochBudget: big.NewInt(3), MaxTxPerBlock: 1, MaxFeePerTx: big.NewInt(5)}
+	approvalTx, err := NewPublisherApprovalTransaction(0, publisher, "Partner Publisher", limits)
+	if err != nil {
+		fmt.Println("Error creating publisher approval:", err)
+		return
+	}
+	approvalTx.ProcessTransactionFee()
+	for _, member := range members[:2] {
+		if err := approvalTx.AddCoSignature(member); err != nil {
+			fmt.Println("Error co-signing publisher approval:", err)
+			return
+		}
 	}
 
-	// Register an approved publisher for demonstration
-	AddApprovedPublisher("Address1", "Partner Publisher")
+	// participants[2] pays the fees of participants[3]'s transactions
+	paymaster, paymasterUser := participants[2], participants[3]
 
 	// Simulate adding blocks
 	for i := 0; i < 5; i++ {
 		fmt.Printf("\n--- Round %d ---\n", i+1)
 
 		// 1. Pre-Submission Phase
-		PreSubmissionPool = []Proposal{} // Clear pool for new round
+		// Every participant sends a transaction, and every proposal packs all pending transactions
+		var pending []*Transaction
+		if i == 0 {
+			pending = append(pending, approvalTx)
+		}
 		for _, p := range participants {
 			// Create a dummy transaction for the proposal
-			tx := NewTransaction(p, "Treasury", big.NewInt(10), i, fmt.Sprintf("Reward Claim %d", i))
+			tx := NewTransaction(p, TreasuryAddress, big.NewInt(10), i, fmt.Sprintf("Reward Claim %d", i))
 
-			// If it's Address1 (approved publisher), set publisher field
-			if p == "Address1" {
+			// If it's the approved publisher, set publisher field
+			if p == publisher {
 				tx.SetPublisher(p)
 			}
+			// Another participant acts as paymaster for this one
+			if p == paymasterUser {
+				tx.SetFeePayer(paymaster)
+			}
 
 			// Process fee (Coalition pays if sponsored, otherwise sender)
 			tx.ProcessTransactionFee()
 
-			SubmitProposal(p, []*Transaction{tx})
+			if err := tx.SignTransaction(wallets[p].PrivateKey); err != nil {
+				fmt.Println("Error signing transaction:", err)
+				continue
+			}
+			if tx.FeePayer != "" {
+				if err := tx.SignAsFeePayer(wallets[tx.FeePayer]); err != nil {
+					fmt.Println("Error countersigning fee:", err)
+					continue
+				}
+			}
+			pending = append(pending, tx)
+		}
+
+		PreSubmissionPool = []Proposal{} // Clear pool for new round
+		for _, p := range participants {
+			SubmitProposal(p, pending)
 		}
 		fmt.Printf("Pre-Submission Pool size: %d\n", len(PreSubmissionPool))
 
@@ -80,13 +157,14 @@ func main() {
 		// Generate block (no sidechain headers for these blocks)
 		newBlock := GenerateBlock(Blockchain[len(Blockchain)-1], activeMiner.Transactions, activeMiner.MinerAddress, nil)
 
-		if IsBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
-			Blockchain = append(Blockchain, newBlock)
+		if AddBlock(newBlock) {
 			fmt.Printf("Block %d added by %s. Hash: %s\n", newBlock.Index, newBlock.Validator, newBlock.Hash)
 			fmt.Printf("Transactions: %d\n", len(newBlock.Transactions))
 
 			// Distribute rewards (Miner, Coalition, Burn)
-			DistributeBlockReward(newBlock.Validator, newBlock.Transactions)
+			if state, err := CurrentState(); err == nil {
+				DistributeBlockReward(newBlock.Validator, state.LastReward)
+			}
 
 		} else {
 			fmt.Println("Block invalid!")
@@ -106,14 +184,71 @@ func main() {
 	sc := CreateSidechain("sc1", "Micro-Payment Chain")
 	fmt.Printf("Created Sidechain: %s\n", sc.Name)
 
-	// Add some micro-transactions to sidechain
-	tx1 := NewTransaction("UserA", "UserB", big.NewInt(1), 0, "Micro 1")
-	tx2 := NewTransaction("UserB", "UserC", big.NewInt(1), 0, "Micro 2")
-	sc.AddSidechainBlock([]*Transaction{tx1, tx2}, "SidechainValidator")
-	fmt.Printf("Added sidechain block with 2 transactions\n")
+	// The operator registers the sidechain's 2-of-3 federated validators on the main chain
+	var sidechainValidators []*Wallet
+	var validatorKeys []string
+	for i := 0; i < 3; i++ {
+		validator := CreateWallet()
+		sidechainValidators = append(sidechainValidators, validator)
+		validatorKeys = append(validatorKeys, validator.GetAddress())
+	}
+	operator := participants[1]
+	registrationTx, err := NewSidechainRegistrationTransaction(operator, 5, SidechainRegistration{
+		SidechainID: sc.ID,
+		Name:        sc.Name,
+		Validators:  SidechainValidatorSet{Validators: validatorKeys, Threshold: 2},
+	})
+	if err != nil {
+		fmt.Println("Error creating sidechain registration:", err)
+		return
+	}
+	registrationTx.ProcessTransactionFee()
+	if err := registrationTx.SignTransaction(wallets[operator].PrivateKey); err != nil {
+		fmt.Println("Error signing sidechain registration:", err)
+		return
+	}
+	// The operator also bridges coins to its sidechain account to spend there
+	depositTx, err := NewBridgeDepositTransaction(operator, 6, sc.ID, operator, big.NewInt(10))
+	if err != nil {
+		fmt.Println("Error creating bridge deposit:", err)
+		return
+	}
+	depositTx.ProcessTransactionFee()
+	if err := depositTx.SignTransaction(wallets[operator].PrivateKey); err != nil {
+		fmt.Println("Error signing bridge deposit:", err)
+		return
+	}
+	if AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{registrationTx, depositTx}, operator, nil)) {
+		fmt.Printf("Sidechain %s registered with a 2-of-3 validator set, 10 coins bridged\n", sc.ID)
+	}
 
-	// Generate header to anchor to main chain
-	header, _ := sc.GenerateSidechainHeader(0, 1) // Genesis + Block 1
+	// Mint the deposit and add some signed micro-transactions, in a block signed by two validators
+	sidechainTxs, err := sc.PendingDeposits()
+	if err != nil {
+		fmt.Println("Error reading bridge deposits:", err)
+		return
+	}
+	tx1 := NewTransaction(operator, participants[0], big.NewInt(1), 0, "Micro 1")
+	tx2 := NewTransaction(operator, participants[2], big.NewInt(1), 1, "Micro 2")
+	for _, tx := range []*Transaction{tx1, tx2} {
+		tx.SignTransaction(wallets[operator].PrivateKey)
+		sidechainTxs = append(sidechainTxs, tx)
+	}
+	if _, err := sc.AddSidechainBlock(sidechainTxs, sidechainValidators[:2]...); err != nil {
+		fmt.Println("Error adding sidechain block:", err)
+		return
+	}
+	fmt.Printf("Added sidechain block with %d transactions, state root %s\n", len(sidechainTxs), sc.State.StateRoot())
+
+	// The anchoring service builds a header once two blocks are unanchored and
+	// submits it in an anchor transaction paid by the operator
+	service := NewAnchoringService(sc, wallets[operator], sidechainValidators, AnchoringPolicy{BlockInterval: 2, TimeInterval: time.Hour})
+	anchorTx, err := service.Tick(time.Now())
+	if err != nil || anchorTx == nil {
+		fmt.Println("Anchoring service did not submit a header:", err)
+		return
+	}
+	header, _ := anchorTransactionHeader(anchorTx)
 	fmt.Printf("Generated Sidechain Header: MerkleRoot=%s\n", header.MerkleRoot)
 
 	// Verify header
@@ -124,43 +259,148 @@ func main() {
 	// Demonstrate anchoring to main chain
 	fmt.Println("Anchoring sidechain header to main chain...")
 	latestBlock := Blockchain[len(Blockchain)-1]
-	anchoredBlock := GenerateBlock(latestBlock, []*Transaction{}, "AnchorMiner", []SidechainHeader{*header})
-	if IsBlockValid(anchoredBlock, latestBlock) {
-		Blockchain = append(Blockchain, anchoredBlock)
+	anchoredBlock := GenerateBlock(latestBlock, []*Transaction{anchorTx}, operator, nil)
+	if AddBlock(anchoredBlock) {
 		fmt.Printf("Block %d added with anchored sidechain header.\n", anchoredBlock.Index)
 	}
+	service.Tick(time.Now())
+	anchoring := service.GetAnchoringStats(time.Now())
+	fmt.Printf("Anchoring: %v blocks unanchored, %v included, fees paid %v\n", anchoring["unanchored_blocks"], anchoring["included"], anchoring["fees_paid"])
+	archived := GetArchiveStats(sc.ID)
+	fmt.Printf("Archived ranges %v: %v blocks, %v transactions available for verification\n", archived["archived_ranges"], archived["archived_blocks"], archived["archived_transactions"])
+
+	// Prove a micro-transaction against the anchored block without the sidechain's blocks
+	if proof, err := sc.GenerateMerkleProof(*header, tx2.ID); err == nil {
+		if err := VerifyTransactionInclusion(anchoredBlock, tx2, proof); err == nil {
+			fmt.Printf("Transaction %s proven in block %d (index %d, %d siblings)\n", tx2.ID, anchoredBlock.Index, proof.Index, len(proof.Siblings))
+		} else {
+			fmt.Println("Inclusion proof failed:", err)
+		}
+	}
 
 	fmt.Println("\n--- VEP2 Treasury Simulation ---")
 
-	// 1. Treasury approves a wallet
-	userWallet := "Address1"
-	approvalHash := Registry.ApproveWallet(userWallet)
+	// 1. Treasury approves a wallet through governance, scoped to MCP actions with a spending cap
+	userWallet := publisher
+	grant := WalletApprovalGrant{
+		Wallet:       userWallet,
+		Scope:        []string{"mcp-action"},
+		SpendingCap:  big.NewInt(50),
+		ExpiryHeight: len(Blockchain) + 100,
+	}
+	walletApprovalTx, err := NewWalletApprovalTransaction(1, grant)
+	if err != nil {
+		fmt.Println("Error creating wallet approval:", err)
+		return
+	}
+	walletApprovalTx.ProcessTransactionFee()
+	for _, member := range members[:2] {
+		if err := walletApprovalTx.AddCoSignature(member); err != nil {
+			fmt.Println("Error co-signing wallet approval:", err)
+			return
+		}
+	}
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{walletApprovalTx}, participants[1], nil)) {
+		fmt.Println("Wallet approval block invalid!")
+	}
+	approvalHash := walletApprovalTx.ID
+	fmt.Printf("Treasury: Approved wallet %s with hash %s until height %d\n", userWallet, approvalHash, grant.ExpiryHeight)
 
-	// 2. User attempts a funded action
-	// Create a transaction with the approval hash in payload
+	// 2. User executes a funded action; the treasury pays the service
+	// The publisher sent one transaction per round, so its next nonce is the round count
+	userNonce := 5
 	fmt.Printf("User %s attempting funded action with hash %s...\n", userWallet, approvalHash)
-
-	fundedTx := NewTransaction(userWallet, "Service", big.NewInt(0), 1, "Approval:"+approvalHash)
-
-	if Registry.IsApproved(userWallet, approvalHash) {
+	if submitFundedAction(wallets[userWallet], userNonce, approvalHash, participants[1]) {
 		fmt.Println("Action Successful: Funded by Treasury (VOC)")
-		fmt.Printf("Transaction ID: %s\n", fundedTx.ID)
 	} else {
 		fmt.Println("Action Failed: Not Approved")
 	}
 
-	// 3. Treasury revokes approval
-	Registry.RevokeWallet(userWallet)
+	// 3. Treasury revokes approval; watchers see the ApprovalRevoked event once the block is added
+	SubscribeEvents(EventApprovalRevoked, func(event Event) {
+		fmt.Printf("Event %s at height %d: wallet %s, approval %s\n",
+			event.Name, event.Height, event.Attributes["wallet"], event.Attributes["approvalHash"])
+	})
+	revocationTx, err := NewWalletRevocationTransaction(2, userWallet, 0)
+	if err != nil {
+		fmt.Println("Error creating wallet revocation:", err)
+		return
+	}
+	revocationTx.ProcessTransactionFee()
+	for _, member := range members[1:] {
+		if err := revocationTx.AddCoSignature(member); err != nil {
+			fmt.Println("Error co-signing wallet revocation:", err)
+			return
+		}
+	}
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{revocationTx}, participants[1], nil)) {
+		fmt.Println("Wallet revocation block invalid!")
+	} else {
+		fmt.Printf("Treasury: Revoked approval for wallet %s\n", userWallet)
+	}
 
-	// 4. User attempts action again
+	// 4. User attempts action again; the block is rejected
 	fmt.Printf("User %s attempting funded action again...\n", userWallet)
-	if Registry.IsApproved(userWallet, approvalHash) {
+	if submitFundedAction(wallets[userWallet], userNonce+1, approvalHash, participants[1]) {
 		fmt.Println("Action Successful: Funded by Treasury (VOC)")
 	} else {
 		fmt.Println("Action Failed: Not Approved (Revoked)")
 	}
 
+	// Display supply accounting
+	if state, err := CurrentState(); err == nil {
+		supply := GetSupplyReport(state)
+		fmt.Printf("\nSupply at height %d: Minted=%s Burnt=%s TreasuryHeld=%s Circulating=%s\n",
+			supply.Height, supply.Minted.String(), supply.Burnt.String(), supply.TreasuryHeld.String(), supply.Circulating.String())
+	}
+
+	// Display sponsorship usage per publisher
+	for _, stats := range GetPublisherStats() {
+		fmt.Printf("Publisher %s: sponsored %s of %s this epoch, over budget: %v, fallbacks: %d\n",
+			stats["name"], stats["epoch_spent"], stats["epoch_budget"], stats["over_budget"], stats["fallbacks"])
+	}
+
+	// Display treasury solvency against the chain stability model
+	solvency := GetTreasurySolvency(SolvencyWindow)
+	fmt.Printf("Treasury solvency over %d blocks: net %s/block, sponsorship %s/block vs model income %s/block, runway (blocks): %s, sustainable: %v\n",
+		solvency["blocks"], solvency["net_per_block"], solvency["sponsorship_per_block"], solvency["model_income"],
+		solvency["runway_blocks"], solvency["sustainable"])
+
 	// Display final treasury stats
 	stats := GetTreasuryStats()
 	fmt.Printf("\nFinal Treasury Balance: %s\n", stats["balance"])
+
+	if exportPath != "" {
+		if err := SaveChain(exportPath, Blockchain); err != nil {
+			fmt.Println("Error exporting chain:", err)
+			return
+		}
+		fmt.Printf("Chain exported to %s\n", exportPath)
+	}
+	if archivePath != "" {
+		if err := SaveArchive(archivePath); err != nil {
+			fmt.Println("Error exporting sidechain archive:", err)
+			return
+		}
+		fmt.Printf("Sidechain archive exported to %s\n", archivePath)
+	}
+}
+
+// submitFundedAction sends a treasury-funded MCP action in a block proposed by validator
+func submitFundedAction(wallet *Wallet, nonce int, approvalHash, validator string) bool {
+	tx, err := NewFundedActionTransaction(wallet.GetAddress(), "Service", big.NewInt(10), nonce, approvalHash, "mcp-action")
+	if err != nil {
+		fmt.Println("Error creating funded action:", err)
+		return false
+	}
+	tx.ProcessTransactionFee()
+	if err := tx.SignTransaction(wallet.PrivateKey); err != nil {
+		fmt.Println("Error signing funded action:", err)
+		return false
+	}
+	if !AddBlock(GenerateBlock(Blockchain[len(Blockchain)-1], []*Transaction{tx}, validator, nil)) {
+		return false
+	}
+	fmt.Printf("Transaction ID: %s\n", tx.ID)
+	return true
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// MerkleProof proves that a sidechain transaction is covered by an anchored SidechainHeader
+// It holds everything a verifier needs besides the main-chain block carrying the header
+type MerkleProof struct {
+	SidechainID string
+	BlockRange  string   // Range of the anchored header
+	TxID        string   // Leaf being proven
+	Index       int      // Position of the transaction within the range
+	Siblings    []string // Sibling hashes from the leaf level up to the root
+}
+
+// Domain separation prefixes, so a leaf can never be reinterpreted as an inner node
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// merkleLeafHash hashes raw leaf data
+func merkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash hashes two raw child hashes into their parent
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// EmptyMerkleRoot is the root of a tree without leaves, the hash of no data
+var EmptyMerkleRoot = hex.EncodeToString(sha256.New().Sum(nil))
+
+// transactionLeaf returns the raw bytes of a transaction ID used as a merkle leaf
+func transactionLeaf(txID string) []byte {
+	if raw, err := hex.DecodeString(txID); err == nil {
+		return raw
+	}
+	return []byte(txID)
+}
+
+// merkleLevels builds every level of the tree, leaf hashes first and the root last
+// An unpaired last node is promoted to the next level unchanged rather than duplicated,
+// so no two different leaf lists share a root.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeafHash(leaf)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// MerkleRoot returns the hex root of a tree over raw leaves
+func MerkleRoot(leaves [][]byte) string {
+	if len(leaves) == 0 {
+		return EmptyMerkleRoot
+	}
+	levels := merkleLevels(leaves)
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// CalculateMerkleRoot calculates the merkle root of a list of transactions
+// Used for sidechain headers and for the transaction root of main-chain blocks
+func CalculateMerkleRoot(transactions []*Transaction) string {
+	leaves := make([][]byte, len(transactions))
+	for i, tx := range transactions {
+		leaves[i] = transactionLeaf(tx.ID)
+	}
+	return MerkleRoot(leaves)
+}
+
+// CalculateTraceRoot calculates the merkle root of the ledger roots after each transaction
+// of a sidechain range. Like transaction IDs, the roots are hex hashes
+func CalculateTraceRoot(stateRoots []string) string {
+	leaves := make([][]byte, len(stateRoots))
+	for i, root := range stateRoots {
+		leaves[i] = transactionLeaf(root)
+	}
+	return MerkleRoot(leaves)
+}
+
+// merkleSiblings returns the sibling path for the leaf at index
+// Levels where the node is unpaired contribute no sibling
+func merkleSiblings(leaves [][]byte, index int) []string {
+	var siblings []string
+	levels := merkleLevels(leaves)
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			siblings = append(siblings, hex.EncodeToString(level[sibling]))
+		}
+		index /= 2
+	}
+	return siblings
+}
+
+// ComputeRoot folds the sibling path over the leaf in a tree of leafCount leaves
+// and returns the resulting root
+func (p *MerkleProof) ComputeRoot(leafCount int) (string, error) {
+	return merkleProofRoot(transactionLeaf(p.TxID), p.Index, leafCount, p.Siblings)
+}
+
+// merkleProofRoot folds a sibling path over the leaf at index in a tree of leafCount leaves
+func merkleProofRoot(leaf []byte, index, leafCount int, siblings []string) (string, error) {
+	if index < 0 || index >= leafCount {
+		return "", fmt.Errorf("index %d outside %d leaves", index, leafCount)
+	}
+	node := merkleLeafHash(leaf)
+	width, used := leafCount, 0
+	for width > 1 {
+		paired := index%2 == 1 || index+1 < width
+		if paired {
+			if used >= len(siblings) {
+				return "", fmt.Errorf("proof has %d siblings, more needed", len(siblings))
+			}
+			sibling, err := hex.DecodeString(siblings[used])
+			if err != nil {
+				return "", fmt.Errorf("invalid sibling %d: %v", used, err)
+			}
+			used++
+			if index%2 == 0 {
+				node = merkleNodeHash(node, sibling)
+			} else {
+				node = merkleNodeHash(sibling, node)
+			}
+		}
+		index /= 2
+		width = (width + 1) / 2
+	}
+	if used != len(siblings) {
+		return "", fmt.Errorf("proof has %d unused siblings", len(siblings)-used)
+	}
+	return hex.EncodeToString(node), nil
+}
+
+// GenerateMerkleProof builds an inclusion proof for a transaction in an anchored header's range
+func (sc *Sidechain) GenerateMerkleProof(header SidechainHeader, txID string) (*MerkleProof, error) {
+	if header.SidechainID != sc.ID {
+		return nil, fmt.Errorf("header belongs to sidechain %s, not %s", header.SidechainID, sc.ID)
+	}
+	startBlock, endBlock, err := parseBlockRange(header.BlockRange)
+	if err != nil {
+		return nil, err
+	}
+	if startBlock < 0 || endBlock >= len(sc.Blocks) {
+		return nil, fmt.Errorf("block range %s is not in sidechain %s", header.BlockRange, sc.ID)
+	}
+
+	var leaves [][]byte
+	index := -1
+	for i := startBlock; i <= endBlock; i++ {
+		for _, tx := range sc.Blocks[i].Transactions {
+			if tx.ID == txID {
+				index = len(leaves)
+			}
+			leaves = append(leaves, transactionLeaf(tx.ID))
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transaction %s is not in range %s", txID, header.BlockRange)
+	}
+
+	proof := &MerkleProof{
+		SidechainID: sc.ID,
+		BlockRange:  header.BlockRange,
+		TxID:        txID,
+		Index:       index,
+		Siblings:    merkleSiblings(leaves, index),
+	}
+	if root, err := proof.ComputeRoot(len(leaves)); err != nil || root != header.MerkleRoot {
+		return nil, fmt.Errorf("sidechain blocks %s do not match the anchored merkle root", header.BlockRange)
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks a proof against the matching header anchored in a main-chain block
+// It needs only the block, not the sidechain's own blocks
+func VerifyMerkleProof(block Block, proof *MerkleProof) error {
+	for _, header := range block.AnchoredHeaders() {
+		if header.SidechainID != proof.SidechainID || header.BlockRange != proof.BlockRange {
+			continue
+		}
+		root, err := proof.ComputeRoot(header.TransactionCount)
+		if err != nil {
+			return err
+		}
+		if root != header.MerkleRoot {
+			return fmt.Errorf("proof computes root %s, block %d anchors %s", root, block.Index, header.MerkleRoot)
+		}
+		return nil
+	}
+	return fmt.Errorf("block %d anchors no header for %s range %s", block.Index, proof.SidechainID, proof.BlockRange)
+}
+
+// VerifyTransactionInclusion checks that a transaction's content matches the proven leaf
+// and that the proof holds against the main-chain block
+func VerifyTransactionInclusion(block Block, tx *Transaction, proof *MerkleProof) error {
+	if tx.CalculateHash() != proof.TxID {
+		return fmt.Errorf("transaction does not hash to the proven leaf %s", proof.TxID)
+	}
+	return VerifyMerkleProof(block, proof)
+}
+
+// parseBlockRange parses a "start-end" sidechain block range
+func parseBlockRange(blockRange string) (int, int, error) {
+	var startBlock, endBlock int
+	if _, err := fmt.Sscanf(blockRange, "%d-%d", &startBlock, &endBlock); err != nil {
+		return 0, 0, fmt.Errorf("invalid block range format: %s", blockRange)
+	}
+	if startBlock > endBlock {
+		return 0, 0, fmt.Errorf("invalid block range: %s", blockRange)
+	}
+	return startBlock, endBlock, nil
+}
@@ -17,8 +17,11 @@ type Proposal struct {
 var PreSubmissionPool []Proposal
 
 // SubmitProposal adds a proposal to the pool
+// Transactions are packed to the consensus block limits so any proposal can become a valid block,
+// and anchor transactions wait until their batch is archived
 func SubmitProposal(miner string, txs []*Transaction) {
-	PreSubmissionPool = append(PreSubmissionPool, Proposal{MinerAddress: miner, Transactions: txs})
+	packed := PackTransactions(ArchivedTransactions(txs), miner, nil)
+	PreSubmissionPool = append(PreSubmissionPool, Proposal{MinerAddress: miner, Transactions: packed})
 }
 
 // SelectPrimaryMiner selects a primary miner from the pool using randomness
@@ -57,35 +60,57 @@ func GetNextMiner(currentMiner Proposal) Proposal {
 	return PreSubmissionPool[nextIndex]
 }
 
-// DistributeBlockReward calculates and distributes the block reward
-// 1/3 to Miner, 1/3 to Coalition, 1/3 Burnt
-func DistributeBlockReward(minerAddress string, transactions []*Transaction) {
-	// Calculate W (total fees)
-	W := big.NewInt(0)
-	for _, tx := range transactions {
-		if tx.Fee != nil {
-			W.Add(W, tx.Fee)
-		}
-	}
+// BlockGenerationReward is the number of new coins generated with every block
+const BlockGenerationReward = 9
+
+// BlockReward is the split of a block's generated coins plus collected fees
+type BlockReward struct {
+	Generated *big.Int // New coins created by the block
+	Fees      *big.Int // W, the base-fee portion of all fees paid in the block
+	Tips      *big.Int // Fees paid above the base fee, given to the miner in full
+	Miner     *big.Int // Miner share plus tips
+	Coalition *big.Int
+	Burnt     *big.Int // Includes any rounding remainder of the 1/3 split
+}
+
+// CalculateBlockReward computes the reward split for a block
+// 1/3 of (9 + W) to Miner, 1/3 to Coalition, the rest is Burnt so that rounding
+// never creates coins. Tips bypass the split and go to the miner.
+func CalculateBlockReward(fees, tips *big.Int) BlockReward {
+	W := new(big.Int).Set(fees)
 
 	// Block generation = 9 coins
 	// Note: In a real system, we'd handle decimals (10^18)
 	// Here we assume 9 base units for simplicity or 9 * 10^18
-	blockGen := big.NewInt(9)
+	blockGen := big.NewInt(BlockGenerationReward)
 
 	// Total Reward = 9 + W
 	totalReward := new(big.Int).Add(blockGen, W)
 
 	// Split 1/3
 	share := new(big.Int).Div(totalReward, big.NewInt(3))
+	burnt := new(big.Int).Sub(totalReward, share)
+	burnt.Sub(burnt, share)
+
+	return BlockReward{
+		Generated: blockGen,
+		Fees:      W,
+		Tips:      new(big.Int).Set(tips),
+		Miner:     new(big.Int).Add(share, tips),
+		Coalition: new(big.Int).Set(share),
+		Burnt:     burnt,
+	}
+}
 
+// DistributeBlockReward reports the reward split of an applied block
+// The shares are credited to the miner and the coalition treasury when the block is applied
+func DistributeBlockReward(minerAddress string, reward BlockReward) {
 	// 1. Miner Reward
-	// In a real system, this would create a coinbase transaction or update state
-	fmt.Printf("Miner %s reward: %s\n", minerAddress, share.String())
+	fmt.Printf("Miner %s reward: %s (tips: %s)\n", minerAddress, reward.Miner.String(), reward.Tips.String())
 
 	// 2. Coalition Reward
-	DepositToTreasury(share, "Block Reward Share")
+	fmt.Printf("Coalition reward: %s. Treasury balance: %s\n", reward.Coalition.String(), GetTreasuryBalance().String())
 
 	// 3. Burn
-	fmt.Printf("Burnt amount: %s\n", share.String())
+	fmt.Printf("Burnt amount: %s\n", reward.Burnt.String())
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,7 @@ type Sidechain struct {
 	Name        string
 	ParentChain string // Reference to main chain
 	Blocks      []SidechainBlock
+	State       *SidechainState // Account ledger after the last block
 	CreatedAt   time.Time
 }
 
@@ -25,17 +27,24 @@ type SidechainBlock struct {
 	Transactions []*Transaction
 	Hash         string
 	PrevHash     string
-	Validator    string // Simplified validation - no PoP for sidechains
+	StateRoot    string        // Ledger root after the block's transactions
+	TxStateRoots []string      // Ledger root after each transaction, so a fraud proof can replay one step
+	Validator    string        // Proposing federated validator - no PoP for sidechains
+	Signatures   []CoSignature // Federated validator signatures over the block hash
 }
 
 // SidechainHeader represents the merkle root and metadata
 // This is what gets anchored to the main chain
 type SidechainHeader struct {
-	SidechainID    string
-	BlockRange     string // e.g., "1-100" indicating blocks included
-	MerkleRoot     string // Merkle root of all transactions in the range
+	SidechainID      string
+	BlockRange       string // e.g., "1-100" indicating blocks included
+	MerkleRoot       string // Merkle root of all transactions in the range
 	TransactionCount int
-	Timestamp      string
+	StateRoot        string // Sidechain ledger root after the last block in the range
+	TraceRoot        string // Merkle root of the ledger roots after each transaction in the range
+	Timestamp        string
+	PrevHeaderHash   string        // Hash of the sidechain's previously anchored header, empty for the first
+	Signatures       []CoSignature // Federated validator signatures over the header hash
 }
 
 // Global registry of sidechains
@@ -48,6 +57,7 @@ func CreateSidechain(id, name string) *Sidechain {
 		Name:        name,
 		ParentChain: "vuser-mainchain",
 		Blocks:      []SidechainBlock{},
+		State:       NewSidechainState(),
 		CreatedAt:   time.Now(),
 	}
 
@@ -57,6 +67,7 @@ func CreateSidechain(id, name string) *Sidechain {
 		Timestamp:    time.Now().String(),
 		Transactions: []*Transaction{},
 		PrevHash:     "0",
+		StateRoot:    sidechain.State.StateRoot(),
 		Validator:    "genesis",
 	}
 	genesisBlock.Hash = CalculateSidechainBlockHash(genesisBlock)
@@ -66,8 +77,17 @@ func CreateSidechain(id, name string) *Sidechain {
 	return sidechain
 }
 
-// AddSidechainBlock adds a new block to a sidechain
-func (sc *Sidechain) AddSidechainBlock(transactions []*Transaction, validator string) SidechainBlock {
+// ProposeSidechainBlock builds an unsigned block on top of the sidechain's tip
+// The transactions are applied to a copy of the ledger to compute the block's state root
+func (sc *Sidechain) ProposeSidechainBlock(transactions []*Transaction, validator string) (SidechainBlock, error) {
+	anchor, err := sc.registeredAnchor()
+	if err != nil {
+		return SidechainBlock{}, err
+	}
+	ledger, trace, err := sc.applySidechainTransactions(transactions, anchor)
+	if err != nil {
+		return SidechainBlock{}, err
+	}
 	prevBlock := sc.Blocks[len(sc.Blocks)-1]
 
 	newBlock := SidechainBlock{
@@ -75,12 +95,131 @@ func (sc *Sidechain) AddSidechainBlock(transactions []*Transaction, validator st
 		Timestamp:    time.Now().String(),
 		Transactions: transactions,
 		PrevHash:     prevBlock.Hash,
+		StateRoot:    ledger.StateRoot(),
+		TxStateRoots: trace,
 		Validator:    validator,
 	}
 	newBlock.Hash = CalculateSidechainBlockHash(newBlock)
+	return newBlock, nil
+}
 
-	sc.Blocks = append(sc.Blocks, newBlock)
-	return newBlock
+// registeredAnchor returns the main chain's record of the sidechain
+func (sc *Sidechain) registeredAnchor() (*SidechainAnchor, error) {
+	state, err := CurrentState()
+	if err != nil {
+		return nil, err
+	}
+	anchor, exists := state.Sidechains[sc.ID]
+	if !exists {
+		return nil, fmt.Errorf("sidechain %s is not registered on the main chain", sc.ID)
+	}
+	return anchor, nil
+}
+
+// applySidechainTransactions applies transactions to a copy of the sidechain's ledger
+// and returns it with the ledger root after each transaction
+func (sc *Sidechain) applySidechainTransactions(transactions []*Transaction, anchor *SidechainAnchor) (*SidechainState, []string, error) {
+	ledger := sc.State.Copy()
+	var trace []string
+	for _, tx := range transactions {
+		if err := ledger.ApplyTransaction(tx, anchor); err != nil {
+			return nil, nil, fmt.Errorf("transaction %s: %v", tx.ID, err)
+		}
+		trace = append(trace, ledger.StateRoot())
+	}
+	return ledger, trace, nil
+}
+
+// AppendSidechainBlock adds a block signed by a threshold of the validator set in effect for it
+func (sc *Sidechain) AppendSidechainBlock(block SidechainBlock) error {
+	prevBlock := sc.Blocks[len(sc.Blocks)-1]
+	if block.Index != prevBlock.Index+1 || block.PrevHash != prevBlock.Hash {
+		return fmt.Errorf("block %d does not follow sidechain block %d", block.Index, prevBlock.Index)
+	}
+	if CalculateSidechainBlockHash(block) != block.Hash {
+		return fmt.Errorf("hash %s does not match block contents", block.Hash)
+	}
+	anchor, err := sc.registeredAnchor()
+	if err != nil {
+		return err
+	}
+	signs := anchor.signsFor(block.Index)
+	if !signs(block.Validator) {
+		return fmt.Errorf("proposer %s is not a validator of block %d", block.Validator, block.Index)
+	}
+	threshold := anchor.ValidatorsFor(block.Index).Threshold
+	if signers := block.ValidSigners(signs); len(signers) < threshold {
+		return fmt.Errorf("block %d signed by %d of the %d required validators", block.Index, len(signers), threshold)
+	}
+	ledger, trace, err := sc.applySidechainTransactions(block.Transactions, anchor)
+	if err != nil {
+		return err
+	}
+	if root := ledger.StateRoot(); root != block.StateRoot {
+		return fmt.Errorf("block %d state root %s does not match ledger root %s", block.Index, block.StateRoot, root)
+	}
+	if len(block.TxStateRoots) != len(trace) {
+		return fmt.Errorf("block %d has %d transaction state roots for %d transactions", block.Index, len(block.TxStateRoots), len(trace))
+	}
+	for i, root := range trace {
+		if block.TxStateRoots[i] != root {
+			return fmt.Errorf("block %d state root after transaction %d does not match ledger root %s", block.Index, i, root)
+		}
+	}
+
+	sc.Blocks = append(sc.Blocks, block)
+	sc.State = ledger
+	return nil
+}
+
+// AddSidechainBlock proposes a block from the first signer, signs it with every signer and adds it
+func (sc *Sidechain) AddSidechainBlock(transactions []*Transaction, signers ...*Wallet) (SidechainBlock, error) {
+	if len(signers) == 0 {
+		return SidechainBlock{}, fmt.Errorf("sidechain blocks need validator signatures")
+	}
+	newBlock, err := sc.ProposeSidechainBlock(transactions, signers[0].GetAddress())
+	if err != nil {
+		return SidechainBlock{}, err
+	}
+	for _, signer := range signers {
+		if err := newBlock.Sign(signer); err != nil {
+			return SidechainBlock{}, err
+		}
+	}
+	if err := sc.AppendSidechainBlock(newBlock); err != nil {
+		return SidechainBlock{}, err
+	}
+	return newBlock, nil
+}
+
+// ValidatorsFor returns the validator set anchored on the main chain for a sidechain block
+func (sc *Sidechain) ValidatorsFor(index int) (SidechainValidatorSet, error) {
+	anchor, err := sc.registeredAnchor()
+	if err != nil {
+		return SidechainValidatorSet{}, err
+	}
+	return anchor.ValidatorsFor(index), nil
+}
+
+// signingDigest is the data federated validators sign for a block
+func (b *SidechainBlock) signingDigest() []byte {
+	digest := sha256.Sum256([]byte("sidechain-block:" + b.Hash))
+	return digest[:]
+}
+
+// Sign adds a federated validator's signature to the block
+func (b *SidechainBlock) Sign(wallet *Wallet) error {
+	signature, err := wallet.Sign(b.signingDigest())
+	if err != nil {
+		return err
+	}
+	b.Signatures = append(b.Signatures, CoSignature{Signer: wallet.GetAddress(), Signature: signature})
+	return nil
+}
+
+// ValidSigners returns the distinct validators accepted by allowed that signed the block
+func (b *SidechainBlock) ValidSigners(allowed func(address string) bool) []string {
+	return validCoSigners(b.signingDigest(), b.Signatures, allowed)
 }
 
 // CalculateSidechainBlockHash calculates the hash of a sidechain block
@@ -89,7 +228,8 @@ func CalculateSidechainBlockHash(block SidechainBlock) string {
 	for _, tx := range block.Transactions {
 		txHashes += tx.ID
 	}
-	record := fmt.Sprintf("%d%s%s%s%s", block.Index, block.Timestamp, txHashes, block.PrevHash, block.Validator)
+	record := fmt.Sprintf("%d%s%s%s%s%s%s", block.Index, block.Timestamp, txHashes, block.PrevHash, block.StateRoot,
+		strings.Join(block.TxStateRoots, ""), block.Validator)
 	h := sha256.New()
 	h.Write([]byte(record))
 	return hex.EncodeToString(h.Sum(nil))
@@ -102,10 +242,12 @@ func (sc *Sidechain) GenerateSidechainHeader(startBlock, endBlock int) (*Sidecha
 		return nil, fmt.Errorf("invalid block range: %d-%d", startBlock, endBlock)
 	}
 
-	// Collect all transactions in the range
+	// Collect all transactions in the range, with the ledger root after each
 	var allTransactions []*Transaction
+	var trace []string
 	for i := startBlock; i <= endBlock; i++ {
 		allTransactions = append(allTransactions, sc.Blocks[i].Transactions...)
+		trace = append(trace, sc.Blocks[i].TxStateRoots...)
 	}
 
 	// Calculate merkle root
@@ -116,47 +258,53 @@ func (sc *Sidechain) GenerateSidechainHeader(startBlock, endBlock int) (*Sidecha
 		BlockRange:       fmt.Sprintf("%d-%d", startBlock, endBlock),
 		MerkleRoot:       merkleRoot,
 		TransactionCount: len(allTransactions),
+		StateRoot:        sc.Blocks[endBlock].StateRoot,
+		TraceRoot:        CalculateTraceRoot(trace),
 		Timestamp:        time.Now().String(),
 	}
 
+	// Link to the last header anchored on the main chain
+	if state, err := CurrentState(); err == nil {
+		if anchor, exists := state.Sidechains[sc.ID]; exists {
+			header.PrevHeaderHash = anchor.LastHeaderHash
+		}
+	}
+
 	return header, nil
 }
 
-// CalculateMerkleRoot calculates the merkle root of a list of transactions
-// Simplified implementation - in production, use proper merkle tree
-func CalculateMerkleRoot(transactions []*Transaction) string {
-	if len(transactions) == 0 {
-		return "0"
-	}
-
-	// Collect all transaction hashes
-	hashes := make([]string, len(transactions))
-	for i, tx := range transactions {
-		hashes[i] = tx.ID
-	}
-
-	// Build merkle tree bottom-up
-	for len(hashes) > 1 {
-		var newLevel []string
-		for i := 0; i < len(hashes); i += 2 {
-			var combined string
-			if i+1 < len(hashes) {
-				combined = hashes[i] + hashes[i+1]
-			} else {
-				// Odd number - duplicate last hash
-				combined = hashes[i] + hashes[i]
-			}
-			h := sha256.New()
-			h.Write([]byte(combined))
-			newLevel = append(newLevel, hex.EncodeToString(h.Sum(nil)))
-		}
-		hashes = newLevel
+// CalculateHash hashes the header contents, excluding validator signatures
+func (h *SidechainHeader) CalculateHash() string {
+	record := fmt.Sprintf("%s|%s|%s|%d|%s|%s|%s|%s", h.SidechainID, h.BlockRange, h.MerkleRoot, h.TransactionCount, h.StateRoot, h.TraceRoot,
+		h.Timestamp, h.PrevHeaderHash)
+	hashed := sha256.Sum256([]byte(record))
+	return hex.EncodeToString(hashed[:])
+}
+
+// signingDigest is the data federated validators sign
+// It is hashed because signatures only cover the first 32 bytes of the data
+func (h *SidechainHeader) signingDigest() []byte {
+	digest := sha256.Sum256([]byte("sidechain-header:" + h.CalculateHash()))
+	return digest[:]
+}
+
+// Sign adds a federated validator's signature to the header
+func (h *SidechainHeader) Sign(wallet *Wallet) error {
+	signature, err := wallet.Sign(h.signingDigest())
+	if err != nil {
+		return err
 	}
+	h.Signatures = append(h.Signatures, CoSignature{Signer: wallet.GetAddress(), Signature: signature})
+	return nil
+}
 
-	return hashes[0]
+// ValidSigners returns the distinct validators accepted by allowed that signed the header
+func (h *SidechainHeader) ValidSigners(allowed func(address string) bool) []string {
+	return validCoSigners(h.signingDigest(), h.Signatures, allowed)
 }
 
-// VerifySidechainHeader verifies that a sidechain header is valid
+// VerifySidechainHeader checks a header against the sidechain's full block history
+// This needs the sidechain's blocks, so main-chain validation relies on the anchor checks instead
 func VerifySidechainHeader(header *SidechainHeader) bool {
 	sc, exists := SidechainRegistry[header.SidechainID]
 	if !exists {
@@ -165,10 +313,9 @@ func VerifySidechainHeader(header *SidechainHeader) bool {
 	}
 
 	// Parse block range
-	var startBlock, endBlock int
-	_, err := fmt.Sscanf(header.BlockRange, "%d-%d", &startBlock, &endBlock)
+	startBlock, endBlock, err := parseBlockRange(header.BlockRange)
 	if err != nil {
-		fmt.Println("Invalid block range format:", header.BlockRange)
+		fmt.Println(err)
 		return false
 	}
 
@@ -189,6 +336,16 @@ func VerifySidechainHeader(header *SidechainHeader) bool {
 		return false
 	}
 
+	if regeneratedHeader.StateRoot != header.StateRoot {
+		fmt.Println("State root mismatch")
+		return false
+	}
+
+	if regeneratedHeader.TraceRoot != header.TraceRoot {
+		fmt.Println("Trace root mismatch")
+		return false
+	}
+
 	return true
 }
 
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SidechainState is a sidechain's account ledger
+// Transactions follow the main chain's transfer rules; fees follow the sidechain's own
+// policy, registered on the main chain, and are paid to its operator.
+type SidechainState struct {
+	Balances map[string]*big.Int
+	Nonces   map[string]int
+	Minted   map[string]bool // Bridge deposits minted, by deposit ID
+}
+
+// NewSidechainState creates an empty sidechain ledger
+func NewSidechainState() *SidechainState {
+	return &SidechainState{
+		Balances: make(map[string]*big.Int),
+		Nonces:   make(map[string]int),
+		Minted:   make(map[string]bool),
+	}
+}
+
+// Copy returns a deep copy of the ledger
+func (s *SidechainState) Copy() *SidechainState {
+	c := NewSidechainState()
+	for address, balance := range s.Balances {
+		c.Balances[address] = new(big.Int).Set(balance)
+	}
+	for address, nonce := range s.Nonces {
+		c.Nonces[address] = nonce
+	}
+	for id := range s.Minted {
+		c.Minted[id] = true
+	}
+	return c
+}
+
+// BalanceOf returns a sidechain account's balance
+func (s *SidechainState) BalanceOf(address string) *big.Int {
+	if balance, exists := s.Balances[address]; exists {
+		return new(big.Int).Set(balance)
+	}
+	return big.NewInt(0)
+}
+
+// addBalance adjusts a sidechain account's balance
+func (s *SidechainState) addBalance(address string, amount *big.Int) {
+	if _, exists := s.Balances[address]; !exists {
+		s.Balances[address] = big.NewInt(0)
+	}
+	s.Balances[address].Add(s.Balances[address], amount)
+}
+
+// ApplyTransaction applies a sidechain transaction, leaving the ledger unchanged if it is invalid
+// Mints must match a main-chain deposit and are free; transfers and burns need the sender's
+// signature and their next nonce, and the sender must cover the amount and the sidechain fee.
+func (s *SidechainState) ApplyTransaction(tx *Transaction, anchor *SidechainAnchor) error {
+	if tx.Amount == nil || tx.Amount.Sign() < 0 {
+		return fmt.Errorf("invalid amount")
+	}
+	if tx.ID != tx.CalculateHash() {
+		return fmt.Errorf("ID does not match transaction contents")
+	}
+
+	if tx.Type == TxBridgeMint {
+		if s.Minted[tx.Payload] {
+			return fmt.Errorf("deposit %s already minted", tx.Payload)
+		}
+		for _, deposit := range anchor.Deposits {
+			if deposit.ID == tx.Payload && NewBridgeMintTransaction(deposit).ID == tx.ID {
+				s.Minted[tx.Payload] = true
+				s.addBalance(tx.Recipient, tx.Amount)
+				return nil
+			}
+		}
+		return fmt.Errorf("mint %s does not match a main-chain deposit", tx.ID)
+	}
+	if tx.Type != TxTransfer && tx.Type != TxBridgeBurn {
+		return fmt.Errorf("transaction type %q is not allowed on sidechains", tx.Type)
+	}
+
+	if tx.Signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+	if !tx.VerifyTransaction() {
+		return fmt.Errorf("signature does not match sender %s", tx.Sender)
+	}
+	if tx.Nonce != s.Nonces[tx.Sender] {
+		return fmt.Errorf("nonce %d out of order, next nonce for %s is %d", tx.Nonce, tx.Sender, s.Nonces[tx.Sender])
+	}
+	fee := anchor.TransactionFee()
+	cost := new(big.Int).Add(tx.Amount, fee)
+	if s.BalanceOf(tx.Sender).Cmp(cost) < 0 {
+		return fmt.Errorf("sender %s cannot cover %s", tx.Sender, cost.String())
+	}
+
+	s.Nonces[tx.Sender]++
+	s.addBalance(tx.Sender, new(big.Int).Neg(cost))
+	if tx.Type == TxTransfer {
+		s.addBalance(tx.Recipient, tx.Amount)
+	}
+	if fee.Sign() > 0 {
+		s.addBalance(anchor.Operator, fee)
+	}
+	return nil
+}
+
+// Supply returns the coins held in sidechain accounts
+func (s *SidechainState) Supply() *big.Int {
+	supply := big.NewInt(0)
+	for _, balance := range s.Balances {
+		supply.Add(supply, balance)
+	}
+	return supply
+}
+
+// Ledger keys of the state tree
+const (
+	accountKeyPrefix = "account|"
+	mintedKeyPrefix  = "minted|"
+)
+
+// accountKey returns the state tree key of an account, holding "balance|nonce"
+func accountKey(address string) string {
+	return accountKeyPrefix + address
+}
+
+// mintedKey returns the state tree key of a bridge deposit, holding "minted" once minted
+func mintedKey(depositID string) string {
+	return mintedKeyPrefix + depositID
+}
+
+// stateValue returns the value the ledger holds for a key, empty if it holds none
+func (s *SidechainState) stateValue(key string) string {
+	switch {
+	case strings.HasPrefix(key, accountKeyPrefix):
+		address := strings.TrimPrefix(key, accountKeyPrefix)
+		balance, hasBalance := s.Balances[address]
+		nonce, hasNonce := s.Nonces[address]
+		if !hasBalance && !hasNonce {
+			return ""
+		}
+		if !hasBalance {
+			balance = big.NewInt(0)
+		}
+		return fmt.Sprintf("%s|%d", balance.String(), nonce)
+	case strings.HasPrefix(key, mintedKeyPrefix):
+		if s.Minted[strings.TrimPrefix(key, mintedKeyPrefix)] {
+			return "minted"
+		}
+	}
+	return ""
+}
+
+// setStateValue sets a key to a value proven against a state root
+func (s *SidechainState) setStateValue(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(key, accountKeyPrefix):
+		address := strings.TrimPrefix(key, accountKeyPrefix)
+		balanceText, nonceText, _ := strings.Cut(value, "|")
+		balance, ok := new(big.Int).SetString(balanceText, 10)
+		nonce, err := strconv.Atoi(nonceText)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid account value %q for %s", value, address)
+		}
+		s.Balances[address] = balance
+		if nonce > 0 {
+			s.Nonces[address] = nonce
+		}
+	case strings.HasPrefix(key, mintedKeyPrefix) && value == "minted":
+		s.Minted[strings.TrimPrefix(key, mintedKeyPrefix)] = true
+	default:
+		return fmt.Errorf("invalid state entry %s = %q", key, value)
+	}
+	return nil
+}
+
+// stateKeys returns every key the ledger holds a value for
+func (s *SidechainState) stateKeys() []string {
+	var keys []string
+	for address := range s.Balances {
+		keys = append(keys, accountKey(address))
+	}
+	for address := range s.Nonces {
+		if _, exists := s.Balances[address]; !exists {
+			keys = append(keys, accountKey(address))
+		}
+	}
+	for id := range s.Minted {
+		keys = append(keys, mintedKey(id))
+	}
+	return keys
+}
+
+// StateRoot returns the root of the sparse merkle tree over the ledger's accounts and
+// minted deposits. Each key sits at the leaf its hash points to, so a key's value, or
+// its absence, can be proven and updated without the rest of the ledger.
+func (s *SidechainState) StateRoot() string {
+	var entries []stateEntry
+	for _, key := range s.stateKeys() {
+		entries = append(entries, newStateEntry(key, s.stateValue(key)))
+	}
+	return stateTreeRoot(entries, emptySibling)
+}
+
+// StateKeyProof proves the value of one ledger key against a state root
+type StateKeyProof struct {
+	Key      string
+	Value    string         // Empty if the ledger holds no value for the key
+	Siblings map[int]string // Sibling hashes on the key's path by depth, empty subtrees left out
+}
+
+// ProveState builds proofs of the values the ledger holds for keys
+func (s *SidechainState) ProveState(keys []string) []StateKeyProof {
+	var entries []stateEntry
+	for _, key := range s.stateKeys() {
+		entries = append(entries, newStateEntry(key, s.stateValue(key)))
+	}
+	sortStateEntries(entries)
+
+	proofs := make([]StateKeyProof, 0, len(keys))
+	for _, key := range keys {
+		proof := StateKeyProof{Key: key, Value: s.stateValue(key), Siblings: make(map[int]string)}
+		path := statePath(key)
+		below := entries
+		for depth := 0; depth < stateTreeDepth && len(below) > 0; depth++ {
+			var same, other []stateEntry
+			for _, entry := range below {
+				if pathBit(entry.path, depth) == pathBit(path, depth) {
+					same = append(same, entry)
+				} else {
+					other = append(other, entry)
+				}
+			}
+			if len(other) > 0 {
+				proof.Siblings[depth+1] = hex.EncodeToString(sparseRoot(other, depth+1, emptySibling))
+			}
+			below = same
+		}
+		proofs = append(proofs, proof)
+	}
+	return proofs
+}
+
+// stateProofRoot returns the state root implied by proofs, with each proven key holding
+// value(key). Proofs that together give a known root vouch for every sibling they use.
+func stateProofRoot(proofs []StateKeyProof, value func(key string) string) (string, error) {
+	seen := make(map[string]bool)
+	var entries []stateEntry
+	for _, proof := range proofs {
+		if seen[proof.Key] {
+			return "", fmt.Errorf("key %s is proven twice", proof.Key)
+		}
+		seen[proof.Key] = true
+		entry := newStateEntry(proof.Key, value(proof.Key))
+		entry.siblings = make(map[int][]byte, len(proof.Siblings))
+		for depth, sibling := range proof.Siblings {
+			raw, err := hex.DecodeString(sibling)
+			if err != nil || depth < 1 || depth > stateTreeDepth {
+				return "", fmt.Errorf("invalid sibling at depth %d for %s", depth, proof.Key)
+			}
+			entry.siblings[depth] = raw
+		}
+		entries = append(entries, entry)
+	}
+	return stateTreeRoot(entries, func(entry stateEntry, depth int) []byte {
+		if sibling, exists := entry.siblings[depth]; exists {
+			return sibling
+		}
+		return emptySibling(entry, depth)
+	}), nil
+}
+
+// provenLedger builds a partial ledger holding only the proven keys
+func provenLedger(proofs []StateKeyProof) (*SidechainState, error) {
+	ledger := NewSidechainState()
+	for _, proof := range proofs {
+		if err := ledger.setStateValue(proof.Key, proof.Value); err != nil {
+			return nil, err
+		}
+	}
+	return ledger, nil
+}
+
+// stateTreeDepth is the depth of the state tree, one level per bit of a key's hash
+const stateTreeDepth = 256
+
+// emptyStateNodes holds the hash of an empty subtree by its height
+var emptyStateNodes = func() [][]byte {
+	nodes := [][]byte{make([]byte, sha256.Size)}
+	for height := 1; height <= stateTreeDepth; height++ {
+		nodes = append(nodes, merkleNodeHash(nodes[height-1], nodes[height-1]))
+	}
+	return nodes
+}()
+
+// stateEntry is a ledger key placed in the state tree
+type stateEntry struct {
+	path     []byte
+	leaf     []byte
+	siblings map[int][]byte // Proven sibling hashes by depth, for partial trees
+}
+
+// newStateEntry hashes a key and its value into a leaf; an empty value is an empty leaf
+func newStateEntry(key, value string) stateEntry {
+	leaf := emptyStateNodes[0]
+	if value != "" {
+		leaf = merkleLeafHash([]byte(key + "|" + value))
+	}
+	return stateEntry{path: statePath(key), leaf: leaf}
+}
+
+// statePath returns the position of a key in the state tree
+func statePath(key string) []byte {
+	path := sha256.Sum256([]byte(key))
+	return path[:]
+}
+
+// pathBit returns the bit of a path choosing the branch below depth
+func pathBit(path []byte, depth int) int {
+	return int(path[depth/8]>>(7-depth%8)) & 1
+}
+
+// emptySibling returns the hash of the empty subtree at depth
+func emptySibling(_ stateEntry, depth int) []byte {
+	return emptyStateNodes[stateTreeDepth-depth]
+}
+
+// sortStateEntries orders entries by their path
+func sortStateEntries(entries []stateEntry) {
+	sort.Slice(entries, func(i, j int) bool { return string(entries[i].path) < string(entries[j].path) })
+}
+
+// stateTreeRoot returns the hex root of the tree holding entries
+func stateTreeRoot(entries []stateEntry, sibling func(entry stateEntry, depth int) []byte) string {
+	if len(entries) == 0 {
+		return hex.EncodeToString(emptyStateNodes[stateTreeDepth])
+	}
+	sortStateEntries(entries)
+	return hex.EncodeToString(sparseRoot(entries, 0, sibling))
+}
+
+// sparseRoot hashes the subtree at depth holding entries, which share their path above it.
+// sibling returns the hash of a subtree without entries, given an entry on the other branch.
+func sparseRoot(entries []stateEntry, depth int, sibling func(entry stateEntry, depth int) []byte) []byte {
+	if depth == stateTreeDepth {
+		return entries[0].leaf
+	}
+	split := sort.Search(len(entries), func(i int) bool { return pathBit(entries[i].path, depth) == 1 })
+	left, right := entries[:split], entries[split:]
+	if len(left) == 0 {
+		return merkleNodeHash(sibling(right[0], depth+1), sparseRoot(right, depth+1, sibling))
+	}
+	if len(right) == 0 {
+		return merkleNodeHash(sparseRoot(left, depth+1, sibling), sibling(left[0], depth+1))
+	}
+	return merkleNodeHash(sparseRoot(left, depth+1, sibling), sparseRoot(right, depth+1, sibling))
+}
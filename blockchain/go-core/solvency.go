@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// SolvencyWindow is the number of recent blocks kept for treasury solvency analysis
+const SolvencyWindow = 100
+
+// SolvencyReport measures the treasury's real inflows and outflows over recent blocks
+// against the whitepaper's chain stability model. The coalition receives (9 + W) / 3
+// per block, which has to cover the fees it sponsors; the supply changes by
+// S_net = 6 - W/3 per block.
+type SolvencyReport struct {
+	FromHeight int
+	ToHeight   int
+	Blocks     int
+	Balance    *big.Int // Treasury balance at ToHeight
+
+	FeePot        *big.Int // Total W over the window
+	RewardIncome  *big.Int // Reward share deposits
+	SponsoredFees *big.Int // Sponsorship withdrawals
+	OtherInflows  *big.Int // Transfers and other deposits
+	OtherOutflows *big.Int // Withdrawals, funded actions and coalition fees
+	NetIncome     *big.Int // Net change of the treasury balance over the window
+
+	NetPerBlock         *big.Rat // Rolling net income per block
+	ModelIncome         *big.Rat // Model coalition income per block, (9 + W) / 3 at the average W
+	ModelSupplyNet      *big.Rat // Model supply change per block, 6 - W/3 at the average W
+	SponsorshipPerBlock *big.Rat
+
+	RunwayBlocks int64 // Blocks until the balance runs out at the current net income, -1 if not shrinking
+	Sustainable  bool  // Sponsorship spending is within the model's coalition income
+}
+
+// AnalyzeTreasurySolvency computes the solvency report over the last window blocks of a state
+func AnalyzeTreasurySolvency(state *ChainState, window int) *SolvencyReport {
+	if window <= 0 || window > SolvencyWindow {
+		window = SolvencyWindow
+	}
+	rewards := state.RecentRewards
+	if len(rewards) > window {
+		rewards = rewards[len(rewards)-window:]
+	}
+
+	report := &SolvencyReport{
+		ToHeight:      state.Height,
+		Blocks:        len(rewards),
+		Balance:       state.BalanceOf(CoalitionAddress),
+		FeePot:        big.NewInt(0),
+		RewardIncome:  big.NewInt(0),
+		SponsoredFees: big.NewInt(0),
+		OtherInflows:  big.NewInt(0),
+		OtherOutflows: big.NewInt(0),
+		NetIncome:     big.NewInt(0),
+		RunwayBlocks:  -1,
+		Sustainable:   true,
+	}
+	report.FromHeight = state.Height - report.Blocks + 1
+	if report.Blocks == 0 {
+		report.NetPerBlock = new(big.Rat)
+		report.ModelIncome = new(big.Rat)
+		report.ModelSupplyNet = new(big.Rat)
+		report.SponsorshipPerBlock = new(big.Rat)
+		return report
+	}
+
+	for _, reward := range rewards {
+		report.FeePot.Add(report.FeePot, reward.Fees)
+	}
+
+	// Journal entries are in height order, so scan back to the start of the window
+	journal := state.Treasury.TransactionLog()
+	for i := len(journal) - 1; i >= 0 && journal[i].Height >= report.FromHeight; i-- {
+		entry := journal[i]
+		report.NetIncome.Add(report.NetIncome, entry.Change)
+		switch {
+		case entry.Type == JournalRewardShare:
+			report.RewardIncome.Add(report.RewardIncome, entry.Change)
+		case entry.Type == JournalSponsorship:
+			report.SponsoredFees.Sub(report.SponsoredFees, entry.Change)
+		case entry.Change.Sign() > 0:
+			report.OtherInflows.Add(report.OtherInflows, entry.Change)
+		case entry.Change.Sign() < 0:
+			report.OtherOutflows.Sub(report.OtherOutflows, entry.Change)
+		}
+	}
+
+	blocks := big.NewInt(int64(report.Blocks))
+	averageW := new(big.Rat).SetFrac(report.FeePot, blocks)
+	report.NetPerBlock = new(big.Rat).SetFrac(report.NetIncome, blocks)
+	report.SponsorshipPerBlock = new(big.Rat).SetFrac(report.SponsoredFees, blocks)
+
+	// R_C = (9 + W) / 3
+	report.ModelIncome = new(big.Rat).Add(averageW, big.NewRat(BlockGenerationReward, 1))
+	report.ModelIncome.Quo(report.ModelIncome, big.NewRat(3, 1))
+	// S_net = 6 - W/3
+	report.ModelSupplyNet = new(big.Rat).Quo(averageW, big.NewRat(3, 1))
+	report.ModelSupplyNet.Sub(big.NewRat(6, 1), report.ModelSupplyNet)
+
+	report.Sustainable = report.SponsorshipPerBlock.Cmp(report.ModelIncome) <= 0
+
+	if report.NetIncome.Sign() < 0 {
+		// Balance / (-net per block) = balance * blocks / -net
+		runway := new(big.Int).Mul(report.Balance, blocks)
+		runway.Quo(runway, new(big.Int).Neg(report.NetIncome))
+		if runway.IsInt64() {
+			report.RunwayBlocks = runway.Int64()
+		}
+	}
+	return report
+}
+
+// GetTreasurySolvency returns solvency statistics for the last window blocks
+func GetTreasurySolvency(window int) map[string]interface{} {
+	state, err := CurrentState()
+	if err != nil {
+		return map[string]interface{}{
+			"error": fmt.Sprintf("Error building chain state: %v", err),
+		}
+	}
+
+	report := AnalyzeTreasurySolvency(state, window)
+	runway := "unlimited"
+	if report.RunwayBlocks >= 0 {
+		runway = fmt.Sprintf("%d", report.RunwayBlocks)
+	}
+	return map[string]interface{}{
+		"from_height":           report.FromHeight,
+		"to_height":             report.ToHeight,
+		"blocks":                report.Blocks,
+		"balance":               report.Balance.String(),
+		"reward_income":         report.RewardIncome.String(),
+		"sponsored_fees":        report.SponsoredFees.String(),
+		"other_inflows":         report.OtherInflows.String(),
+		"other_outflows":        report.OtherOutflows.String(),
+		"net_income":            report.NetIncome.String(),
+		"net_per_block":         report.NetPerBlock.FloatString(2),
+		"sponsorship_per_block": report.SponsorshipPerBlock.FloatString(2),
+		"model_income":          report.ModelIncome.FloatString(2),
+		"model_supply_net":      report.ModelSupplyNet.FloatString(2),
+		"runway_blocks":         runway,
+		"sustainable":           report.Sustainable,
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CoalitionAddress is the account that receives the coalition's share of block rewards
+const CoalitionAddress = "Coalition"
+
+// EligibilityPoolSize is the number of recent unique senders eligible to propose blocks
+const EligibilityPoolSize = 100
+
+// ChainState is the account state derived by applying blocks in order
+type ChainState struct {
+	Height   int    // Index of the last applied block, -1 before genesis
+	TipHash  string // Hash of the last applied block
+	Balances map[string]*big.Int
+	Nonces   map[string]int // Nonce each sender must use next
+	Minted   *big.Int       // Genesis allocation plus all generated coins
+	Burnt    *big.Int       // Total coins destroyed by the reward split
+	Genesis  *big.Int       // Amount minted by the genesis block
+
+	FeeSchedules   []ScheduledFee // Governance fee schedules ordered by activation height
+	DynamicBaseFee *big.Int       // Base fee for the next block, nil unless the dynamic base fee is enabled
+	LastReward     BlockReward    // Reward split of the last applied block
+	RecentRewards  []BlockReward  // Reward splits of the last SolvencyWindow blocks, oldest first
+
+	// Sponsored transactions in the last block that fell back to sender-paid
+	LastSponsorFallbacks []string
+
+	// Last unique transaction senders, most recent last (Proof-of-Participation)
+	EligibilityPool []string
+
+	// Coalition treasury view of the CoalitionAddress account
+	Treasury *CoalitionTreasury
+
+	Governance GovernanceSet                 // Installed by the genesis block
+	Publishers map[string]*ApprovedPublisher // Publishers approved for sponsorship by governance
+	Approvals  map[string]*WalletApproval    // Latest VEP2 wallet approval by wallet address
+
+	// Replaced VEP2 approvals by wallet address, oldest first, kept for auditing
+	ApprovalHistory map[string][]*WalletApproval
+
+	// Registered sidechains and their anchoring progress by sidechain ID
+	Sidechains map[string]*SidechainAnchor
+
+	// Events emitted by applied blocks, most recent block first
+	EventLog *eventBlock
+
+	// Block and transaction currently being applied, used to stamp treasury journal entries
+	blockHeight int
+	blockTime   time.Time
+	txID        string
+	ownEvents   *eventBlock // Event block started by this state, the only one it appends to
+}
+
+// Cached state for the global Blockchain, rebuilt whenever the tip changes
+var chainState *ChainState
+
+// NewChainState creates an empty state ready to apply a genesis block
+func NewChainState() *ChainState {
+	return &ChainState{
+		Height:   -1,
+		Balances: make(map[string]*big.Int),
+		Nonces:   make(map[string]int),
+		Minted:   big.NewInt(0),
+		Burnt:    big.NewInt(0),
+		Genesis:  big.NewInt(0),
+		Treasury: NewCoalitionTreasury(),
+
+		Publishers: make(map[string]*ApprovedPublisher),
+		Approvals:  make(map[string]*WalletApproval),
+
+		ApprovalHistory: make(map[string][]*WalletApproval),
+		Sidechains:      make(map[string]*SidechainAnchor),
+	}
+}
+
+// Copy returns a deep copy of the state so a block can be applied speculatively
+func (s *ChainState) Copy() *ChainState {
+	c := &ChainState{
+		Height:   s.Height,
+		TipHash:  s.TipHash,
+		Balances: make(map[string]*big.Int, len(s.Balances)),
+		Nonces:   make(map[string]int, len(s.Nonces)),
+		Minted:   new(big.Int).Set(s.Minted),
+		Burnt:    new(big.Int).Set(s.Burnt),
+		Genesis:  new(big.Int).Set(s.Genesis),
+
+		LastReward:      s.LastReward,
+		RecentRewards:   append([]BlockReward(nil), s.RecentRewards...),
+		EligibilityPool: append([]string(nil), s.EligibilityPool...),
+		Treasury:        s.Treasury.Copy(),
+
+		Governance: GovernanceSet{
+			Keys:      append([]string(nil), s.Governance.Keys...),
+			Threshold: s.Governance.Threshold,
+		},
+		Publishers: make(map[string]*ApprovedPublisher, len(s.Publishers)),
+		Approvals:  make(map[string]*WalletApproval, len(s.Approvals)),
+
+		ApprovalHistory: make(map[string][]*WalletApproval, len(s.ApprovalHistory)),
+		EventLog:        s.EventLog,
+		Sidechains:      make(map[string]*SidechainAnchor, len(s.Sidechains)),
+	}
+	for id, anchor := range s.Sidechains {
+		c.Sidechains[id] = anchor.Copy()
+	}
+	for address, publisher := range s.Publishers {
+		c.Publishers[address] = publisher.Copy()
+	}
+	for address, approval := range s.Approvals {
+		c.Approvals[address] = approval.Copy()
+	}
+	for address, history := range s.ApprovalHistory {
+		for _, approval := range history {
+			c.ApprovalHistory[address] = append(c.ApprovalHistory[address], approval.Copy())
+		}
+	}
+	if s.DynamicBaseFee != nil {
+		c.DynamicBaseFee = new(big.Int).Set(s.DynamicBaseFee)
+	}
+	for _, scheduled := range s.FeeSchedules {
+		c.FeeSchedules = append(c.FeeSchedules, ScheduledFee{
+			ActivationHeight: scheduled.ActivationHeight,
+			Schedule:         scheduled.Schedule.Copy(),
+		})
+	}
+	for address, balance := range s.Balances {
+		c.Balances[address] = new(big.Int).Set(balance)
+	}
+	for address, nonce := range s.Nonces {
+		c.Nonces[address] = nonce
+	}
+	return c
+}
+
+// BalanceOf returns the balance of an address
+func (s *ChainState) BalanceOf(address string) *big.Int {
+	if balance, exists := s.Balances[address]; exists {
+		return new(big.Int).Set(balance)
+	}
+	return big.NewInt(0)
+}
+
+// credit adds to an account; credits to the coalition are journaled as treasury deposits
+func (s *ChainState) credit(address string, amount *big.Int, entryType JournalEntryType, purpose string) {
+	if amount == nil || amount.Sign() == 0 {
+		return
+	}
+	if address == CoalitionAddress {
+		s.depositTreasury(s.journalEntry(entryType, amount, purpose))
+		return
+	}
+	s.addBalance(address, amount)
+}
+
+// debit subtracts from an account, failing if the account cannot cover the amount
+// Debits from the coalition are journaled as treasury withdrawals
+func (s *ChainState) debit(address string, amount *big.Int, entryType JournalEntryType, purpose string) error {
+	if amount == nil || amount.Sign() == 0 {
+		return nil
+	}
+	if balance := s.BalanceOf(address); balance.Cmp(amount) < 0 {
+		return fmt.Errorf("insufficient funds: %s has %s, needs %s", address, balance.String(), amount.String())
+	}
+	if address == CoalitionAddress {
+		s.withdrawTreasury(s.journalEntry(entryType, amount, purpose))
+		return nil
+	}
+	s.addBalance(address, new(big.Int).Neg(amount))
+	return nil
+}
+
+// depositTreasury credits the coalition account and journals the entry
+func (s *ChainState) depositTreasury(entry TreasuryTransaction) {
+	s.addBalance(CoalitionAddress, entry.Amount)
+	s.Treasury.deposit(entry)
+}
+
+// withdrawTreasury debits the coalition account and journals the entry
+func (s *ChainState) withdrawTreasury(entry TreasuryTransaction) {
+	s.addBalance(CoalitionAddress, new(big.Int).Neg(entry.Amount))
+	s.Treasury.withdraw(entry)
+}
+
+// addBalance adds a signed amount to an account
+func (s *ChainState) addBalance(address string, amount *big.Int) {
+	if _, exists := s.Balances[address]; !exists {
+		s.Balances[address] = big.NewInt(0)
+	}
+	s.Balances[address].Add(s.Balances[address], amount)
+}
+
+// journalEntry creates a treasury journal entry stamped with the block and
+// transaction being applied
+func (s *ChainState) journalEntry(entryType JournalEntryType, amount *big.Int, purpose string) TreasuryTransaction {
+	return TreasuryTransaction{
+		Type:      entryType,
+		Amount:    new(big.Int).Set(amount),
+		Purpose:   purpose,
+		Height:    s.blockHeight,
+		TxID:      s.txID,
+		Timestamp: s.blockTime,
+	}
+}
+
+// ApplyBlock applies a block's transfers, fees and rewards to the state
+// The supply invariant is checked after every block
+func (s *ChainState) ApplyBlock(block Block) error {
+	fees, tips, err := s.applyBlockBody(block)
+	if err != nil {
+		return err
+	}
+	return s.finishBlock(block, fees, tips)
+}
+
+// applyBlockBody applies a block's transactions and sidechain headers, returning
+// W and the tips they paid. Genesis blocks pay neither
+func (s *ChainState) applyBlockBody(block Block) (*big.Int, *big.Int, error) {
+	if block.Index != s.Height+1 {
+		return nil, nil, fmt.Errorf("block %d applied on top of height %d", block.Index, s.Height)
+	}
+	s.blockHeight = block.Index
+	s.blockTime = ParseBlockTimestamp(block.Timestamp)
+	s.LastSponsorFallbacks = nil
+
+	if block.Index == 0 {
+		return nil, nil, s.applyGenesis(block)
+	}
+	if !s.IsEligibleProposer(block.Validator) {
+		return nil, nil, fmt.Errorf("proposer %s is not among the last %d unique senders", block.Validator, EligibilityPoolSize)
+	}
+
+	// The base-fee portion of each fee goes into W, anything above it is a tip
+	feeSchedule := s.NextFeeSchedule()
+	fees := big.NewInt(0)
+	tips := big.NewInt(0)
+	for _, tx := range block.Transactions {
+		if tx.ID != tx.CalculateHash() {
+			return nil, nil, fmt.Errorf("transaction %s: ID does not match contents", tx.ID)
+		}
+		if err := checkTransactionAuthorization(tx); err != nil {
+			return nil, nil, fmt.Errorf("transaction %s: %v", tx.ID, err)
+		}
+		required := feeSchedule.FeeFor(tx)
+		if tx.Fee == nil || tx.Fee.Cmp(required) < 0 {
+			return nil, nil, fmt.Errorf("transaction %s: fee below schedule, required %s", tx.ID, required.String())
+		}
+		// The treasury pays exactly the scheduled fee, never a tip
+		if (tx.Sender == CoalitionAddress || tx.IsSponsored) && tx.Fee.Cmp(required) > 0 {
+			return nil, nil, fmt.Errorf("transaction %s: coalition-paid fee %s above schedule %s", tx.ID, tx.Fee.String(), required.String())
+		}
+		s.txID = tx.ID
+		if err := s.applyTransaction(tx, block.Index); err != nil {
+			return nil, nil, fmt.Errorf("transaction %s: %v", tx.ID, err)
+		}
+		s.recordParticipant(tx.Sender)
+		fees.Add(fees, required)
+		tips.Add(tips, new(big.Int).Sub(tx.Fee, required))
+	}
+
+	s.txID = ""
+
+	headerFees, err := s.applySidechainHeaders(block, feeSchedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	fees.Add(fees, headerFees)
+	return fees, tips, nil
+}
+
+// finishBlock credits the reward for the fees a block paid, advances the tip
+// and checks the supply invariant and the treasury
+func (s *ChainState) finishBlock(block Block, fees, tips *big.Int) error {
+	if block.Index > 0 {
+		reward := CalculateBlockReward(fees, tips)
+		s.LastReward = reward
+		s.RecentRewards = append(s.RecentRewards, reward)
+		if len(s.RecentRewards) > SolvencyWindow {
+			s.RecentRewards = s.RecentRewards[len(s.RecentRewards)-SolvencyWindow:]
+		}
+		s.Minted.Add(s.Minted, reward.Generated)
+		s.credit(block.Validator, reward.Miner, JournalMinerReward, "Miner reward")
+		s.credit(CoalitionAddress, reward.Coalition, JournalRewardShare, "Block Reward Share")
+		s.Burnt.Add(s.Burnt, reward.Burnt)
+	}
+
+	s.Height = block.Index
+	s.TipHash = block.Hash
+	s.updateDynamicBaseFee(block)
+
+	if err := CheckSupplyInvariant(s); err != nil {
+		return err
+	}
+	return checkTreasuryConsistency(s)
+}
+
+// applyGenesis mints every genesis transaction to its recipient
+// and installs the governance key set
+func (s *ChainState) applyGenesis(block Block) error {
+	for _, tx := range block.Transactions {
+		if tx.ID != tx.CalculateHash() {
+			return fmt.Errorf("transaction %s: ID does not match contents", tx.ID)
+		}
+		if tx.Type == TxGovernanceSet {
+			if err := s.applyGovernanceSet(tx); err != nil {
+				return fmt.Errorf("transaction %s: %v", tx.ID, err)
+			}
+			continue
+		}
+		if tx.Amount == nil {
+			continue
+		}
+		s.txID = tx.ID
+		s.credit(tx.Recipient, tx.Amount, JournalGenesis, "Genesis allocation")
+		s.Minted.Add(s.Minted, tx.Amount)
+		s.Genesis.Add(s.Genesis, tx.Amount)
+	}
+	s.txID = ""
+	return nil
+}
+
+// applyTransaction moves the amount to the recipient and collects the fee
+// from the sender, or from the coalition when the transaction is sponsored
+func (s *ChainState) applyTransaction(tx *Transaction, height int) error {
+	if tx.Amount != nil && tx.Amount.Sign() < 0 {
+		return fmt.Errorf("negative amount %s", tx.Amount.String())
+	}
+	if tx.Fee != nil && tx.Fee.Sign() < 0 {
+		return fmt.Errorf("negative fee %s", tx.Fee.String())
+	}
+	if tx.Nonce != s.Nonces[tx.Sender] {
+		return fmt.Errorf("nonce %d out of order, next nonce for %s is %d", tx.Nonce, tx.Sender, s.Nonces[tx.Sender])
+	}
+	s.Nonces[tx.Sender]++
+
+	// Coalition funds only move through governance and treasury transactions
+	if isCoalitionType(tx.Type) != (tx.Sender == CoalitionAddress) {
+		return fmt.Errorf("%s can only send governance and treasury transactions", CoalitionAddress)
+	}
+	// Their payloads say what moves, so the transaction itself carries nothing
+	if isCoalitionType(tx.Type) && ((tx.Amount != nil && tx.Amount.Sign() != 0) || tx.Recipient != CoalitionAddress) {
+		return fmt.Errorf("%s transactions must send 0 to %s", tx.Type, CoalitionAddress)
+	}
+	// The treasury pays every coalition transaction's fee, so none is unauthenticated:
+	// governance changes need the threshold, treasury steps at least one member whose
+	// signature the withdrawal then counts towards its own threshold
+	if isGovernanceType(tx.Type) {
+		if !s.IsGovernanceAuthorized(tx) {
+			return fmt.Errorf("not authorized by %d of %d governance keys", s.Governance.Threshold, len(s.Governance.Keys))
+		}
+	} else if isCoalitionType(tx.Type) && len(tx.ValidCoSigners(s.Governance.IsMember)) == 0 {
+		return fmt.Errorf("not signed by a governance member")
+	}
+
+	var err error
+	switch tx.Type {
+	case TxTransfer:
+	case TxFeeScheduleUpdate:
+		err = s.applyFeeScheduleUpdate(tx, height)
+	case TxPublisherApproval:
+		err = s.applyPublisherApproval(tx)
+	case TxPublisherRemoval:
+		err = s.applyPublisherRemoval(tx)
+	case TxWalletApproval:
+		err = s.applyWalletApproval(tx)
+	case TxWalletRevocation:
+		err = s.applyWalletRevocation(tx)
+	case TxFundedAction:
+		err = s.applyFundedAction(tx)
+	case TxSidechainRegistration:
+		err = s.applySidechainRegistration(tx)
+	case TxSidechainValidatorRotation:
+		err = s.applySidechainValidatorRotation(tx)
+	case TxSidechainAnchor:
+		err = s.applySidechainAnchor(tx)
+	case TxBridgeDeposit:
+		err = s.applyBridgeDeposit(tx)
+	case TxBridgeWithdrawal:
+		err = s.applyBridgeWithdrawal(tx)
+	case TxBridgeRelease:
+		err = s.applyBridgeRelease(tx)
+	case TxSidechainFraudProof:
+		err = s.applyFraudProof(tx)
+	case TxTreasuryProposal:
+		err = s.applyWithdrawalProposal(tx)
+	case TxTreasurySignature:
+		err = s.applyWithdrawalSignature(tx)
+	case TxTreasuryExecution:
+		err = s.applyWithdrawalExecution(tx)
+	default:
+		err = fmt.Errorf("unknown transaction type %q", tx.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Funded actions move the amount out of the treasury when applied
+	if tx.Type != TxFundedAction {
+		if err := s.debit(tx.Sender, tx.Amount, JournalTransfer, fmt.Sprintf("Transfer to %s", tx.Recipient)); err != nil {
+			return err
+		}
+		s.credit(tx.Recipient, tx.Amount, JournalTransfer, fmt.Sprintf("Transfer from %s", tx.Sender))
+	}
+
+	sponsored := tx.IsSponsored
+	if sponsored {
+		publisher, approved := s.Publishers[tx.Publisher]
+		if !approved {
+			return fmt.Errorf("publisher %s is not approved for sponsorship", tx.Publisher)
+		}
+
+		// Over its limits the publisher's transaction falls back to sender-paid
+		if err := publisher.checkSponsorshipLimits(tx.Fee, height); err != nil {
+			publisher.recordFallback(err, height)
+			s.LastSponsorFallbacks = append(s.LastSponsorFallbacks, tx.ID)
+			sponsored = false
+		} else {
+			publisher.recordSponsorship(tx.Fee, height)
+		}
+	}
+
+	if tx.FeePayer != "" {
+		return s.chargeFeePayer(tx)
+	}
+	if sponsored {
+		if err := s.debit(CoalitionAddress, tx.Fee, JournalSponsorship, fmt.Sprintf("Fee sponsorship for %s", tx.Publisher)); err != nil {
+			return fmt.Errorf("coalition treasury cannot cover sponsored fee: %v", err)
+		}
+		if tx.Fee != nil {
+			if _, exists := s.Treasury.SponsoredFees[tx.Publisher]; !exists {
+				s.Treasury.SponsoredFees[tx.Publisher] = big.NewInt(0)
+			}
+			s.Treasury.SponsoredFees[tx.Publisher].Add(s.Treasury.SponsoredFees[tx.Publisher], tx.Fee)
+		}
+		return nil
+	}
+	return s.debit(tx.Sender, tx.Fee, JournalFee, "Transaction fee")
+}
+
+// chargeFeePayer collects a transaction's fee from the paymaster that countersigned it
+func (s *ChainState) chargeFeePayer(tx *Transaction) error {
+	if tx.IsSponsored {
+		return fmt.Errorf("transaction cannot be both coalition sponsored and paid by %s", tx.FeePayer)
+	}
+	if tx.FeePayer == CoalitionAddress {
+		return fmt.Errorf("%s sponsors fees through approved publishers", CoalitionAddress)
+	}
+	if !tx.VerifyFeePayer() {
+		return fmt.Errorf("invalid fee payer signature from %s", tx.FeePayer)
+	}
+	return s.debit(tx.FeePayer, tx.Fee, JournalFee, fmt.Sprintf("Transaction fee for %s", tx.Sender))
+}
+
+// checkTreasuryConsistency verifies the treasury view matches the coalition account
+func checkTreasuryConsistency(s *ChainState) error {
+	balance := s.BalanceOf(CoalitionAddress)
+	if s.Treasury.Balance.Cmp(balance) != 0 {
+		return fmt.Errorf("treasury balance %s does not match coalition account %s at height %d",
+			s.Treasury.Balance.String(), balance.String(), s.Height)
+	}
+
+	net := new(big.Int).Sub(s.Treasury.TotalReceived, s.Treasury.TotalSpent)
+	if net.Cmp(balance) != 0 {
+		return fmt.Errorf("treasury received minus spent is %s, balance is %s at height %d",
+			net.String(), balance.String(), s.Height)
+	}
+
+	if last, exists := s.Treasury.LastEntry(); exists && last.Balance.Cmp(balance) != 0 {
+		return fmt.Errorf("treasury journal balance %s does not match coalition account %s at height %d",
+			last.Balance.String(), balance.String(), s.Height)
+	}
+	return nil
+}
+
+// recordParticipant moves a sender to the most recent end of the eligibility pool
+func (s *ChainState) recordParticipant(address string) {
+	for i, existing := range s.EligibilityPool {
+		if existing == address {
+			s.EligibilityPool = append(s.EligibilityPool[:i], s.EligibilityPool[i+1:]...)
+			break
+		}
+	}
+	s.EligibilityPool = append(s.EligibilityPool, address)
+	if len(s.EligibilityPool) > EligibilityPoolSize {
+		s.EligibilityPool = s.EligibilityPool[len(s.EligibilityPool)-EligibilityPoolSize:]
+	}
+}
+
+// IsEligibleProposer checks whether an address may propose the next block
+// Any proposer is accepted while the pool is still empty after genesis
+func (s *ChainState) IsEligibleProposer(address string) bool {
+	if len(s.EligibilityPool) == 0 {
+		return true
+	}
+	for _, participant := range s.EligibilityPool {
+		if participant == address {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildState replays a chain from genesis and returns the resulting state
+func BuildState(chain []Block) (*ChainState, error) {
+	state := NewChainState()
+	for _, block := range chain {
+		if err := state.ApplyBlock(block); err != nil {
+			return nil, fmt.Errorf("height %d: %v", block.Index, err)
+		}
+	}
+	return state, nil
+}
+
+// CurrentState returns the state at the tip of the global Blockchain
+func CurrentState() (*ChainState, error) {
+	if len(Blockchain) == 0 {
+		return NewChainState(), nil
+	}
+
+	tip := Blockchain[len(Blockchain)-1]
+	if chainState == nil || chainState.Height != tip.Index || chainState.TipHash != tip.Hash {
+		state, err := BuildState(Blockchain)
+		if err != nil {
+			return nil, err
+		}
+		chainState = state
+	}
+	return chainState, nil
+}
@@ -9,9 +9,63 @@ import (
 	"math/big"
 )
 
+// TxType identifies how a transaction is applied to the chain state
+type TxType string
+
+const (
+	// TxTransfer is a plain value transfer (the default)
+	TxTransfer TxType = ""
+	// TxFeeScheduleUpdate is a governance transaction scheduling a new fee schedule
+	TxFeeScheduleUpdate TxType = "fee_schedule_update"
+	// TxGovernanceSet installs the coalition governance key set (genesis only)
+	TxGovernanceSet TxType = "governance_set"
+	// TxPublisherApproval is a governance transaction approving a publisher for sponsorship
+	TxPublisherApproval TxType = "publisher_approval"
+	// TxPublisherRemoval is a governance transaction removing a publisher's approval
+	TxPublisherRemoval TxType = "publisher_removal"
+	// TxTreasuryProposal proposes a multisig withdrawal from the coalition treasury
+	TxTreasuryProposal TxType = "treasury_proposal"
+	// TxTreasurySignature adds governance signatures to a proposed withdrawal
+	TxTreasurySignature TxType = "treasury_signature"
+	// TxTreasuryExecution executes a signed withdrawal after its time lock
+	TxTreasuryExecution TxType = "treasury_execution"
+	// TxWalletApproval is a governance transaction approving a wallet for funded operations (VEP2)
+	TxWalletApproval TxType = "wallet_approval"
+	// TxWalletRevocation is a governance transaction revoking a wallet's approval
+	TxWalletRevocation TxType = "wallet_revocation"
+	// TxFundedAction is an approved wallet's action paid for by the coalition treasury
+	TxFundedAction TxType = "funded_action"
+	// TxSidechainRegistration registers a sidechain and its federated validator set
+	TxSidechainRegistration TxType = "sidechain_registration"
+	// TxSidechainValidatorRotation schedules a new validator set for a registered sidechain
+	TxSidechainValidatorRotation TxType = "sidechain_validator_rotation"
+	// TxSidechainAnchor anchors a signed sidechain header, its sender paying the anchoring fee
+	TxSidechainAnchor TxType = "sidechain_anchor"
+	// TxBridgeDeposit locks coins in a sidechain's bridge escrow to be minted on the sidechain
+	TxBridgeDeposit TxType = "bridge_deposit"
+	// TxBridgeWithdrawal claims a sidechain burn proven against an anchored header
+	TxBridgeWithdrawal TxType = "bridge_withdrawal"
+	// TxBridgeRelease releases a claimed withdrawal from escrow after its challenge period
+	TxBridgeRelease TxType = "bridge_release"
+	// TxBridgeMint mints a main-chain deposit on a sidechain (sidechain only)
+	TxBridgeMint TxType = "bridge_mint"
+	// TxBridgeBurn burns sidechain coins for withdrawal to the main chain (sidechain only)
+	TxBridgeBurn TxType = "bridge_burn"
+	// TxSidechainFraudProof proves an anchored sidechain range contains an invalid transaction
+	TxSidechainFraudProof TxType = "sidechain_fraud_proof"
+)
+
+// CoSignature is an additional signature over a transaction's hash,
+// used where a transaction must be authorized by several keys
+type CoSignature struct {
+	Signer    string // Wallet address of the signer
+	Signature string
+}
+
 // Transaction represents a transfer of value or data
 type Transaction struct {
 	ID          string
+	Type        TxType
 	Sender      string
 	Recipient   string
 	Amount      *big.Int
@@ -21,6 +75,11 @@ type Transaction struct {
 	Publisher   string   // Publisher address (if transaction is from a publisher)
 	IsSponsored bool     // Whether coalition pays the fee
 	Fee         *big.Int // Transaction fee amount
+
+	FeePayer          string // Paymaster paying the fee instead of the sender, if any
+	FeePayerSignature string // Paymaster's signature over the transaction hash and fee
+
+	CoSignatures []CoSignature // Multi-party authorization (e.g. governance M-of-N)
 }
 
 // NewTransaction creates a new transaction
@@ -37,8 +96,11 @@ func NewTransaction(sender, recipient string, amount *big.Int, nonce int, payloa
 }
 
 // CalculateHash calculates the hash of the transaction
+// The fee and sponsorship are included so signatures and co-signatures commit to who pays what.
+// Fields are delimited and strings quoted so no two transactions share a record
 func (tx *Transaction) CalculateHash() string {
-	record := fmt.Sprintf("%s%s%s%d%s", tx.Sender, tx.Recipient, tx.Amount.String(), tx.Nonce, tx.Payload)
+	record := fmt.Sprintf("%q|%q|%s|%d|%q|%q|%q|%s|%t|%q", tx.Sender, tx.Recipient, tx.Amount.String(), tx.Nonce, tx.Payload, tx.Type,
+		tx.FeePayer, tx.Fee.String(), tx.IsSponsored, tx.Publisher)
 	h := sha256.New()
 	h.Write([]byte(record))
 	return hex.EncodeToString(h.Sum(nil))
@@ -51,71 +113,148 @@ func (tx *Transaction) SignTransaction(privateKey *ecdsa.PrivateKey) error {
 	if err != nil {
 		return err
 	}
-	signature := append(r.Bytes(), s.Bytes()...)
-	tx.Signature = hex.EncodeToString(signature)
+	tx.Signature = hex.EncodeToString(encodeComponents(r, s))
 	return nil
 }
 
-// VerifyTransaction verifies the transaction signature
-// Note: This is a simplified verification for demonstration.
-// Real ECDSA verification requires parsing the signature back to r, s and the public key from hex.
+// VerifyTransaction verifies the transaction signature against the sender's address
 func (tx *Transaction) VerifyTransaction() bool {
-	// In a full implementation, we would decode the sender's address (public key)
-	// and verify the signature against the hash.
-	// For this prototype, we assume valid if signature is present.
-	return tx.Signature != ""
+	return VerifySignature(tx.Sender, []byte(tx.CalculateHash()), tx.Signature)
 }
 
-// CalculateFee determines the transaction fee based on size and complexity
-// Base fee + data size fee
-func (tx *Transaction) CalculateFee() *big.Int {
-	baseFee := big.NewInt(1) // 1 coin base fee
+// AddCoSignature signs the transaction's hash with a wallet and attaches the signature
+func (tx *Transaction) AddCoSignature(wallet *Wallet) error {
+	signature, err := wallet.Sign([]byte(tx.CalculateHash()))
+	if err != nil {
+		return err
+	}
+	tx.CoSignatures = append(tx.CoSignatures, CoSignature{Signer: wallet.GetAddress(), Signature: signature})
+	return nil
+}
 
-	// Add fee based on payload size (1 coin per 100 bytes)
-	payloadSize := len(tx.Payload)
-	dataSizeFee := big.NewInt(int64(payloadSize / 100))
+// ValidCoSigners returns the distinct signers accepted by allowed whose co-signature is valid
+func (tx *Transaction) ValidCoSigners(allowed func(address string) bool) []string {
+	return validCoSigners([]byte(tx.CalculateHash()), tx.CoSignatures, allowed)
+}
 
-	totalFee := new(big.Int).Add(baseFee, dataSizeFee)
-	return totalFee
+// validCoSigners returns the distinct signers accepted by allowed whose signature over data is valid
+func validCoSigners(data []byte, cosigs []CoSignature, allowed func(address string) bool) []string {
+	seen := make(map[string]bool)
+	var signers []string
+	for _, cosig := range cosigs {
+		if seen[cosig.Signer] || !allowed(cosig.Signer) {
+			continue
+		}
+		if VerifySignature(cosig.Signer, data, cosig.Signature) {
+			seen[cosig.Signer] = true
+			signers = append(signers, cosig.Signer)
+		}
+	}
+	return signers
+}
+
+// CalculateFee determines the transaction fee based on size and complexity
+// using the fee schedule active for the next block
+func (tx *Transaction) CalculateFee() *big.Int {
+	return ActiveFeeSchedule().FeeFor(tx)
 }
 
 // ApplyCoalitionSponsorship checks if the publisher is approved and applies sponsorship
-// Returns true if sponsorship was applied, false otherwise
+// Returns true if sponsorship was applied, false otherwise. Sponsorship is signed, so sign after this
 func (tx *Transaction) ApplyCoalitionSponsorship() bool {
 	// If no publisher specified, cannot be sponsored
-	if tx.Publisher == "" {
-		tx.IsSponsored = false
-		return false
+	tx.IsSponsored = tx.Publisher != "" && IsPublisherApproved(tx.Publisher)
+	tx.ID = tx.CalculateHash()
+	return tx.IsSponsored
+}
+
+// SetPublisher sets the publisher for this transaction and checks sponsorship
+// Unless the publisher is the sender, it countersigns with SignAsPublisher
+func (tx *Transaction) SetPublisher(publisherAddress string) {
+	tx.Publisher = publisherAddress
+	tx.ApplyCoalitionSponsorship()
+}
+
+// SignAsPublisher countersigns a sponsored transaction with the publisher's wallet,
+// authorizing the coalition to pay its fee against the publisher's budget
+func (tx *Transaction) SignAsPublisher(wallet *Wallet) error {
+	if tx.Publisher != wallet.GetAddress() {
+		return fmt.Errorf("wallet %s is not the publisher %s", wallet.GetAddress(), tx.Publisher)
 	}
+	return tx.AddCoSignature(wallet)
+}
 
-	// Check if publisher is approved
-	if IsPublisherApproved(tx.Publisher) {
-		tx.IsSponsored = true
+// VerifyPublisher checks the publisher sent or countersigned the transaction
+func (tx *Transaction) VerifyPublisher() bool {
+	if tx.Sender == tx.Publisher {
 		return true
 	}
+	return len(tx.ValidCoSigners(func(address string) bool { return address == tx.Publisher })) > 0
+}
 
+// SetFeePayer names a paymaster that pays the fee instead of the sender
+// The sender signs the transaction including the payer, then the payer countersigns with SignAsFeePayer
+func (tx *Transaction) SetFeePayer(payerAddress string) {
+	tx.FeePayer = payerAddress
 	tx.IsSponsored = false
-	return false
+	tx.ID = tx.CalculateHash()
 }
 
-// SetPublisher sets the publisher for this transaction and checks sponsorship
-func (tx *Transaction) SetPublisher(publisherAddress string) {
-	tx.Publisher = publisherAddress
-	tx.ApplyCoalitionSponsorship()
+// feePayerDigest is the data a paymaster signs, committing to the fee it pays
+// It is hashed because signatures only cover the first 32 bytes of the data
+func (tx *Transaction) feePayerDigest() []byte {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", tx.CalculateHash(), tx.Fee.String())))
+	return digest[:]
+}
+
+// SignAsFeePayer countersigns the transaction with the paymaster's wallet
+func (tx *Transaction) SignAsFeePayer(wallet *Wallet) error {
+	if tx.FeePayer != wallet.GetAddress() {
+		return fmt.Errorf("wallet %s is not the fee payer %s", wallet.GetAddress(), tx.FeePayer)
+	}
+	if tx.Fee == nil {
+		return fmt.Errorf("fee must be set before the payer signs")
+	}
+	signature, err := wallet.Sign(tx.feePayerDigest())
+	if err != nil {
+		return err
+	}
+	tx.FeePayerSignature = signature
+	return nil
+}
+
+// VerifyFeePayer checks the paymaster's countersignature
+func (tx *Transaction) VerifyFeePayer() bool {
+	return tx.Fee != nil && VerifySignature(tx.FeePayer, tx.feePayerDigest(), tx.FeePayerSignature)
 }
 
 // ProcessTransactionFee handles the transaction fee payment
-// For sponsored transactions, coalition pays. Otherwise, sender pays.
-// Returns true if fee was successfully processed
+// For sponsored transactions, coalition pays; with a fee payer, the paymaster pays.
+// Otherwise, sender pays. Returns true if fee was successfully processed
 func (tx *Transaction) ProcessTransactionFee() bool {
-	// Calculate fee if not already set
+	// Calculate fee if not already set; the fee is signed, so sign after this
 	if tx.Fee == nil {
 		tx.Fee = tx.CalculateFee()
+		tx.ID = tx.CalculateHash()
+	}
+
+	if tx.FeePayer != "" {
+		// Paymaster's balance is charged when the block is applied
+		if balance := GetBalance(tx.FeePayer); balance.Cmp(tx.Fee) < 0 {
+			fmt.Printf("Fee payer %s cannot cover fee %s, balance %s\n", tx.FeePayer, tx.Fee.String(), balance.String())
+			return false
+		}
+		return true
 	}
 
 	if tx.IsSponsored {
-		// Coalition sponsors the fee
-		return SponsorTransactionFee(tx.Publisher, tx.Fee)
+		// Coalition sponsors the fee, withdrawn from the treasury when the block is applied.
+		// If the publisher is over its sponsorship limits the sender pays instead.
+		if !CanSponsorTransactionFee(tx.Publisher, tx.Fee) {
+			tx.IsSponsored = false
+			tx.ID = tx.CalculateHash()
+		}
+		return true
 	}
 
 	// Non-sponsored: fee will be deducted from sender's balance during block validation
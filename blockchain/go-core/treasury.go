@@ -1,45 +1,289 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"time"
+	"math/big"
 )
 
-// ApprovalRegistry manages wallet approvals for funded operations
-type ApprovalRegistry struct {
-	Approvals map[string]string // WalletAddress -> ApprovalHash
+// WalletApproval is a VEP2 approval for treasury-funded operations
+// Approvals are granted by governance transactions and live in chain state
+type WalletApproval struct {
+	Wallet         string
+	Hash           string   // ID of the approving transaction, presented with funded actions
+	Scope          []string // Services or actions covered, empty covers all
+	SpendingCap    *big.Int // Total the wallet may draw from the treasury, nil for no cap
+	Spent          *big.Int
+	ExpiryHeight   int // First height at which the approval is no longer valid
+	ApprovedHeight int
+	CoSignatures   []CoSignature // Governance signatures over Hash
+
+	RevokedHeight  int    // Height of the revoking block, 0 while not revoked
+	RevocationHash string // ID of the revoking transaction
+	GraceHeight    int    // First height at which the revocation takes effect
+}
+
+// WalletApprovalGrant is the payload of a TxWalletApproval transaction
+type WalletApprovalGrant struct {
+	Wallet       string
+	Scope        []string
+	SpendingCap  *big.Int
+	ExpiryHeight int
+}
+
+// WalletRevocation is the payload of a TxWalletRevocation transaction
+// In-flight funded actions stay valid until GraceHeight; 0 revokes immediately.
+type WalletRevocation struct {
+	Wallet      string
+	GraceHeight int
+}
+
+// Copy returns a deep copy of the approval
+func (a *WalletApproval) Copy() *WalletApproval {
+	c := *a
+	c.Scope = append([]string(nil), a.Scope...)
+	if a.SpendingCap != nil {
+		c.SpendingCap = new(big.Int).Set(a.SpendingCap)
+	}
+	c.Spent = new(big.Int).Set(a.Spent)
+	c.CoSignatures = append([]CoSignature(nil), a.CoSignatures...)
+	return &c
+}
+
+// IsRevoked checks whether the approval is revoked at a height
+func (a *WalletApproval) IsRevoked(height int) bool {
+	return a.RevocationHash != "" && height >= a.GraceHeight
+}
+
+// Remaining returns the unspent allowance, or nil if the approval has no cap
+func (a *WalletApproval) Remaining() *big.Int {
+	if a.SpendingCap == nil {
+		return nil
+	}
+	remaining := new(big.Int).Sub(a.SpendingCap, a.Spent)
+	if remaining.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return remaining
+}
+
+// Covers checks whether a service or action is within the approval's scope
+func (a *WalletApproval) Covers(scope string) bool {
+	if len(a.Scope) == 0 {
+		return true
+	}
+	for _, s := range a.Scope {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWalletApprovalTransaction creates a governance transaction approving a wallet
+// for treasury-funded operations. The transaction ID is the approval hash.
+func NewWalletApprovalTransaction(nonce int, grant WalletApprovalGrant) (*Transaction, error) {
+	return newGovernanceTransaction(TxWalletApproval, nonce, grant)
 }
 
-// Global registry instance
-var Registry = ApprovalRegistry{
-	Approvals: make(map[string]string),
+// NewWalletRevocationTransaction creates a governance transaction revoking a wallet's approval
+// from graceHeight, or from its own block if graceHeight is 0
+func NewWalletRevocationTransaction(nonce int, wallet string, graceHeight int) (*Transaction, error) {
+	return newGovernanceTransaction(TxWalletRevocation, nonce, WalletRevocation{Wallet: wallet, GraceHeight: graceHeight})
 }
 
-// ApproveWallet grants approval to a wallet and returns the approval hash
-// In a real contract, this would be called by the Treasury
-func (r *ApprovalRegistry) ApproveWallet(walletAddress string) string {
-	timestamp := time.Now().String()
-	data := fmt.Sprintf("%s:%s", walletAddress, timestamp)
+// FundedAction is the payload of a TxFundedAction transaction
+type FundedAction struct {
+	ApprovalHash string
+	Scope        string // Service or action being funded
+}
+
+// NewFundedActionTransaction creates a transaction in which the treasury pays amount to
+// recipient on behalf of an approved wallet, mirroring executeFundedAction in
+// VuserApprovalRegistry.sol. The wallet signs it and pays the fee.
+func NewFundedActionTransaction(wallet, recipient string, amount *big.Int, nonce int, approvalHash, scope string) (*Transaction, error) {
+	data, err := json.Marshal(FundedAction{ApprovalHash: approvalHash, Scope: scope})
+	if err != nil {
+		return nil, err
+	}
+	tx := NewTransaction(wallet, recipient, amount, nonce, string(data))
+	tx.Type = TxFundedAction
+	tx.ID = tx.CalculateHash()
+	return tx, nil
+}
+
+// applyWalletApproval records an approval, moving any earlier approval for the wallet
+// to its history
+func (s *ChainState) applyWalletApproval(tx *Transaction) error {
+	var grant WalletApprovalGrant
+	if err := json.Unmarshal([]byte(tx.Payload), &grant); err != nil {
+		return fmt.Errorf("invalid wallet approval payload: %v", err)
+	}
+	if grant.Wallet == "" {
+		return fmt.Errorf("wallet approval needs a wallet")
+	}
+	if grant.ExpiryHeight <= s.blockHeight {
+		return fmt.Errorf("approval expiry height %d must be after inclusion height %d", grant.ExpiryHeight, s.blockHeight)
+	}
+	if grant.SpendingCap != nil && grant.SpendingCap.Sign() < 0 {
+		return fmt.Errorf("negative spending cap %s", grant.SpendingCap.String())
+	}
 
-	h := sha256.New()
-	h.Write([]byte(data))
-	approvalHash := hex.EncodeToString(h.Sum(nil))
+	approval := &WalletApproval{
+		Wallet:         grant.Wallet,
+		Hash:           tx.ID,
+		Scope:          append([]string(nil), grant.Scope...),
+		Spent:          big.NewInt(0),
+		ExpiryHeight:   grant.ExpiryHeight,
+		ApprovedHeight: s.blockHeight,
+		CoSignatures:   append([]CoSignature(nil), tx.CoSignatures...),
+	}
+	if grant.SpendingCap != nil {
+		approval.SpendingCap = new(big.Int).Set(grant.SpendingCap)
+	}
+	if previous, exists := s.Approvals[grant.Wallet]; exists {
+		s.ApprovalHistory[grant.Wallet] = append(s.ApprovalHistory[grant.Wallet], previous)
+	}
+	s.Approvals[grant.Wallet] = approval
+	s.emit(EventApprovalGranted, tx.ID, map[string]string{"wallet": grant.Wallet, "txHash": tx.ID})
+	return nil
+}
+
+// applyWalletRevocation marks a wallet's approval revoked from its grace height
+// The approval stays in state for auditing
+func (s *ChainState) applyWalletRevocation(tx *Transaction) error {
+	var revocation WalletRevocation
+	if err := json.Unmarshal([]byte(tx.Payload), &revocation); err != nil {
+		return fmt.Errorf("invalid wallet revocation payload: %v", err)
+	}
+	approval, exists := s.Approvals[revocation.Wallet]
+	if !exists {
+		return fmt.Errorf("wallet %s has no approval", revocation.Wallet)
+	}
+	if approval.RevocationHash != "" {
+		return fmt.Errorf("approval %s already revoked at height %d", approval.Hash, approval.RevokedHeight)
+	}
+	graceHeight := revocation.GraceHeight
+	if graceHeight == 0 {
+		graceHeight = s.blockHeight
+	} else if graceHeight <= s.blockHeight {
+		return fmt.Errorf("grace height %d must be after inclusion height %d", graceHeight, s.blockHeight)
+	}
 
-	r.Approvals[walletAddress] = approvalHash
-	fmt.Printf("Treasury: Approved wallet %s with hash %s\n", walletAddress, approvalHash)
-	return approvalHash
+	approval.RevokedHeight = s.blockHeight
+	approval.RevocationHash = tx.ID
+	approval.GraceHeight = graceHeight
+	s.emit(EventApprovalRevoked, tx.ID, map[string]string{
+		"wallet":       revocation.Wallet,
+		"txHash":       tx.ID,
+		"approvalHash": approval.Hash,
+		"graceHeight":  fmt.Sprintf("%d", graceHeight),
+	})
+	return nil
 }
 
-// RevokeWallet revokes approval for a wallet
-func (r *ApprovalRegistry) RevokeWallet(walletAddress string) {
-	delete(r.Approvals, walletAddress)
-	fmt.Printf("Treasury: Revoked approval for wallet %s\n", walletAddress)
+// applyFundedAction checks the sender's approval and pays the amount from the treasury
+func (s *ChainState) applyFundedAction(tx *Transaction) error {
+	var action FundedAction
+	if err := json.Unmarshal([]byte(tx.Payload), &action); err != nil {
+		return fmt.Errorf("invalid funded action payload: %v", err)
+	}
+	amount := tx.Amount
+	if amount == nil {
+		amount = big.NewInt(0)
+	}
+	if err := s.CheckApproval(tx.Sender, action.ApprovalHash, action.Scope, amount, s.blockHeight); err != nil {
+		return fmt.Errorf("invalid or revoked approval: %v", err)
+	}
+	if s.BalanceOf(CoalitionAddress).Cmp(amount) < 0 {
+		return fmt.Errorf("coalition treasury cannot cover funded action of %s", amount.String())
+	}
+
+	approval := s.Approvals[tx.Sender]
+	approval.Spent.Add(approval.Spent, amount)
+	if err := s.debit(CoalitionAddress, amount, JournalFundedAction, fmt.Sprintf("Funded action for %s", tx.Sender)); err != nil {
+		return err
+	}
+	s.credit(tx.Recipient, amount, JournalFundedAction, fmt.Sprintf("Funded action for %s", tx.Sender))
+	return nil
+}
+
+// CheckApproval verifies that a wallet holds the approval with the given hash at a height:
+// it must still carry valid governance signatures, not have expired, cover the scope
+// and have allowance left for amount. An empty scope or nil amount skips that check.
+func (s *ChainState) CheckApproval(wallet, approvalHash, scope string, amount *big.Int, height int) error {
+	approval, exists := s.Approvals[wallet]
+	if !exists {
+		return fmt.Errorf("wallet %s is not approved", wallet)
+	}
+	if approval.Hash != approvalHash {
+		return fmt.Errorf("approval hash %s does not match the latest approval for %s", approvalHash, wallet)
+	}
+	signers := validCoSigners([]byte(approval.Hash), approval.CoSignatures, s.Governance.IsMember)
+	if len(signers) < s.Governance.Threshold {
+		return fmt.Errorf("approval %s has %d of %d governance signatures", approval.Hash, len(signers), s.Governance.Threshold)
+	}
+	if approval.IsRevoked(height) {
+		return fmt.Errorf("approval %s revoked from height %d", approval.Hash, approval.GraceHeight)
+	}
+	if height >= approval.ExpiryHeight {
+		return fmt.Errorf("approval %s expired at height %d", approval.Hash, approval.ExpiryHeight)
+	}
+	if scope != "" && !approval.Covers(scope) {
+		return fmt.Errorf("approval %s does not cover %s", approval.Hash, scope)
+	}
+	if remaining := approval.Remaining(); remaining != nil {
+		if remaining.Sign() == 0 {
+			return fmt.Errorf("approval %s has no allowance left", approval.Hash)
+		}
+		if amount != nil && amount.Cmp(remaining) > 0 {
+			return fmt.Errorf("amount %s exceeds remaining allowance %s", amount.String(), remaining.String())
+		}
+	}
+	return nil
 }
 
 // IsApproved checks if a wallet has a valid approval matching the provided hash
-func (r *ApprovalRegistry) IsApproved(walletAddress string, approvalHash string) bool {
-	storedHash, exists := r.Approvals[walletAddress]
-	return exists && storedHash == approvalHash
+// for the next block
+func IsApproved(walletAddress string, approvalHash string) bool {
+	return IsApprovedFor(walletAddress, approvalHash, "", nil)
+}
+
+// IsApprovedFor checks if a wallet's approval covers a scope and amount for the next block
+func IsApprovedFor(walletAddress, approvalHash, scope string, amount *big.Int) bool {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return false
+	}
+	if err := state.CheckApproval(walletAddress, approvalHash, scope, amount, len(Blockchain)); err != nil {
+		fmt.Println("Approval check failed:", err)
+		return false
+	}
+	return true
+}
+
+// GetWalletApproval returns the current approval for a wallet
+func GetWalletApproval(walletAddress string) (*WalletApproval, bool) {
+	state, err := CurrentState()
+	if err != nil {
+		return nil, false
+	}
+	approval, exists := state.Approvals[walletAddress]
+	return approval, exists
+}
+
+// GetApprovalHistory returns every approval issued to a wallet, oldest first,
+// including revoked and replaced approvals
+func GetApprovalHistory(walletAddress string) []*WalletApproval {
+	state, err := CurrentState()
+	if err != nil {
+		fmt.Println("Error building chain state:", err)
+		return nil
+	}
+	history := append([]*WalletApproval(nil), state.ApprovalHistory[walletAddress]...)
+	if approval, exists := state.Approvals[walletAddress]; exists {
+		history = append(history, approval)
+	}
+	return history
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ChainValidationError reports the first block that failed validation
+type ChainValidationError struct {
+	Height int
+	Reason string
+}
+
+func (e *ChainValidationError) Error() string {
+	return fmt.Sprintf("invalid block at height %d: %s", e.Height, e.Reason)
+}
+
+// ValidateChain replays a chain from genesis and checks hashes, signatures,
+// nonces, balances, proposer eligibility, rewards, sidechain anchors and
+// treasury changes. It returns the state at the tip, or a *ChainValidationError
+// for the first invalid block.
+func ValidateChain(chain []Block) (*ChainState, error) {
+	if len(chain) == 0 {
+		return nil, &ChainValidationError{Height: 0, Reason: "chain is empty"}
+	}
+
+	state := NewChainState()
+	for height, block := range chain {
+		var err error
+		if height == 0 {
+			err = validateGenesis(state, block)
+		} else {
+			state, err = validateNextBlock(state, block, chain[height-1])
+		}
+		if err != nil {
+			return nil, &ChainValidationError{Height: height, Reason: err.Error()}
+		}
+	}
+	return state, nil
+}
+
+// validateGenesis checks the genesis block and applies its allocations
+func validateGenesis(state *ChainState, block Block) error {
+	if block.Index != 0 {
+		return fmt.Errorf("genesis index is %d", block.Index)
+	}
+	if block.PrevHash != "" {
+		return fmt.Errorf("genesis has previous hash %s", block.PrevHash)
+	}
+	if CalculateHash(block) != block.Hash {
+		return fmt.Errorf("hash %s does not match block contents", block.Hash)
+	}
+	return state.ApplyBlock(block)
+}
+
+// validateNextBlock checks a block against its parent and applies it to a copy
+// of the state before it, returning the state after the block. ApplyBlock holds
+// every transaction and proposer rule, so replay and AddBlock accept the same blocks.
+func validateNextBlock(state *ChainState, block, prev Block) (*ChainState, error) {
+	if err := CheckBlockStructure(block, prev); err != nil {
+		return nil, err
+	}
+
+	next := state.Copy()
+	fees, tips, err := next.applyBlockBody(block)
+	if err != nil {
+		return nil, err
+	}
+	// The reward is credited last, so the proposer's balance before it shows what the reward added
+	unrewarded := next.BalanceOf(block.Validator)
+	if err := next.finishBlock(block, fees, tips); err != nil {
+		return nil, err
+	}
+
+	if err := checkReward(state, next, block, new(big.Int).Sub(next.BalanceOf(block.Validator), unrewarded)); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// checkTransactionAuthorization checks the signature or governance authority of a transaction
+func checkTransactionAuthorization(tx *Transaction) error {
+	// Coalition transactions are authorized by governance co-signatures, checked when applied
+	if isCoalitionType(tx.Type) {
+		return nil
+	}
+
+	if tx.Signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+	if !tx.VerifyTransaction() {
+		return fmt.Errorf("signature does not match sender %s", tx.Sender)
+	}
+	if tx.IsSponsored && tx.Publisher == "" {
+		return fmt.Errorf("sponsored without a publisher")
+	}
+	// Otherwise anyone could spend an approved publisher's sponsorship budget
+	if tx.IsSponsored && !tx.VerifyPublisher() {
+		return fmt.Errorf("sponsorship not signed by publisher %s", tx.Publisher)
+	}
+	return nil
+}
+
+// checkAnchoredHeader checks a sidechain header's structure
+// Signatures and continuity are checked against the sidechain's registration when applied
+func checkAnchoredHeader(header SidechainHeader) error {
+	var startBlock, endBlock int
+	if _, err := fmt.Sscanf(header.BlockRange, "%d-%d", &startBlock, &endBlock); err != nil || startBlock > endBlock || startBlock < 0 {
+		return fmt.Errorf("invalid block range")
+	}
+	if header.MerkleRoot == "" || header.StateRoot == "" || header.TraceRoot == "" || header.TransactionCount < 0 {
+		return fmt.Errorf("missing merkle root, state root, trace root or transaction count")
+	}
+	return nil
+}
+
+// checkReward verifies the block generated exactly 9 coins and split them with
+// the fees as 1/3 miner, 1/3 coalition and the rest burnt. The fees are priced
+// from the block's contents by the fee schedule, and credited is what the
+// proposer's balance gained from the reward
+func checkReward(before, after *ChainState, block Block, credited *big.Int) error {
+	minted := new(big.Int).Sub(after.Minted, before.Minted)
+	if minted.Cmp(big.NewInt(BlockGenerationReward)) != 0 {
+		return fmt.Errorf("block minted %s coins, expected %d", minted.String(), BlockGenerationReward)
+	}
+
+	feeSchedule := before.NextFeeSchedule()
+	fees := big.NewInt(0)
+	tips := big.NewInt(0)
+	for _, tx := range block.Transactions {
+		required := feeSchedule.FeeFor(tx)
+		fees.Add(fees, required)
+		tips.Add(tips, new(big.Int).Sub(tx.Fee, required))
+	}
+	for _, header := range block.SidechainHeaders {
+		fee, err := headerAnchoringFee(header, feeSchedule)
+		if err != nil {
+			return err
+		}
+		fees.Add(fees, fee)
+	}
+	expected := CalculateBlockReward(fees, tips)
+
+	if credited.Cmp(expected.Miner) != 0 {
+		return fmt.Errorf("proposer %s was credited %s, the fee schedule gives %s", block.Validator, credited.String(), expected.Miner.String())
+	}
+	reward := after.LastReward
+	if reward.Miner.Cmp(expected.Miner) != 0 || reward.Coalition.Cmp(expected.Coalition) != 0 || reward.Burnt.Cmp(expected.Burnt) != 0 {
+		return fmt.Errorf("reward split miner %s, coalition %s, burnt %s does not follow the 1/3 rule",
+			reward.Miner.String(), reward.Coalition.String(), reward.Burnt.String())
+	}
+
+	burnt := new(big.Int).Sub(after.Burnt, before.Burnt)
+	if burnt.Cmp(expected.Burnt) != 0 {
+		return fmt.Errorf("burnt total grew by %s, expected %s", burnt.String(), expected.Burnt.String())
+	}
+	return nil
+}
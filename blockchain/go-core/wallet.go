@@ -6,8 +6,12 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"math/big"
 )
 
+// Size in bytes of a P-256 coordinate or signature component
+const keyComponentSize = 32
+
 // Wallet represents a user's wallet
 type Wallet struct {
 	PrivateKey *ecdsa.PrivateKey
@@ -21,7 +25,7 @@ func CreateWallet() *Wallet {
 		fmt.Println(err)
 		return nil
 	}
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	public := encodeComponents(private.PublicKey.X, private.PublicKey.Y)
 	return &Wallet{private, public}
 }
 
@@ -36,8 +40,41 @@ func (w *Wallet) Sign(data []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	signature := append(r.Bytes(), s.Bytes()...)
-	return hex.EncodeToString(signature), nil
+	return hex.EncodeToString(encodeComponents(r, s)), nil
+}
+
+// encodeComponents concatenates two values as fixed-size big-endian components
+func encodeComponents(a, b *big.Int) []byte {
+	out := make([]byte, 2*keyComponentSize)
+	a.FillBytes(out[:keyComponentSize])
+	b.FillBytes(out[keyComponentSize:])
+	return out
+}
+
+// decodeComponents splits a hex string into two fixed-size components
+func decodeComponents(encoded string) (*big.Int, *big.Int, bool) {
+	data, err := hex.DecodeString(encoded)
+	if err != nil || len(data) != 2*keyComponentSize {
+		return nil, nil, false
+	}
+	a := new(big.Int).SetBytes(data[:keyComponentSize])
+	b := new(big.Int).SetBytes(data[keyComponentSize:])
+	return a, b, true
+}
+
+// VerifySignature checks a signature over data against a wallet address
+// The address is the hex encoded P-256 public key returned by GetAddress
+func VerifySignature(address string, data []byte, signature string) bool {
+	x, y, ok := decodeComponents(address)
+	if !ok || !elliptic.P256().IsOnCurve(x, y) {
+		return false
+	}
+	r, s, ok := decodeComponents(signature)
+	if !ok {
+		return false
+	}
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return ecdsa.Verify(publicKey, data, r, s)
 }
 
 // TODO: Implement SaveToFile and LoadWallet using gob encoding or similar
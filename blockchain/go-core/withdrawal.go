@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// TreasuryWithdrawalTimelock is the number of blocks between a withdrawal
+// proposal and the earliest height it can be executed
+const TreasuryWithdrawalTimelock = 10
+
+// TreasuryWithdrawal is a multisig spend from the coalition treasury
+type TreasuryWithdrawal struct {
+	ID               string // ID of the proposal transaction
+	Recipient        string
+	Amount           *big.Int
+	Purpose          string
+	ProposedBy       string
+	ProposedHeight   int
+	ExecutableHeight int
+	Signers          []string // Governance members that signed, proposer first
+	Executed         bool
+	ExecutedHeight   int
+}
+
+// WithdrawalProposal is the payload of a TxTreasuryProposal transaction
+type WithdrawalProposal struct {
+	Recipient string
+	Amount    *big.Int
+	Purpose   string
+}
+
+// WithdrawalReference is the payload of signature and execution transactions
+type WithdrawalReference struct {
+	ProposalID string
+}
+
+// Copy returns a deep copy of the withdrawal
+func (w *TreasuryWithdrawal) Copy() *TreasuryWithdrawal {
+	c := *w
+	c.Amount = new(big.Int).Set(w.Amount)
+	c.Signers = append([]string(nil), w.Signers...)
+	return &c
+}
+
+// hasSigner checks whether a member already signed the withdrawal
+func (w *TreasuryWithdrawal) hasSigner(address string) bool {
+	for _, signer := range w.Signers {
+		if signer == address {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWithdrawalProposalTransaction creates a treasury spend proposal
+// The proposing governance member must co-sign it with AddCoSignature
+func NewWithdrawalProposalTransaction(nonce int, recipient string, amount *big.Int, purpose string) (*Transaction, error) {
+	return newGovernanceTransaction(TxTreasuryProposal, nonce, WithdrawalProposal{Recipient: recipient, Amount: amount, Purpose: purpose})
+}
+
+// NewWithdrawalSignatureTransaction creates a transaction carrying members' signatures
+// for a proposed withdrawal. Each co-signature from a governance member counts once.
+func NewWithdrawalSignatureTransaction(nonce int, proposalID string) (*Transaction, error) {
+	return newGovernanceTransaction(TxTreasurySignature, nonce, WithdrawalReference{ProposalID: proposalID})
+}
+
+// NewWithdrawalExecutionTransaction creates a transaction executing a fully signed
+// withdrawal once its time lock has passed
+func NewWithdrawalExecutionTransaction(nonce int, proposalID string) (*Transaction, error) {
+	return newGovernanceTransaction(TxTreasuryExecution, nonce, WithdrawalReference{ProposalID: proposalID})
+}
+
+// applyWithdrawalProposal records a new withdrawal signed by its proposer
+func (s *ChainState) applyWithdrawalProposal(tx *Transaction) error {
+	var proposal WithdrawalProposal
+	if err := json.Unmarshal([]byte(tx.Payload), &proposal); err != nil {
+		return fmt.Errorf("invalid withdrawal proposal payload: %v", err)
+	}
+	if proposal.Recipient == "" || proposal.Amount == nil || proposal.Amount.Sign() <= 0 {
+		return fmt.Errorf("withdrawal proposal needs a recipient and a positive amount")
+	}
+	if _, exists := s.Treasury.Withdrawals[tx.ID]; exists {
+		return fmt.Errorf("withdrawal %s already proposed", tx.ID)
+	}
+
+	signers := tx.ValidCoSigners(s.Governance.IsMember)
+	if len(signers) == 0 {
+		return fmt.Errorf("withdrawal proposal not signed by a governance member")
+	}
+
+	withdrawal := &TreasuryWithdrawal{
+		ID:               tx.ID,
+		Recipient:        proposal.Recipient,
+		Amount:           new(big.Int).Set(proposal.Amount),
+		Purpose:          proposal.Purpose,
+		ProposedBy:       signers[0],
+		ProposedHeight:   s.blockHeight,
+		ExecutableHeight: s.blockHeight + TreasuryWithdrawalTimelock,
+		Signers:          signers,
+	}
+	s.Treasury.Withdrawals[tx.ID] = withdrawal
+	entry := s.journalEntry(JournalWithdrawalProposal, withdrawal.Amount,
+		fmt.Sprintf("Proposal %s to %s: %s", withdrawal.ID, withdrawal.Recipient, withdrawal.Purpose))
+	entry.Signers = append([]string(nil), signers...)
+	s.Treasury.record(entry)
+	return nil
+}
+
+// applyWithdrawalSignature adds members' signatures to a pending withdrawal
+func (s *ChainState) applyWithdrawalSignature(tx *Transaction) error {
+	withdrawal, err := s.pendingWithdrawal(tx)
+	if err != nil {
+		return err
+	}
+
+	var added []string
+	for _, signer := range tx.ValidCoSigners(s.Governance.IsMember) {
+		if !withdrawal.hasSigner(signer) {
+			withdrawal.Signers = append(withdrawal.Signers, signer)
+			added = append(added, signer)
+		}
+	}
+	if len(added) == 0 {
+		return fmt.Errorf("no new governance signatures for withdrawal %s", withdrawal.ID)
+	}
+
+	entry := s.journalEntry(JournalWithdrawalSignature, withdrawal.Amount,
+		fmt.Sprintf("Signatures for proposal %s (%d of %d)", withdrawal.ID, len(withdrawal.Signers), s.Governance.Threshold))
+	entry.Signers = added
+	s.Treasury.record(entry)
+	return nil
+}
+
+// applyWithdrawalExecution pays out a withdrawal that has enough signatures
+// and whose time lock has passed
+func (s *ChainState) applyWithdrawalExecution(tx *Transaction) error {
+	withdrawal, err := s.pendingWithdrawal(tx)
+	if err != nil {
+		return err
+	}
+	if len(withdrawal.Signers) < s.Governance.Threshold {
+		return fmt.Errorf("withdrawal %s has %d of %d required signatures", withdrawal.ID, len(withdrawal.Signers), s.Governance.Threshold)
+	}
+	if s.blockHeight < withdrawal.ExecutableHeight {
+		return fmt.Errorf("withdrawal %s is time locked until height %d", withdrawal.ID, withdrawal.ExecutableHeight)
+	}
+	if s.BalanceOf(CoalitionAddress).Cmp(withdrawal.Amount) < 0 {
+		return fmt.Errorf("coalition treasury cannot cover withdrawal of %s", withdrawal.Amount.String())
+	}
+
+	withdrawal.Executed = true
+	withdrawal.ExecutedHeight = s.blockHeight
+	entry := s.journalEntry(JournalWithdrawal, withdrawal.Amount, fmt.Sprintf("Withdrawal %s: %s", withdrawal.ID, withdrawal.Purpose))
+	entry.Signers = append([]string(nil), withdrawal.Signers...)
+	s.withdrawTreasury(entry)
+	s.credit(withdrawal.Recipient, withdrawal.Amount, JournalWithdrawal, fmt.Sprintf("Withdrawal %s", withdrawal.ID))
+	return nil
+}
+
+// pendingWithdrawal looks up the unexecuted withdrawal a transaction refers to
+func (s *ChainState) pendingWithdrawal(tx *Transaction) (*TreasuryWithdrawal, error) {
+	var reference WithdrawalReference
+	if err := json.Unmarshal([]byte(tx.Payload), &reference); err != nil {
+		return nil, fmt.Errorf("invalid withdrawal reference payload: %v", err)
+	}
+	withdrawal, exists := s.Treasury.Withdrawals[reference.ProposalID]
+	if !exists {
+		return nil, fmt.Errorf("unknown withdrawal %s", reference.ProposalID)
+	}
+	if withdrawal.Executed {
+		return nil, fmt.Errorf("withdrawal %s already executed at height %d", withdrawal.ID, withdrawal.ExecutedHeight)
+	}
+	return withdrawal, nil
+}
+
+// GetTreasuryWithdrawal returns a multisig withdrawal by proposal ID
+func GetTreasuryWithdrawal(proposalID string) (*TreasuryWithdrawal, bool) {
+	treasury := currentTreasury()
+	if treasury == nil {
+		return nil, false
+	}
+	withdrawal, exists := treasury.Withdrawals[proposalID]
+	return withdrawal, exists
+}